@@ -0,0 +1,137 @@
+package kvndb
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultAccessLogFactor = 10
+	defaultAccessDecay     = time.Minute
+
+	// accessInitial is counter of newly put entry, so it is not the
+	// first candidate for eviction right away
+	accessInitial = 5
+)
+
+// accessCounter is approximate logarithmic access counter of an entry.
+// The more accesses counter has seen, the less likely it is to be
+// incremented, so 8 bits cover millions of accesses. Counter decays by
+// one for every decay period without access.
+type accessCounter struct {
+	count uint8
+	// last is time of the last decay, in decay periods
+	last uint32
+}
+
+// accessTable holds access counters of all entries. All methods are
+// called with datastore mutex held and are no-op on nil table, which
+// is used when access is not tracked.
+type accessTable struct {
+	counters  map[string]accessCounter
+	logFactor int
+	decay     time.Duration
+	rand      *rand.Rand
+	now       func() time.Time
+}
+
+func newAccessTable(logFactor int, decay time.Duration, now func() time.Time) *accessTable {
+	return &accessTable{
+		counters:  make(map[string]accessCounter),
+		logFactor: logFactor,
+		decay:     decay,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:       now,
+	}
+}
+
+// period returns current time in decay periods.
+func (t *accessTable) period() uint32 {
+	return uint32(t.now().UnixNano() / int64(t.decay))
+}
+
+// decayed returns counter decreased by number of periods since it was
+// last decayed.
+func (t *accessTable) decayed(c accessCounter, now uint32) accessCounter {
+	elapsed := now - c.last
+	if elapsed >= uint32(c.count) {
+		c.count = 0
+	} else {
+		c.count -= uint8(elapsed)
+	}
+	c.last = now
+
+	return c
+}
+
+// touch records access of entry with given key.
+func (t *accessTable) touch(key string) {
+	if t == nil {
+		return
+	}
+
+	now := t.period()
+	c, ok := t.counters[key]
+	if !ok {
+		t.counters[key] = accessCounter{
+			count: accessInitial,
+			last:  now,
+		}
+		return
+	}
+
+	c = t.decayed(c, now)
+	if c.count < 255 {
+		base := 0
+		if c.count > accessInitial {
+			base = int(c.count - accessInitial)
+		}
+		if t.rand.Float64() < 1/float64(base*t.logFactor+1) {
+			c.count++
+		}
+	}
+	t.counters[key] = c
+}
+
+// get returns current counter of entry with given key.
+func (t *accessTable) get(key string) (uint8, bool) {
+	if t == nil {
+		return 0, false
+	}
+
+	c, ok := t.counters[key]
+	if !ok {
+		return 0, false
+	}
+
+	return t.decayed(c, t.period()).count, true
+}
+
+func (t *accessTable) remove(key string) {
+	if t == nil {
+		return
+	}
+
+	delete(t.counters, key)
+}
+
+func (t *accessTable) reset() {
+	if t == nil {
+		return
+	}
+
+	t.counters = make(map[string]accessCounter)
+}
+
+func (t *accessTable) clone() *accessTable {
+	if t == nil {
+		return nil
+	}
+
+	c := newAccessTable(t.logFactor, t.decay, t.now)
+	for key, counter := range t.counters {
+		c.counters[key] = counter
+	}
+
+	return c
+}
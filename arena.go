@@ -0,0 +1,191 @@
+package kvndb
+
+import "math"
+
+const (
+	defaultArenaChunkSize = 4 << 20
+)
+
+// arenaRef points to a value stored in arena chunk. Unlike a slice it
+// contains no pointers, so GC only follows keys of map holding refs,
+// not a pointer per value.
+type arenaRef struct {
+	chunk  uint32
+	offset uint32
+	length uint32
+}
+
+// arenaEngine keeps values packed in large byte chunks instead of
+// individual heap allocations. Chunks are append-only, space of
+// overwritten and deleted values is reclaimed by compaction once
+// it outweighs live data.
+type arenaEngine struct {
+	chunkSize int
+	chunks    [][]byte
+	refs      map[string]arenaRef
+	live      int
+	garbage   int
+	keyBytes  int64
+}
+
+func newArenaEngine(chunkSize int) *arenaEngine {
+	if chunkSize <= 0 {
+		chunkSize = defaultArenaChunkSize
+	}
+	// references hold uint32 offsets
+	if uint64(chunkSize) > math.MaxUint32 {
+		chunkSize = math.MaxUint32
+	}
+
+	return &arenaEngine{
+		chunkSize: chunkSize,
+		chunks:    make([][]byte, 0),
+		refs:      make(map[string]arenaRef),
+	}
+}
+
+func (e *arenaEngine) get(key string) ([]byte, error) {
+	ref, ok := e.refs[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	// copy value out, so callers never pin or modify arena chunks
+	value := make([]byte, ref.length)
+	copy(value, e.view(ref))
+
+	return value, nil
+}
+
+func (e *arenaEngine) put(key string, value []byte) error {
+	// references hold uint32 lengths
+	if uint64(len(value)) > math.MaxUint32 {
+		return ErrValueTooLarge
+	}
+
+	if ref, ok := e.refs[key]; ok {
+		e.release(ref)
+	} else {
+		e.keyBytes += int64(len(key))
+	}
+
+	e.refs[key] = e.alloc(value)
+	e.live += len(value)
+
+	e.maybeCompact()
+
+	return nil
+}
+
+func (e *arenaEngine) delete(key string) bool {
+	ref, ok := e.refs[key]
+	if !ok {
+		return false
+	}
+
+	e.release(ref)
+	delete(e.refs, key)
+	e.keyBytes -= int64(len(key))
+
+	e.maybeCompact()
+
+	return true
+}
+
+func (e *arenaEngine) len() int {
+	return len(e.refs)
+}
+
+// memSize counts garbage too, it is held in chunks until compaction.
+func (e *arenaEngine) memSize() int64 {
+	return e.keyBytes + int64(len(e.refs))*mapEntryOverhead + int64(e.live+e.garbage)
+}
+
+func (e *arenaEngine) forEach(fn func(key string, value []byte) error) error {
+	for key, ref := range e.refs {
+		if err := fn(key, e.view(ref)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *arenaEngine) reset() error {
+	e.chunks = make([][]byte, 0)
+	e.refs = make(map[string]arenaRef)
+	e.live = 0
+	e.garbage = 0
+	e.keyBytes = 0
+
+	return nil
+}
+
+func (e *arenaEngine) close() error {
+	e.chunks = nil
+	e.refs = nil
+
+	return nil
+}
+
+// view returns slice of arena chunk holding referenced value. Capacity
+// is capped, so appending to the view never writes into the arena.
+// Since chunks are append-only, view stays valid after later mutations.
+func (e *arenaEngine) view(ref arenaRef) []byte {
+	start := ref.offset
+	end := ref.offset + ref.length
+
+	return e.chunks[ref.chunk][start:end:end]
+}
+
+func (e *arenaEngine) alloc(value []byte) arenaRef {
+	// values bigger than chunk size get dedicated chunk
+	if len(value) > e.chunkSize {
+		chunk := make([]byte, len(value))
+		copy(chunk, value)
+		e.chunks = append(e.chunks, chunk)
+		return arenaRef{
+			chunk:  uint32(len(e.chunks) - 1),
+			offset: 0,
+			length: uint32(len(value)),
+		}
+	}
+
+	last := len(e.chunks) - 1
+	if last < 0 || cap(e.chunks[last])-len(e.chunks[last]) < len(value) {
+		e.chunks = append(e.chunks, make([]byte, 0, e.chunkSize))
+		last = len(e.chunks) - 1
+	}
+
+	offset := len(e.chunks[last])
+	e.chunks[last] = append(e.chunks[last], value...)
+
+	return arenaRef{
+		chunk:  uint32(last),
+		offset: uint32(offset),
+		length: uint32(len(value)),
+	}
+}
+
+func (e *arenaEngine) release(ref arenaRef) {
+	e.live -= int(ref.length)
+	e.garbage += int(ref.length)
+}
+
+// maybeCompact copies live values into fresh chunks when garbage takes
+// more space than live values. Old chunks are left to GC.
+func (e *arenaEngine) maybeCompact() {
+	if e.garbage < e.chunkSize || e.garbage < e.live {
+		return
+	}
+
+	old := e.chunks
+	e.chunks = make([][]byte, 0)
+	for key, ref := range e.refs {
+		start := ref.offset
+		end := ref.offset + ref.length
+		e.refs[key] = e.alloc(old[ref.chunk][start:end])
+	}
+
+	e.garbage = 0
+}
@@ -0,0 +1,214 @@
+package kvndb
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Backup archive holds snapshot under its usual file name, preceded by
+// its checksum file and manifest describing it, so RestoreBackup can
+// verify snapshot while it is extracted.
+
+func (d *db) Backup(w io.Writer) (err error) {
+	defer func() {
+		err = wrapSnapshotError("backup", "", 0, err)
+	}()
+
+	tmp, err := os.MkdirTemp("", "kvndb-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	// footer index can not be told apart from records until the end
+	// of snapshot, so it is left out for Restore to stream records
+	entry, err := d.writeTempSnapshot(tmp, false)
+	if err != nil {
+		return err
+	}
+
+	fd, err := os.Open(getSnapshotFilepath(tmp, entry.Id))
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	entry.Bytes = fi.Size()
+	entry.Checksum, err = getSnapshotChecksum(entry.Id, tmp)
+	if err != nil {
+		return err
+	}
+	manifest, err := json.MarshalIndent([]SnapshotEntry{entry}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err = writeTarFile(tw, manifestName, bytes.NewReader(manifest), int64(len(manifest)), entry.Created)
+	if err == nil {
+		err = writeTarFile(tw, generateChecksumName(entry.Id), bytes.NewReader(entry.Checksum), int64(len(entry.Checksum)), entry.Created)
+	}
+	if err == nil {
+		err = writeTarFile(tw, generateSnapshotName(entry.Id), fd, entry.Bytes, entry.Created)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	return gw.Close()
+}
+
+// writeTempSnapshot writes snapshot of current data into given
+// directory as snapshot 1, returning its description without size and
+// checksum.
+func (d *db) writeTempSnapshot(dir string, withIndex bool) (SnapshotEntry, error) {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return SnapshotEntry{}, ErrAlreadyClosed
+	}
+
+	entry := SnapshotEntry{
+		Id:       1,
+		Entries:  uint64(d.data.len()),
+		Revision: d.revision,
+		Created:  time.Now(),
+	}
+
+	fd, err := os.OpenFile(getSnapshotFilepath(dir, entry.Id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return entry, err
+	}
+	err = writeSnapshotTo(fd, d.data, d.meta, withIndex, d.opts.codec, d.revision)
+	if err != nil {
+		_ = fd.Close()
+		return entry, err
+	}
+
+	return entry, fd.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, r io.Reader, size int64, modTime time.Time) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, r)
+
+	return err
+}
+
+// readBackup calls fn with base name and content of every file in
+// archive written by Backup, in order they were written.
+func readBackup(r io.Reader, fn func(name string, r io.Reader) error) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		err = fn(path.Base(hdr.Name), tr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// RestoreBackup extracts snapshot from archive written by Backup into
+// new snapshot in given directory, returning its id. Snapshot is kept
+// only if it matches checksum stored in archive. If directory has
+// manifest, restored snapshot is added to it. Existing snapshots are
+// kept, so restored snapshot becomes the latest one.
+func RestoreBackup(r io.Reader, dir string) (id uint, err error) {
+	defer func() {
+		err = wrapSnapshotError("restore", dir, id, err)
+	}()
+
+	var entry *SnapshotEntry
+	var checksum []byte
+	err = readBackup(r, func(name string, r io.Reader) error {
+		var err error
+		switch {
+		case name == manifestName:
+			entries := make([]SnapshotEntry, 0)
+			err = json.NewDecoder(r).Decode(&entries)
+			if err != nil || len(entries) != 1 {
+				return ErrBadManifest
+			}
+			entry = &entries[0]
+		case strings.HasSuffix(name, ".sha256"):
+			checksum, err = io.ReadAll(io.LimitReader(r, 1024))
+		case isSnapshotName(name):
+			if checksum == nil || id != 0 {
+				return ErrBadBackup
+			}
+			id, err = receiveSnapshot(dir, r, checksum)
+		}
+		return err
+	})
+	if err != nil {
+		return id, err
+	}
+	if id == 0 {
+		return 0, ErrBadBackup
+	}
+
+	if entry == nil {
+		return id, nil
+	}
+	_, err = os.Stat(getManifestFilepath(dir))
+	if os.IsNotExist(err) {
+		return id, nil
+	}
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		return id, err
+	}
+	defer lock.unlock()
+
+	return id, updateManifest(dir, &Report{
+		Id:       id,
+		Dir:      dir,
+		Entries:  entry.Entries,
+		Bytes:    entry.Bytes,
+		Checksum: checksum,
+		Revision: entry.Revision,
+		Started:  entry.Created,
+	}, newOptions(nil))
+}
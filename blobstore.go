@@ -0,0 +1,299 @@
+package kvndb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// BlobStore stores named objects, e.g. in object storage, for SaveTo
+// and LoadFrom. Implementations must be safe for concurrent use.
+type BlobStore interface {
+	// Put stores object with given name and size, read from r,
+	// replacing existing one. Object must not be visible to Get and
+	// List until it is stored whole.
+	Put(name string, r io.Reader, size int64) error
+	// Get returns content of object with given name, ErrBlobNotFound
+	// if there is none.
+	Get(name string) (io.ReadCloser, error)
+	// List returns names of all objects starting with prefix.
+	List(prefix string) ([]string, error)
+	// Delete removes object with given name. Removing object which
+	// does not exist is not an error.
+	Delete(name string) error
+}
+
+// fsBlobStore is BlobStore keeping objects as files in directory.
+type fsBlobStore struct {
+	dir string
+}
+
+// NewFSBlobStore returns BlobStore keeping objects as files in given
+// directory, which must exist. Object names must not contain path
+// separators.
+func NewFSBlobStore(dir string) BlobStore {
+	return &fsBlobStore{
+		dir: dir,
+	}
+}
+
+// fsBlobCounter makes names of temporary files unique within process.
+var fsBlobCounter uint64
+
+func (s *fsBlobStore) Put(name string, r io.Reader, size int64) error {
+	n := atomic.AddUint64(&fsBlobCounter, 1)
+	tmpPath := filepath.Join(s.dir, fmt.Sprintf(".%s.%d-%d.tmp", name, os.Getpid(), n))
+	err := downloadFile(tmpPath, io.LimitReader(r, size))
+	if err == nil {
+		var fi os.FileInfo
+		fi, err = os.Stat(tmpPath)
+		if err == nil && fi.Size() != size {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filepath.Join(s.dir, name))
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+	}
+
+	return err
+}
+
+func (s *fsBlobStore) Get(name string) (io.ReadCloser, error) {
+	fd, err := os.Open(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+
+	return fd, err
+}
+
+func (s *fsBlobStore) List(prefix string) ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		// temporary files of Put are hidden
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if strings.HasPrefix(e.Name(), prefix) {
+			names = append(names, e.Name())
+		}
+	}
+
+	return names, nil
+}
+
+func (s *fsBlobStore) Delete(name string) error {
+	err := os.Remove(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// blobSnapshotIds returns ids of snapshots in store which have checksum,
+// so they were stored whole, in ascending order.
+func blobSnapshotIds(store BlobStore) ([]uint, error) {
+	names, err := store.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make(map[uint]bool)
+	checksums := make(map[uint]bool)
+	for _, name := range names {
+		if isSnapshotName(name) {
+			snapshots[parseSnapshotName(name)] = true
+		}
+		// checksum is named like snapshot with different extension
+		snapshot := strings.TrimSuffix(name, ".sha256") + ".kvndb"
+		if snapshot != name+".kvndb" && isSnapshotName(snapshot) {
+			checksums[parseSnapshotName(snapshot)] = true
+		}
+	}
+
+	ids := make([]uint, 0, len(snapshots))
+	for id := range snapshots {
+		if checksums[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	return ids, nil
+}
+
+func (d *db) SaveTo(store BlobStore, hist uint) (err error) {
+	var id uint
+	defer func() {
+		err = wrapSnapshotError("save", "blob store", id, err)
+	}()
+
+	if hist > maxHistory {
+		return ErrTooMuchHistory
+	}
+
+	tmp, err := os.MkdirTemp("", "kvndb-save-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	entry, err := d.writeTempSnapshot(tmp, d.opts.snapshotIndex)
+	if err != nil {
+		return err
+	}
+	checksum, err := getSnapshotChecksum(entry.Id, tmp)
+	if err != nil {
+		return err
+	}
+
+	ids, err := blobSnapshotIds(store)
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		id = ids[len(ids)-1]
+	}
+	id++
+
+	fd, err := os.Open(getSnapshotFilepath(tmp, entry.Id))
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	// checksum is stored last, marking snapshot complete
+	err = store.Put(generateSnapshotName(id), fd, fi.Size())
+	if err != nil {
+		return err
+	}
+	err = store.Put(generateChecksumName(id), bytes.NewReader(checksum), int64(len(checksum)))
+	if err != nil {
+		return err
+	}
+
+	d.opts.logger.Infof("kvndb: saved snapshot %d with %d entries to blob store", id, entry.Entries)
+
+	ids = append(ids, id)
+	for len(ids) > int(hist)+1 {
+		err = deleteBlobSnapshot(store, ids[0])
+		if err != nil {
+			return err
+		}
+		ids = ids[1:]
+	}
+
+	return nil
+}
+
+// deleteBlobSnapshot removes snapshot from store, checksum first, so
+// partially removed snapshot is not loaded.
+func deleteBlobSnapshot(store BlobStore, id uint) error {
+	for _, name := range []string{generateChecksumName(id), generateSnapshotName(id)} {
+		err := store.Delete(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *db) LoadFrom(store BlobStore) error {
+	d.keyLocks.lockAll()
+	defer d.keyLocks.unlockAll()
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return ErrAlreadyClosed
+	}
+
+	err := loadFromStore(d, store)
+	d.setLoadErr(err)
+	if err != nil && !errors.Is(err, ErrSnapshotNotFound) {
+		d.opts.logger.Errorf("kvndb: failed to load snapshot from blob store: %v", err)
+	}
+
+	return err
+}
+
+// loadFromStore replaces data with records of the latest snapshot in
+// store, streaming them from it.
+func loadFromStore(d *db, store BlobStore) (err error) {
+	var id uint
+	defer func() {
+		err = wrapSnapshotError("load", "blob store", id, err)
+	}()
+
+	report := newReport("", time.Now())
+	d.modified()
+	d.changes.reset()
+
+	err = resetData(d, nil)
+	if err != nil {
+		return err
+	}
+
+	ids, err := blobSnapshotIds(store)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		d.opts.logger.Warnf("kvndb: no snapshots to load in blob store")
+		return ErrSnapshotNotFound
+	}
+	id = ids[len(ids)-1]
+
+	rc, err := store.Get(generateChecksumName(id))
+	if err != nil {
+		return err
+	}
+	checksum, err := io.ReadAll(io.LimitReader(rc, 1024))
+	_ = rc.Close()
+	if err != nil {
+		return err
+	}
+
+	rc, err = store.Get(generateSnapshotName(id))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	err = restoreSnapshot(d, rc, checksum, report)
+	if err != nil {
+		return resetData(d, err)
+	}
+
+	report.Id = id
+	report.Entries = uint64(d.data.len())
+	report.Duration = time.Since(report.Started)
+	d.lastLoad = report
+
+	d.opts.logger.Infof("kvndb: loaded snapshot %d with %d entries from blob store in %s", id, report.Entries, report.Duration)
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package kvndb
+
+// changeLog retains the most recent changes of data, so replication
+// followers can continue from the revision of snapshot they loaded.
+// Retained changes always have consecutive revisions, when data is
+// replaced as a whole, or changed in a way which can not be replicated,
+// log is emptied and all listeners are closed. It is guarded by
+// datastore lock. Methods of nil *changeLog do nothing.
+type changeLog struct {
+	size      int
+	entries   []Event
+	listeners []chan Event
+}
+
+func newChangeLog(size int) *changeLog {
+	return &changeLog{
+		size:    size,
+		entries: make([]Event, 0, size),
+	}
+}
+
+// append records change resulting in given revision and passes it to
+// listeners. Listeners which do not keep up are closed.
+func (c *changeLog) append(kind EventKind, key, value []byte, rev uint64) {
+	if c == nil {
+		return
+	}
+
+	// value of entry put with PutReader is not known
+	if kind == EventPut && value == nil {
+		c.reset()
+		return
+	}
+	if n := len(c.entries); n > 0 && c.entries[n-1].Revision+1 != rev {
+		c.reset()
+	}
+
+	ev := Event{
+		Kind:     kind,
+		Key:      append([]byte(nil), key...),
+		Revision: rev,
+	}
+	if kind == EventPut {
+		ev.Value = append([]byte{}, value...)
+	}
+
+	if len(c.entries) == c.size {
+		copy(c.entries, c.entries[1:])
+		c.entries = c.entries[:len(c.entries)-1]
+	}
+	c.entries = append(c.entries, ev)
+
+	listeners := c.listeners[:0]
+	for _, l := range c.listeners {
+		select {
+		case l <- ev:
+			listeners = append(listeners, l)
+		default:
+			close(l)
+		}
+	}
+	c.listeners = listeners
+}
+
+// subscribe returns changes made after given revision, rev being the
+// current revision of data, and channel receiving following ones. It
+// returns false if changes since given revision are no longer retained.
+func (c *changeLog) subscribe(from, rev uint64) ([]Event, <-chan Event, bool) {
+	if c == nil || from > rev {
+		return nil, nil, false
+	}
+
+	start := len(c.entries)
+	if from < rev {
+		if start == 0 || c.entries[0].Revision > from+1 || c.entries[start-1].Revision != rev {
+			return nil, nil, false
+		}
+		start = int(from + 1 - c.entries[0].Revision)
+	}
+	backlog := append([]Event(nil), c.entries[start:]...)
+
+	l := make(chan Event, c.size)
+	c.listeners = append(c.listeners, l)
+
+	return backlog, l, true
+}
+
+// unsubscribe closes given listener, unless it is already closed.
+func (c *changeLog) unsubscribe(ch <-chan Event) {
+	if c == nil {
+		return
+	}
+
+	for i, l := range c.listeners {
+		if l == ch {
+			c.listeners = append(c.listeners[:i], c.listeners[i+1:]...)
+			close(l)
+			return
+		}
+	}
+}
+
+// reset forgets retained changes and closes all listeners.
+func (c *changeLog) reset() {
+	if c == nil {
+		return
+	}
+
+	c.entries = c.entries[:0]
+	for _, l := range c.listeners {
+		close(l)
+	}
+	c.listeners = nil
+}
@@ -0,0 +1,201 @@
+package kvndb
+
+import (
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/golang/snappy"
+)
+
+// defaultChecksumChunkSize is size of snapshot file chunks checksummed
+// separately when chunk checksums are enabled.
+const defaultChecksumChunkSize = 4 << 20
+
+// CorruptRegion is region of snapshot file which content does not
+// match its checksum.
+type CorruptRegion struct {
+	Offset int64
+	Size   int64
+}
+
+// chunkChecksums are checksums of fixed size chunks of snapshot file,
+// stored next to it. Layout: chunk size (uint32), followed by sha256
+// of every chunk. The last chunk may be shorter than chunk size.
+type chunkChecksums struct {
+	size   int64
+	hashes [][]byte
+}
+
+func (c *chunkChecksums) bytes() []byte {
+	result := make([]byte, 0, 4+len(c.hashes)*sha256.Size)
+	result = append(result, uint32ToBytes(uint32(c.size))...)
+	for _, hash := range c.hashes {
+		result = append(result, hash...)
+	}
+
+	return result
+}
+
+func parseChunkChecksums(b []byte) (*chunkChecksums, error) {
+	if len(b) < 4 || (len(b)-4)%sha256.Size != 0 {
+		return nil, ErrBadSnapshot
+	}
+
+	c := &chunkChecksums{
+		size: int64(bytesToUint32(b[0:4])),
+	}
+	if c.size == 0 {
+		return nil, ErrBadSnapshot
+	}
+	for b = b[4:]; len(b) > 0; b = b[sha256.Size:] {
+		c.hashes = append(c.hashes, b[:sha256.Size])
+	}
+
+	return c, nil
+}
+
+// computeChunkChecksums returns checksums of chunks of given size of
+// whole content of r.
+func computeChunkChecksums(r io.Reader, size int64) (*chunkChecksums, error) {
+	c := &chunkChecksums{
+		size:   size,
+		hashes: make([][]byte, 0),
+	}
+
+	for {
+		hasher := sha256.New()
+		n, err := io.CopyN(hasher, r, size)
+		if n > 0 {
+			c.hashes = append(c.hashes, hasher.Sum(nil))
+		}
+		if err == io.EOF {
+			return c, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// verify returns regions of content of r not matching checksums.
+func (c *chunkChecksums) verify(r io.Reader) ([]CorruptRegion, error) {
+	actual, err := computeChunkChecksums(r, c.size)
+	if err != nil {
+		return nil, err
+	}
+
+	regions := make([]CorruptRegion, 0)
+	n := len(c.hashes)
+	if len(actual.hashes) > n {
+		n = len(actual.hashes)
+	}
+	for i := 0; i < n; i++ {
+		if i < len(c.hashes) && i < len(actual.hashes) && string(c.hashes[i]) == string(actual.hashes[i]) {
+			continue
+		}
+		regions = append(regions, CorruptRegion{
+			Offset: int64(i) * c.size,
+			Size:   c.size,
+		})
+	}
+
+	return regions, nil
+}
+
+func writeChunkChecksums(id uint, dir string, size int64, perm os.FileMode, sync bool) error {
+	fd, err := os.Open(getSnapshotFilepath(dir, id))
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	c, err := computeChunkChecksums(fd, size)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(getChunksFilepath(dir, id), c.bytes(), perm, sync)
+}
+
+// readChunkChecksums returns chunk checksums of snapshot, nil if it was
+// saved without them.
+func readChunkChecksums(id uint, dir string) (*chunkChecksums, error) {
+	b, err := ioutil.ReadFile(getChunksFilepath(dir, id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseChunkChecksums(b)
+}
+
+// isCorruption reports whether error reading snapshot was caused by
+// its content rather than failure to read it.
+func isCorruption(err error) bool {
+	switch err {
+	case ErrBadSnapshot, errDataSizeMismatch, errFrameCorrupt, errFrameChecksum, snappy.ErrCorrupt, io.ErrUnexpectedEOF:
+		return true
+	default:
+		return false
+	}
+}
+
+// VerifySnapshot verifies integrity of snapshot with given id in given
+// directory, id of 0 verifies the latest snapshot. It returns regions
+// of snapshot file which are corrupted, empty if snapshot is intact.
+// For snapshots saved with chunk checksums corruption is localized to
+// chunks, otherwise the whole file is reported as one region.
+func VerifySnapshot(dir string, id uint) (regions []CorruptRegion, err error) {
+	defer func() {
+		err = wrapSnapshotError("verify", dir, id, err)
+	}()
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+
+	if id == 0 {
+		id, err = getMaxSnapshotId(dir)
+		if err != nil {
+			return nil, err
+		}
+		if id == 0 {
+			return nil, ErrSnapshotNotFound
+		}
+	}
+
+	c, err := readChunkChecksums(id, dir)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		fd, err := os.Open(getSnapshotFilepath(dir, id))
+		if err != nil {
+			return nil, err
+		}
+		defer fd.Close()
+
+		return c.verify(fd)
+	}
+
+	fi, err := os.Stat(getSnapshotFilepath(dir, id))
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifySnapshotChecksum(id, dir)
+	if isCorruption(err) {
+		return []CorruptRegion{{Offset: 0, Size: fi.Size()}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return []CorruptRegion{}, nil
+}
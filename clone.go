@@ -0,0 +1,130 @@
+package kvndb
+
+// cloneEngine is implemented by engines able to copy themselves
+// sharing stored values with the copy.
+type cloneEngine interface {
+	clone() engine
+}
+
+// cloneData returns copy of engine, built from scratch with given
+// options if engine is not cloneEngine.
+func cloneData(e engine, o *options) (engine, error) {
+	if ce, ok := e.(cloneEngine); ok {
+		return ce.clone(), nil
+	}
+
+	c := o.newEngine()
+	err := e.forEach(c.put)
+	if err != nil {
+		_ = c.close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (e *mapEngine) clone() engine {
+	c := &mapEngine{
+		data:  make(map[string][]byte, len(e.data)),
+		bytes: e.bytes,
+	}
+	for key, value := range e.data {
+		c.data[key] = value
+	}
+
+	return c
+}
+
+func (e *arenaEngine) clone() engine {
+	// chunks are shared, neither engine may append to the last one
+	// anymore, so both get capped view of it
+	if last := len(e.chunks) - 1; last >= 0 {
+		e.chunks[last] = e.chunks[last][:len(e.chunks[last]):len(e.chunks[last])]
+	}
+
+	c := &arenaEngine{
+		chunkSize: e.chunkSize,
+		chunks:    append([][]byte{}, e.chunks...),
+		refs:      make(map[string]arenaRef, len(e.refs)),
+		live:      e.live,
+		garbage:   e.garbage,
+		keyBytes:  e.keyBytes,
+	}
+	for key, ref := range e.refs {
+		c.refs[key] = ref
+	}
+
+	return c
+}
+
+func (t *metaTable) clone() *metaTable {
+	if t == nil {
+		return nil
+	}
+
+	c := newMetaTable(t.wall)
+	for key, m := range t.entries {
+		c.entries[key] = m
+	}
+
+	return c
+}
+
+func (d *db) Clone() (DB, error) {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return nil, ErrAlreadyClosed
+	}
+
+	o := *d.opts
+	o.expvarName = ""
+	o.finalSaveDir = ""
+
+	data, err := cloneData(d.data, &o)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newDbWithOptions(&o)
+	_ = c.data.close()
+	c.data = data
+	c.meta = d.meta.clone()
+	c.access = d.access.clone()
+	c.ttl = d.ttl.clone()
+	// clone holds data of this revision, entry revisions refer to it
+	c.revision = d.revision
+
+	return c, nil
+}
+
+func (d *db) CopyTo(dst DB, overwrite bool) error {
+	if other, ok := dst.(*db); ok && other == d {
+		return nil
+	}
+
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return ErrAlreadyClosed
+	}
+
+	d.removeExpired()
+
+	return d.data.forEach(func(key string, value []byte) error {
+		if !overwrite {
+			exists, err := dst.Has([]byte(key))
+			if err != nil {
+				return err
+			}
+			if exists {
+				return nil
+			}
+		}
+
+		// dst may keep value, it must not share it with this datastore
+		return dst.Put([]byte(key), d.safeValue(value))
+	})
+}
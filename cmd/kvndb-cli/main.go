@@ -0,0 +1,123 @@
+// Command kvndb-cli inspects and edits kvndb snapshot directories.
+//
+// Usage:
+//
+//	kvndb-cli shell <dir>
+//	kvndb-cli dump [-hash] [-preview n] <dir> [id]
+//	kvndb-cli to-json <dir> [id]
+//	kvndb-cli from-json <dir>
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/akamensky/kvndb"
+)
+
+const usage = `usage: kvndb-cli <command> [arguments]
+
+commands:
+  shell <dir>                            interactive shell over the latest snapshot in dir
+  dump [-hash] [-preview n] <dir> [id]   print records of snapshot, the latest by default
+  to-json <dir> [id]                     print snapshot as newline delimited JSON
+  from-json <dir>                        write newline delimited JSON from stdin as new snapshot
+`
+
+func main() {
+	err := run(os.Args[1:], os.Stdin, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "kvndb-cli:", err)
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("bad usage")
+
+func run(args []string, in io.Reader, out io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return errUsage
+	}
+
+	switch args[0] {
+	case "shell":
+		if len(args) != 2 {
+			fmt.Fprint(os.Stderr, usage)
+			return errUsage
+		}
+		return shell(args[1], in, out)
+	case "dump":
+		return dump(args[1:], out)
+	case "to-json":
+		if len(args) < 2 || len(args) > 3 {
+			fmt.Fprint(os.Stderr, usage)
+			return errUsage
+		}
+		id, err := parseId(args[2:])
+		if err != nil {
+			return err
+		}
+		return kvndb.SnapshotToJSON(out, args[1], id)
+	case "from-json":
+		if len(args) != 2 {
+			fmt.Fprint(os.Stderr, usage)
+			return errUsage
+		}
+		id, err := kvndb.SnapshotFromJSON(in, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "wrote snapshot %d\n", id)
+		return nil
+	case "help", "-h", "--help":
+		fmt.Fprint(out, usage)
+		return nil
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+func dump(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	hash := flags.Bool("hash", false, "print sha256 of every value")
+	preview := flags.Int("preview", 0, "print first `n` bytes of every value")
+	err := flags.Parse(args)
+	if err != nil {
+		return errUsage
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		fmt.Fprint(os.Stderr, usage)
+		return errUsage
+	}
+
+	id, err := parseId(flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+
+	return kvndb.DumpSnapshot(out, flags.Arg(0), id, kvndb.DumpOptions{
+		Preview: *preview,
+		Hash:    *hash,
+	})
+}
+
+// parseId returns snapshot id given as optional argument, 0 meaning the
+// latest snapshot if there is none.
+func parseId(args []string) (uint, error) {
+	if len(args) == 0 {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseUint(args[0], 10, 0)
+	if err != nil {
+		return 0, fmt.Errorf("bad snapshot id %q", args[0])
+	}
+
+	return uint(id), nil
+}
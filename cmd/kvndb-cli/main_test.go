@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestShell(t *testing.T) {
+	dir := t.TempDir()
+
+	in := strings.NewReader("put a hello world\nput b \x01\nget a\nget b\nscan\nsave\ndel a\nget a\nexit\n")
+	out := &bytes.Buffer{}
+	if err := run([]string{"shell", dir}, in, out); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"hello world\n", "\"\\x01\"\n", "a\t11 bytes\nb\t1 bytes\n", "saved snapshot 1\n", "error: kvndb: key not found\n"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("expected output to contain %q, but got %q", expected, out.String())
+		}
+	}
+
+	// saved snapshot is loaded by the next shell
+	out.Reset()
+	if err := run([]string{"shell", dir}, strings.NewReader("get a\n"), out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "loaded snapshot 1 with 2 entries\n") || !strings.Contains(out.String(), "hello world\n") {
+		t.Fatalf("expected saved snapshot to be loaded, but got %q", out.String())
+	}
+}
+
+func TestShellSaveKeepsHistory(t *testing.T) {
+	dir := t.TempDir()
+
+	for i := 0; i < 3; i++ {
+		if err := run([]string{"shell", dir}, strings.NewReader("put a 1\nsave\n"), &bytes.Buffer{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		if err := run([]string{"dump", dir, id}, nil, &bytes.Buffer{}); err != nil {
+			t.Fatalf("expected snapshot %s to be kept, but got [%v]", id, err)
+		}
+	}
+
+	// explicit history prunes older snapshots
+	out := &bytes.Buffer{}
+	if err := run([]string{"shell", dir}, strings.NewReader("save 1\n"), out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "saved snapshot 4\n") {
+		t.Fatalf("expected snapshot 4 to be saved, but got %q", out.String())
+	}
+	if err := run([]string{"dump", dir, "2"}, nil, &bytes.Buffer{}); err == nil {
+		t.Fatal("expected snapshot 2 to be removed")
+	}
+	if err := run([]string{"dump", dir, "3"}, nil, &bytes.Buffer{}); err != nil {
+		t.Fatalf("expected snapshot 3 to be kept, but got [%v]", err)
+	}
+}
+
+func TestDump(t *testing.T) {
+	dir := t.TempDir()
+
+	in := strings.NewReader("put key value\nsave\n")
+	if err := run([]string{"shell", dir}, in, &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := run([]string{"dump", "-preview", "3", dir, "1"}, nil, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "6b6579\t5\t\"val\"\n" {
+		t.Fatalf("unexpected dump %q", out.String())
+	}
+}
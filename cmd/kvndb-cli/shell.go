@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/akamensky/kvndb"
+)
+
+const shellHelp = `commands:
+  get <key>               print value of key
+  put <key> <value>       set key to value, rest of the line is value
+  del <key>               delete key
+  scan [prefix] [limit]   print keys with prefix in order, 100 by default
+  stats                   print datastore statistics
+  save [history]          save changes as new snapshot, keeping history
+                          previous snapshots, all by default
+  help                    print this help
+  exit                    leave shell, unsaved changes are lost
+`
+
+// defaultScanLimit is number of keys printed by scan without limit.
+const defaultScanLimit = 100
+
+// keepAllHistory is the most history Save accepts, which in practice
+// keeps all snapshots.
+const keepAllHistory = 999_999
+
+// shell loads the latest snapshot in dir, or starts empty if there is
+// none, and runs commands read from in until it is exhausted or exit
+// command.
+func shell(dir string, in io.Reader, out io.Writer) error {
+	d := kvndb.New()
+	defer d.Close()
+
+	err := d.Load(dir)
+	if errors.Is(err, kvndb.ErrSnapshotNotFound) {
+		fmt.Fprintf(out, "no snapshots in %s, starting empty\n", dir)
+	} else if err != nil {
+		return err
+	} else {
+		fmt.Fprintf(out, "loaded snapshot %d with %d entries\n", d.LastLoad().Id, d.Size())
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 64<<20)
+	for {
+		fmt.Fprint(out, "kvndb> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+
+		cmd, args := splitCommand(scanner.Text())
+		if cmd == "exit" || cmd == "quit" {
+			return nil
+		}
+		err = execute(d, dir, cmd, args, out)
+		if err != nil {
+			fmt.Fprintln(out, "error:", err)
+		}
+	}
+}
+
+// splitCommand returns command name and the rest of line.
+func splitCommand(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	i := strings.IndexFunc(line, unicode.IsSpace)
+	if i < 0 {
+		return line, ""
+	}
+
+	return line[:i], strings.TrimSpace(line[i:])
+}
+
+func execute(d kvndb.DB, dir, cmd, args string, out io.Writer) error {
+	switch cmd {
+	case "":
+		return nil
+	case "get":
+		value, err := d.Get([]byte(args))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, format(value))
+	case "put":
+		key, value := splitCommand(args)
+		if key == "" {
+			return errors.New("usage: put <key> <value>")
+		}
+		return d.Put([]byte(key), []byte(value))
+	case "del":
+		return d.Delete([]byte(args))
+	case "scan":
+		return scan(d, args, out)
+	case "stats":
+		s := d.Stats()
+		fmt.Fprintf(out, "entries: %d\nbytes: %d\nrevision: %d\n", s.Entries, s.Bytes, d.Revision())
+		if last := d.LastLoad(); last != nil {
+			fmt.Fprintf(out, "loaded: snapshot %d, %d bytes, created %s\n", last.Id, last.Bytes, last.Started.Format("2006-01-02 15:04:05"))
+		}
+	case "save":
+		hist := uint64(keepAllHistory)
+		if args != "" {
+			n, err := strconv.ParseUint(args, 10, 0)
+			if err != nil || n > keepAllHistory {
+				return errors.New("usage: save [history]")
+			}
+			hist = n
+		}
+		err := d.Save(dir, uint(hist))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "saved snapshot %d\n", d.LastSave().Id)
+	case "help":
+		fmt.Fprint(out, shellHelp)
+	default:
+		return fmt.Errorf("unknown command %q, try help", cmd)
+	}
+
+	return nil
+}
+
+func scan(d kvndb.DB, args string, out io.Writer) error {
+	fields := strings.Fields(args)
+	if len(fields) > 2 {
+		return errors.New("usage: scan [prefix] [limit]")
+	}
+	prefix := ""
+	if len(fields) > 0 {
+		prefix = fields[0]
+	}
+	limit := defaultScanLimit
+	if len(fields) > 1 {
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n <= 0 {
+			return errors.New("limit must be a positive number")
+		}
+		limit = n
+	}
+
+	ch, err := d.Range([]byte(prefix), kvndb.PrefixEnd([]byte(prefix)))
+	if err != nil {
+		return err
+	}
+	n := 0
+	// channel must be drained to release datastore
+	for tuple := range ch {
+		if n < limit {
+			fmt.Fprintf(out, "%s\t%d bytes\n", format(tuple.Key), len(tuple.Value))
+		}
+		n++
+	}
+	if n > limit {
+		fmt.Fprintf(out, "... %d more\n", n-limit)
+	}
+
+	return nil
+}
+
+// format returns b as is if it is printable text, quoted otherwise.
+func format(b []byte) string {
+	if !utf8.Valid(b) {
+		return strconv.Quote(string(b))
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) {
+			return strconv.Quote(string(b))
+		}
+	}
+
+	return string(b)
+}
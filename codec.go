@@ -0,0 +1,146 @@
+package kvndb
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Codec encodes records of snapshots in alternative format. Records
+// are still compressed and checksummed the same way, only their
+// encoding differs. Codec must be registered with RegisterCodec, and
+// its name is stored in snapshot header, so snapshots are decoded
+// with the same codec regardless of options of datastore loading them.
+//
+// Snapshots written with codec have neither footer index nor entry
+// metadata, and can not be opened with OpenLazy, OpenSnapshot or
+// DiffSnapshots, nor resumed by LoadContext.
+type Codec interface {
+	// Name identifies codec, it must be at most 255 bytes long.
+	Name() string
+
+	// NewEncoder returns encoder writing records to w.
+	NewEncoder(w io.Writer) RecordEncoder
+
+	// NewDecoder returns decoder reading records from r.
+	NewDecoder(r io.Reader) RecordDecoder
+}
+
+// RecordEncoder encodes records of snapshot.
+type RecordEncoder interface {
+	// Encode writes record with given key and value.
+	Encode(key, value []byte) error
+
+	// Flush writes any buffered records, it is called once after
+	// the last record.
+	Flush() error
+}
+
+// RecordDecoder decodes records of snapshot.
+type RecordDecoder interface {
+	// Decode returns key and value of the next record, io.EOF if
+	// there are no more records.
+	Decode() (key, value []byte, err error)
+}
+
+var (
+	codecsMutex sync.RWMutex
+	codecs      = map[string]Codec{
+		NDJSONCodec.Name(): NDJSONCodec,
+	}
+)
+
+// RegisterCodec makes codec available to WithCodec and for reading
+// snapshots written with it. Registering codec with the same name
+// replaces previous one.
+func RegisterCodec(c Codec) {
+	if len(c.Name()) == 0 || len(c.Name()) > 255 {
+		panic("kvndb: invalid codec name " + c.Name())
+	}
+
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+
+	codecs[c.Name()] = c
+}
+
+func lookupCodec(name string) (Codec, error) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+
+	c, ok := codecs[name]
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+
+	return c, nil
+}
+
+// NDJSONCodec encodes every record as JSON object on its own line,
+// with key and value encoded in base64.
+var NDJSONCodec Codec = ndjsonCodec{}
+
+type ndjsonCodec struct{}
+
+type ndjsonRecord struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+func (ndjsonCodec) Name() string {
+	return "ndjson"
+}
+
+func (ndjsonCodec) NewEncoder(w io.Writer) RecordEncoder {
+	bw := bufio.NewWriter(w)
+	return &ndjsonEncoder{
+		w:   bw,
+		enc: json.NewEncoder(bw),
+	}
+}
+
+func (ndjsonCodec) NewDecoder(r io.Reader) RecordDecoder {
+	return &ndjsonDecoder{
+		dec: json.NewDecoder(r),
+	}
+}
+
+type ndjsonEncoder struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (e *ndjsonEncoder) Encode(key, value []byte) error {
+	return e.enc.Encode(ndjsonRecord{
+		Key:   key,
+		Value: value,
+	})
+}
+
+func (e *ndjsonEncoder) Flush() error {
+	return e.w.Flush()
+}
+
+type ndjsonDecoder struct {
+	dec *json.Decoder
+}
+
+func (d *ndjsonDecoder) Decode() ([]byte, []byte, error) {
+	var record ndjsonRecord
+	err := d.dec.Decode(&record)
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return nil, nil, ErrBadSnapshot
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if record.Value == nil {
+		record.Value = []byte{}
+	}
+
+	return record.Key, record.Value, nil
+}
@@ -0,0 +1,115 @@
+package kvndb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// SnapshotToJSON writes records of snapshot with given id in given
+// directory to w as newline delimited JSON, one object with base64
+// encoded "key" and "value" per line, the same as NDJSONCodec. Id of
+// 0 converts the latest snapshot.
+func SnapshotToJSON(w io.Writer, dir string, id uint) error {
+	it, err := ReadSnapshot(dir, id)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	enc := NDJSONCodec.NewEncoder(w)
+	for it.Next() {
+		err = enc.Encode(it.Key(), it.Value())
+		if err != nil {
+			return err
+		}
+	}
+	if it.Err() != nil {
+		return it.Err()
+	}
+
+	return enc.Flush()
+}
+
+// SnapshotFromJSON writes records read from r as newline delimited
+// JSON, in format written by SnapshotToJSON, into new snapshot in given
+// directory, returning its id. Snapshot is written in native format,
+// so it can be loaded by any datastore. If key repeats, the last record
+// wins on load. Existing snapshots are kept.
+func SnapshotFromJSON(r io.Reader, dir string) (id uint, err error) {
+	defer func() {
+		err = wrapSnapshotError("import", dir, id, err)
+	}()
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.unlock()
+
+	maxId, err := getMaxSnapshotId(dir)
+	if err != nil {
+		return 0, err
+	}
+	id = maxId + 1
+
+	tmpPath := filepath.Join(dir, fmt.Sprintf("%s.%d.tmp", generateSnapshotName(id), os.Getpid()))
+	err = writeRecordsSnapshot(tmpPath, NDJSONCodec.NewDecoder(r))
+	if err == nil {
+		err = os.Rename(tmpPath, getSnapshotFilepath(dir, id))
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return id, err
+	}
+
+	_, err = writeSnapshotChecksum(id, dir, 0600, false)
+	if err != nil {
+		removeSnapshotFiles(dir, id)
+		return id, err
+	}
+
+	return id, nil
+}
+
+// writeRecordsSnapshot writes snapshot in native format with records
+// read from dec to given path.
+func writeRecordsSnapshot(path string, dec RecordDecoder) error {
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(fd)
+	headerBytes := (&snapshotHeader{version: snapshotVersion}).bytes()
+	_, err = bw.Write(headerBytes)
+	if err == nil {
+		fw := newFrameWriter(bw, int64(len(headerBytes)))
+		for {
+			var key, value []byte
+			key, value, err = dec.Decode()
+			if err == io.EOF {
+				err = fw.Flush()
+				break
+			}
+			if err != nil {
+				break
+			}
+			err = writeCompactRecord(fw, key, value, nil)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		_ = fd.Close()
+		return err
+	}
+
+	return fd.Close()
+}
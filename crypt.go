@@ -0,0 +1,99 @@
+package kvndb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// errSealedValue is returned when value kept encrypted in memory
+// fails authentication, which means it was corrupted.
+var errSealedValue = errors.New("kvndb: encrypted value failed authentication")
+
+// newValueCipher returns AES-GCM cipher for given key, which must be
+// 16, 24 or 32 bytes long.
+func newValueCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sealedEngine keeps values of wrapped engine encrypted, so they don't
+// appear in plain text in process memory, core dumps or swap. Values
+// are decrypted on every read.
+type sealedEngine struct {
+	engine
+	aead cipher.AEAD
+}
+
+func newSealedEngine(e engine, aead cipher.AEAD) *sealedEngine {
+	return &sealedEngine{
+		engine: e,
+		aead:   aead,
+	}
+}
+
+func (e *sealedEngine) seal(key string, value []byte) ([]byte, error) {
+	nonceSize := e.aead.NonceSize()
+	sealed := make([]byte, nonceSize, nonceSize+len(value)+e.aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	// key is authenticated too, so values can't be swapped between keys
+	return e.aead.Seal(sealed, sealed, value, []byte(key)), nil
+}
+
+func (e *sealedEngine) open(key string, sealed []byte) ([]byte, error) {
+	nonceSize := e.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, errSealedValue
+	}
+
+	value, err := e.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(key))
+	if err != nil {
+		return nil, errSealedValue
+	}
+
+	// keep empty values distinguishable from missing ones
+	if value == nil {
+		value = []byte{}
+	}
+
+	return value, nil
+}
+
+func (e *sealedEngine) get(key string) ([]byte, error) {
+	sealed, err := e.engine.get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.open(key, sealed)
+}
+
+func (e *sealedEngine) put(key string, value []byte) error {
+	sealed, err := e.seal(key, value)
+	if err != nil {
+		return err
+	}
+
+	return e.engine.put(key, sealed)
+}
+
+func (e *sealedEngine) forEach(fn func(key string, value []byte) error) error {
+	return e.engine.forEach(func(key string, sealed []byte) error {
+		value, err := e.open(key, sealed)
+		if err != nil {
+			return err
+		}
+
+		return fn(key, value)
+	})
+}
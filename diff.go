@@ -0,0 +1,174 @@
+package kvndb
+
+import (
+	"bytes"
+	"sort"
+)
+
+// DiffKind is kind of difference between two snapshots.
+type DiffKind int
+
+const (
+	// DiffAdded means key exists only in the newer snapshot.
+	DiffAdded DiffKind = iota + 1
+	// DiffRemoved means key exists only in the older snapshot.
+	DiffRemoved
+	// DiffChanged means key exists in both snapshots with different
+	// values.
+	DiffChanged
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case DiffAdded:
+		return "added"
+	case DiffRemoved:
+		return "removed"
+	case DiffChanged:
+		return "changed"
+	default:
+		return "unknown"
+	}
+}
+
+// DiffEntry describes difference of one key between two snapshots.
+type DiffEntry struct {
+	Kind DiffKind
+	Key  []byte
+	// Old is value in the older snapshot, nil if key was added.
+	Old []byte
+	// New is value in the newer snapshot, nil if key was removed.
+	New []byte
+}
+
+// DiffSnapshots returns a channel that will iterate over differences
+// between snapshots `a` (older) and `b` (newer) in given directory, in
+// ascending key order. Id of 0 means the latest snapshot. Only keys are
+// held in memory, values are read from snapshot files as they are
+// compared. You MUST read all values until the channel is closed.
+// Reading a value that fails ends iteration early.
+func DiffSnapshots(dir string, a, b uint) (ch <-chan DiffEntry, err error) {
+	defer func() {
+		err = wrapSnapshotError("diff", dir, 0, err)
+	}()
+
+	older, newer, err := openSnapshotPair(dir, a, b)
+	if err != nil {
+		return nil, err
+	}
+	keys := diffKeySet(older, newer)
+
+	out := make(chan DiffEntry)
+
+	go func() {
+		defer close(out)
+		defer older.close()
+		defer newer.close()
+		// there is no way to report read error over channel, it
+		// ends iteration
+		_ = diffKeys(keys, older, newer, func(entry DiffEntry, _ []byte) error {
+			out <- entry
+			return nil
+		})
+	}()
+
+	return out, nil
+}
+
+// openSnapshotPair opens two snapshots for reading, holding directory
+// lock while doing so.
+func openSnapshotPair(dir string, a, b uint) (*lazyEngine, *lazyEngine, error) {
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer lock.unlock()
+
+	maxId, err := getMaxSnapshotId(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if maxId == 0 {
+		return nil, nil, ErrSnapshotNotFound
+	}
+	if a == 0 {
+		a = maxId
+	}
+	if b == 0 {
+		b = maxId
+	}
+
+	older, err := newLazyEngine(newMapEngine(), dir, a, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newer, err := newLazyEngine(newMapEngine(), dir, b, false)
+	if err != nil {
+		_ = older.close()
+		return nil, nil, err
+	}
+
+	return older, newer, nil
+}
+
+// diffKeySet returns sorted keys of both snapshots.
+func diffKeySet(older, newer *lazyEngine) []string {
+	keys := make([]string, 0, len(newer.index))
+	for key := range newer.index {
+		keys = append(keys, key)
+	}
+	for key := range older.index {
+		if _, ok := newer.index[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// diffKeys compares values of given keys in both snapshots, calling fn
+// for every difference with metadata of newer record, nil if it has
+// none, and stopping at first error.
+func diffKeys(keys []string, older, newer *lazyEngine, fn func(entry DiffEntry, meta []byte) error) error {
+	for _, key := range keys {
+		entry := DiffEntry{
+			Key: []byte(key),
+		}
+
+		oldPos, inOld := older.index[key]
+		newPos, inNew := newer.index[key]
+		var err error
+		if inOld {
+			entry.Old, _, err = older.snap.readAt(key, oldPos)
+			if err != nil {
+				return err
+			}
+		}
+		var meta []byte
+		if inNew {
+			entry.New, meta, err = newer.snap.readAt(key, newPos)
+			if err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case !inOld:
+			entry.Kind = DiffAdded
+		case !inNew:
+			entry.Kind = DiffRemoved
+		case !bytes.Equal(entry.Old, entry.New):
+			entry.Kind = DiffChanged
+		default:
+			continue
+		}
+
+		if err = fn(entry, meta); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package kvndb
+
+import (
+	"os"
+	"unsafe"
+)
+
+const (
+	// directIOAlign is alignment of memory, offsets and sizes of writes
+	// to files opened with O_DIRECT.
+	directIOAlign = 4096
+	// directIOBufferSize is size of writes to files opened with
+	// O_DIRECT.
+	directIOBufferSize = 1 << 20
+)
+
+// directWriter buffers writes to file opened with O_DIRECT, writing it
+// in aligned blocks. Flush writes the unaligned tail with O_DIRECT
+// cleared, so it must be called once after all writes.
+type directWriter struct {
+	fd  *os.File
+	buf []byte
+	n   int
+}
+
+func newDirectWriter(fd *os.File) *directWriter {
+	buf := make([]byte, directIOBufferSize+directIOAlign)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % directIOAlign); rem != 0 {
+		offset = directIOAlign - rem
+	}
+
+	return &directWriter{
+		fd:  fd,
+		buf: buf[offset : offset+directIOBufferSize],
+	}
+}
+
+func (w *directWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[w.n:], p)
+		w.n += n
+		p = p[n:]
+		written += n
+
+		if w.n == len(w.buf) {
+			_, err := w.fd.Write(w.buf)
+			if err != nil {
+				return written, err
+			}
+			w.n = 0
+		}
+	}
+
+	return written, nil
+}
+
+func (w *directWriter) Flush() error {
+	aligned := w.n - w.n%directIOAlign
+	if aligned > 0 {
+		_, err := w.fd.Write(w.buf[:aligned])
+		if err != nil {
+			return err
+		}
+	}
+
+	if aligned < w.n {
+		err := clearDirectIO(w.fd)
+		if err != nil {
+			return err
+		}
+		_, err = w.fd.Write(w.buf[aligned:w.n])
+		if err != nil {
+			return err
+		}
+	}
+	w.n = 0
+
+	return nil
+}
@@ -0,0 +1,33 @@
+//go:build linux
+// +build linux
+
+package kvndb
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	// directIOFlag makes writes bypass page cache.
+	directIOFlag = syscall.O_DIRECT
+	// dsyncFlag makes every write wait for data to reach stable
+	// storage.
+	dsyncFlag = syscall.O_DSYNC
+)
+
+// clearDirectIO clears O_DIRECT of open file, so unaligned writes can
+// be made.
+func clearDirectIO(fd *os.File) error {
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd.Fd(), syscall.F_GETFL, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd.Fd(), syscall.F_SETFL, flags&^syscall.O_DIRECT)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package kvndb
+
+import (
+	"os"
+)
+
+const (
+	// directIOFlag is not supported outside of Linux.
+	directIOFlag = 0
+	// dsyncFlag falls back to O_SYNC, which also flushes file metadata.
+	dsyncFlag = os.O_SYNC
+)
+
+func clearDirectIO(fd *os.File) error {
+	return nil
+}
@@ -0,0 +1,84 @@
+package kvndb
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// DumpOptions selects what DumpSnapshot prints about every record.
+type DumpOptions struct {
+	// Preview is number of leading bytes of value to print, quoted.
+	// 0 prints no preview.
+	Preview int
+	// Hash prints sha256 of value.
+	Hash bool
+}
+
+type dumpRecord struct {
+	key     string
+	size    int
+	hash    []byte
+	preview []byte
+}
+
+// DumpSnapshot writes records of snapshot with given id in given
+// directory to w as text, one record per line sorted by key, so dumps
+// of snapshots can be compared with diff. Id of 0 dumps the latest
+// snapshot. Every line has tab separated hex encoded key, size of value
+// and, if selected by opts, sha256 of value and preview of it.
+func DumpSnapshot(w io.Writer, dir string, id uint, opts DumpOptions) error {
+	it, err := ReadSnapshot(dir, id)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	records := make([]dumpRecord, 0)
+	for it.Next() {
+		value := it.Value()
+		r := dumpRecord{
+			key:  string(it.Key()),
+			size: len(value),
+		}
+		if opts.Hash {
+			hash := sha256.Sum256(value)
+			r.hash = hash[:]
+		}
+		if opts.Preview > 0 {
+			if len(value) > opts.Preview {
+				value = value[:opts.Preview]
+			}
+			r.preview = append([]byte(nil), value...)
+		}
+		records = append(records, r)
+	}
+	if it.Err() != nil {
+		return it.Err()
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].key < records[j].key
+	})
+
+	bw := bufio.NewWriter(w)
+	for _, r := range records {
+		line := hex.EncodeToString([]byte(r.key)) + "\t" + strconv.Itoa(r.size)
+		if opts.Hash {
+			line += "\t" + hex.EncodeToString(r.hash)
+		}
+		if opts.Preview > 0 {
+			line += "\t" + strconv.Quote(string(r.preview))
+		}
+		_, err = fmt.Fprintln(bw, line)
+		if err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
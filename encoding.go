@@ -0,0 +1,69 @@
+package kvndb
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// PutJSON puts v encoded as JSON under given key.
+func PutJSON(d DB, key []byte, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return d.Put(key, value)
+}
+
+// GetJSON decodes JSON value of given key into v. If stored value is
+// not valid JSON for v, *DecodeError is returned.
+func GetJSON(d ReadOnlyDB, key []byte, v interface{}) error {
+	value, err := d.Get(key)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(value, v)
+	if err != nil {
+		return &DecodeError{
+			Key: key,
+			Err: err,
+		}
+	}
+
+	return nil
+}
+
+// PutGob puts v encoded by encoding/gob under given key. Concrete types
+// stored in interface fields of v must be registered with gob.Register
+// once before use, same as for any other gob encoding.
+func PutGob(d DB, key []byte, v interface{}) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return err
+	}
+
+	return d.Put(key, buf.Bytes())
+}
+
+// GetGob decodes gob value of given key into v, which must be a
+// pointer. If stored value can not be decoded into v, *DecodeError is
+// returned.
+func GetGob(d ReadOnlyDB, key []byte, v interface{}) error {
+	value, err := d.Get(key)
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(value)).Decode(v)
+	if err != nil {
+		return &DecodeError{
+			Key: key,
+			Err: err,
+		}
+	}
+
+	return nil
+}
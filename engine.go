@@ -0,0 +1,159 @@
+package kvndb
+
+import (
+	"io"
+)
+
+// engine is the storage backend holding datastore entries. All methods
+// are called with datastore mutex held.
+type engine interface {
+	// get returns value for given key, ErrKeyNotFound if key
+	// does not exist.
+	get(key string) ([]byte, error)
+
+	// put adds or updates entry for given key.
+	put(key string, value []byte) error
+
+	// delete removes entry for given key, reporting whether it
+	// existed.
+	delete(key string) bool
+
+	// len returns the number of stored entries.
+	len() int
+
+	// memSize returns approximate number of bytes held in memory by
+	// stored entries, it must not iterate over them.
+	memSize() int64
+
+	// forEach calls fn for every stored entry, stopping at first
+	// error returned by fn.
+	forEach(fn func(key string, value []byte) error) error
+
+	// reset removes all entries.
+	reset() error
+
+	// close releases any resources held by engine.
+	close() error
+}
+
+// streamEngine is implemented by engines able to store and serve
+// values incrementally, without holding them in memory whole.
+type streamEngine interface {
+	// putReader adds or updates entry for given key with exactly
+	// size bytes read from r.
+	putReader(key string, r io.Reader, size int64) error
+
+	// getReader returns reader over value for given key,
+	// ErrKeyNotFound if key does not exist.
+	getReader(key string) (io.ReadCloser, error)
+}
+
+// putReader stores exactly size bytes read from r as value of given
+// key, streaming it when engine supports that.
+func putReader(e engine, key string, r io.Reader, size int64) error {
+	if se, ok := e.(streamEngine); ok {
+		return se.putReader(key, r, size)
+	}
+
+	value, err := readValue(r, size)
+	if err != nil {
+		return err
+	}
+
+	return e.put(key, value)
+}
+
+// getReader returns reader over value of given key, streaming it when
+// engine supports that.
+func getReader(e engine, key string) (io.ReadCloser, error) {
+	if se, ok := e.(streamEngine); ok {
+		return se.getReader(key)
+	}
+
+	value, err := e.get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return readCloser(value), nil
+}
+
+// mapEntryOverhead is approximate number of bytes taken by map entry
+// besides key and value data: string and slice headers and share of
+// map buckets.
+const mapEntryOverhead = 64
+
+// mapEngine is the default engine keeping values as-is in a Go map.
+type mapEngine struct {
+	data  map[string][]byte
+	bytes int64
+}
+
+func newMapEngine() *mapEngine {
+	return &mapEngine{
+		data: make(map[string][]byte),
+	}
+}
+
+func (e *mapEngine) get(key string) ([]byte, error) {
+	value, ok := e.data[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	return value, nil
+}
+
+func (e *mapEngine) put(key string, value []byte) error {
+	if old, ok := e.data[key]; ok {
+		e.bytes -= int64(len(old))
+	} else {
+		e.bytes += int64(len(key)) + mapEntryOverhead
+	}
+	e.bytes += int64(len(value))
+
+	e.data[key] = value
+	return nil
+}
+
+func (e *mapEngine) delete(key string) bool {
+	old, ok := e.data[key]
+	if !ok {
+		return false
+	}
+
+	e.bytes -= int64(len(key)+len(old)) + mapEntryOverhead
+	delete(e.data, key)
+
+	return true
+}
+
+func (e *mapEngine) memSize() int64 {
+	return e.bytes
+}
+
+func (e *mapEngine) len() int {
+	return len(e.data)
+}
+
+func (e *mapEngine) forEach(fn func(key string, value []byte) error) error {
+	for key, value := range e.data {
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *mapEngine) reset() error {
+	e.data = make(map[string][]byte)
+	e.bytes = 0
+	return nil
+}
+
+func (e *mapEngine) close() error {
+	e.data = nil
+	e.bytes = 0
+	return nil
+}
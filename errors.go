@@ -2,12 +2,126 @@ package kvndb
 
 import (
 	"errors"
+	"fmt"
 )
 
 var (
-	ErrKeyNotFound      = errors.New("kvndb: key not found")
-	ErrTooMuchHistory   = errors.New("kvndb: do you really need that much history")
-	ErrSnapshotNotFound = errors.New("kvndb: there are no loadable snapshots, data was reset")
-	ErrAlreadyClosed    = errors.New("kvndb: operations on closed datastore are not possible")
-	ErrBadSnapshot      = errors.New("kvndb: checksum mismatch likely snapshot corrupted")
+	ErrKeyNotFound       = errors.New("kvndb: key not found")
+	ErrTooMuchHistory    = errors.New("kvndb: do you really need that much history")
+	ErrSnapshotNotFound  = errors.New("kvndb: there are no loadable snapshots, data was reset")
+	ErrAlreadyClosed     = errors.New("kvndb: operations on closed datastore are not possible")
+	ErrBadSnapshot       = errors.New("kvndb: checksum mismatch likely snapshot corrupted")
+	ErrBadName           = errors.New("kvndb: datastore name must be a valid directory name")
+	ErrDirLocked         = errors.New("kvndb: snapshot directory is locked by another datastore")
+	ErrBusy              = errors.New("kvndb: datastore is busy with another operation")
+	ErrNoMeta            = errors.New("kvndb: entry metadata is not tracked by datastore")
+	ErrBadPatch          = errors.New("kvndb: not a valid patch")
+	ErrNoAccessFrequency = errors.New("kvndb: access frequency is not tracked by datastore")
+	ErrNotOrdered        = errors.New("kvndb: operation requires datastore created with WithOrderedIndex")
+	ErrValueTooLarge     = errors.New("kvndb: value is too large to be stored")
+	ErrUnknownCodec      = errors.New("kvndb: snapshot codec is not registered")
+	ErrUnsupportedCodec  = errors.New("kvndb: operation is not supported for snapshots written with codec")
+	ErrNotModified       = errors.New("kvndb: data was not modified since the last save, snapshot was not written")
+	ErrRevisionMismatch  = errors.New("kvndb: entry revision differs from expected one")
+	ErrBadKey            = errors.New("kvndb: not a valid composite key")
+	ErrBadManifest       = errors.New("kvndb: snapshot manifest is corrupted")
+	ErrStagingDir        = errors.New("kvndb: staging directory must be on the same filesystem as snapshot directory")
+	ErrChangesTruncated  = errors.New("kvndb: changes since snapshot revision are no longer retained, follower must start over")
+	ErrBadBackup         = errors.New("kvndb: not a valid backup archive")
+	ErrBlobNotFound      = errors.New("kvndb: object not found in blob store")
+	ErrRateLimited       = errors.New("kvndb: mutation rate limit exceeded")
+	ErrInvalidSize       = errors.New("kvndb: value size must not be negative")
+	ErrMemoryLimit       = errors.New("kvndb: datastore memory limit exceeded")
 )
+
+// SnapshotError records an error and snapshot it happened with.
+type SnapshotError struct {
+	// Op is operation which failed, e.g. "save" or "load".
+	Op string
+	// Dir is snapshot directory.
+	Dir string
+	// Id is snapshot id, 0 if error happened before it was known.
+	Id uint
+	// Err is underlying error.
+	Err error
+}
+
+func (e *SnapshotError) Error() string {
+	if e.Id == 0 {
+		return e.Op + " " + e.Dir + ": " + e.Err.Error()
+	}
+
+	return e.Op + " " + getSnapshotFilepath(e.Dir, e.Id) + ": " + e.Err.Error()
+}
+
+func (e *SnapshotError) Unwrap() error {
+	return e.Err
+}
+
+// KeyError records an error and key of entry it happened with.
+type KeyError struct {
+	// Op is operation which failed, e.g. "put" or "get".
+	Op string
+	// Key is key of entry.
+	Key []byte
+	// Err is underlying error.
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("%s %q: %v", e.Op, e.Key, e.Err)
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeError records failure to decode stored value of an entry.
+type DecodeError struct {
+	// Key is key of entry.
+	Key []byte
+	// Err is error of decoder.
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode %q: %v", e.Key, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// wrapSnapshotError wraps err with snapshot details, unless it is nil
+// or already wrapped.
+func wrapSnapshotError(op, dir string, id uint, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var se *SnapshotError
+	if errors.As(err, &se) {
+		return err
+	}
+
+	return &SnapshotError{
+		Op:  op,
+		Dir: dir,
+		Id:  id,
+		Err: err,
+	}
+}
+
+// wrapKeyError wraps err with key details. Errors not specific to
+// the key are returned as is.
+func wrapKeyError(op string, key []byte, err error) error {
+	if err == nil || err == ErrKeyNotFound || err == ErrAlreadyClosed || err == ErrBusy {
+		return err
+	}
+
+	return &KeyError{
+		Op:  op,
+		Key: key,
+		Err: err,
+	}
+}
@@ -0,0 +1,199 @@
+package kvndb
+
+import "strings"
+
+// EventKind is kind of change reported by Event.
+type EventKind int
+
+const (
+	// EventPut reports entry being put.
+	EventPut EventKind = iota
+	// EventDelete reports entry being deleted.
+	EventDelete
+	// EventExpire reports entry being removed after its TTL passed.
+	EventExpire
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventPut:
+		return "put"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is notification about change of single entry. Value is only
+// set for EventPut, and is nil for entries put with PutReader. Entries
+// replaced by Load, LoadMerge or Reset are not reported.
+type Event struct {
+	Kind  EventKind
+	Key   []byte
+	Value []byte
+	// Revision is revision of datastore right after the change.
+	// Every reported change increments revision by one.
+	Revision uint64
+}
+
+// DropPolicy decides what happens to events when buffer of events
+// channel is full.
+type DropPolicy int
+
+const (
+	// DropNewest discards event which does not fit into buffer.
+	DropNewest DropPolicy = iota
+	// DropOldest discards the oldest buffered event to make room for
+	// the new one.
+	DropOldest
+	// Block makes modifying operation wait until event is received.
+	// Receiver MUST NOT call datastore methods while handling events,
+	// as datastore is locked while waiting.
+	Block
+)
+
+// events is channel of events with its drop policy. Methods of nil
+// *events do nothing.
+type events struct {
+	ch     chan Event
+	policy DropPolicy
+}
+
+func newEvents(buffer int, policy DropPolicy) *events {
+	return &events{
+		ch:     make(chan Event, buffer),
+		policy: policy,
+	}
+}
+
+func (e *events) publish(kind EventKind, key, value []byte, rev uint64) {
+	if e == nil {
+		return
+	}
+
+	ev := Event{
+		Kind:     kind,
+		Key:      append([]byte(nil), key...),
+		Revision: rev,
+	}
+	if value != nil {
+		ev.Value = append([]byte(nil), value...)
+	}
+
+	switch e.policy {
+	case Block:
+		e.ch <- ev
+		return
+	case DropOldest:
+		select {
+		case e.ch <- ev:
+			return
+		default:
+		}
+		select {
+		case <-e.ch:
+		default:
+		}
+	}
+
+	select {
+	case e.ch <- ev:
+	default:
+	}
+}
+
+func (e *events) close() {
+	if e != nil {
+		close(e.ch)
+	}
+}
+
+func (d *db) Events() <-chan Event {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.events == nil {
+		return nil
+	}
+
+	return d.events.ch
+}
+
+// Subscription receives events about entries with keys starting with
+// its prefix.
+type Subscription struct {
+	// C is channel of events, it is closed when subscription is
+	// cancelled or datastore is closed.
+	C <-chan Event
+
+	d      *db
+	events *events
+}
+
+// Cancel stops delivery of events and closes C. It is safe to call
+// Cancel more than once.
+func (s *Subscription) Cancel() {
+	s.d.lock()
+	defer s.d.mutex.Unlock()
+
+	for i, sub := range s.d.subscribers {
+		if sub.events == s.events {
+			s.d.subscribers = append(s.d.subscribers[:i], s.d.subscribers[i+1:]...)
+			sub.events.close()
+			return
+		}
+	}
+}
+
+type subscriber struct {
+	prefix string
+	events *events
+}
+
+func (d *db) Subscribe(prefix []byte, buffer int, policy DropPolicy) (*Subscription, error) {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return nil, ErrAlreadyClosed
+	}
+
+	e := newEvents(buffer, policy)
+	d.subscribers = append(d.subscribers, &subscriber{
+		prefix: string(prefix),
+		events: e,
+	})
+
+	return &Subscription{
+		C:      e.ch,
+		d:      d,
+		events: e,
+	}, nil
+}
+
+// notify publishes event to events channel and all subscribers with
+// matching prefix.
+func (d *db) notify(kind EventKind, key, value []byte) {
+	d.events.publish(kind, key, value, d.revision)
+	d.changes.append(kind, key, value, d.revision)
+
+	for _, sub := range d.subscribers {
+		if strings.HasPrefix(string(key), sub.prefix) {
+			sub.events.publish(kind, key, value, d.revision)
+		}
+	}
+}
+
+// closeEvents closes events channel and channels of all subscribers.
+func (d *db) closeEvents() {
+	d.events.close()
+	d.events = nil
+
+	for _, sub := range d.subscribers {
+		sub.events.close()
+	}
+	d.subscribers = nil
+}
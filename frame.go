@@ -0,0 +1,250 @@
+package kvndb
+
+import (
+	"errors"
+	"hash/crc32"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	frameChunkCompressed   = 0x00
+	frameChunkUncompressed = 0x01
+	frameChunkStreamId     = 0xff
+	frameMagicBody         = "sNaPpY"
+	frameMaxBlockSize      = 65536
+)
+
+var (
+	errFrameCorrupt  = errors.New("snappy: corrupt input")
+	errFrameChecksum = errors.New("snappy: corrupt input checksum")
+	crcTable         = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// framePos is a position in decoded snappy stream, which can be read
+// again starting from chunk at given file offset.
+type framePos struct {
+	chunk  int64
+	offset uint32
+}
+
+// frameReader decodes snappy framing format same as snappy.Reader,
+// but keeps track of file offsets of chunks, so position of decoded
+// data can be recorded and read again without decoding stream from
+// the beginning.
+type frameReader struct {
+	r      io.Reader
+	offset int64
+	chunk  int64
+	header [4]byte
+	src    []byte
+	buf    []byte
+	pos    int
+}
+
+// newFrameReader returns reader of snappy stream read from r, which
+// is positioned at given offset of the file.
+func newFrameReader(r io.Reader, offset int64) *frameReader {
+	return &frameReader{
+		r:      r,
+		offset: offset,
+		chunk:  offset,
+	}
+}
+
+// position returns position of the next byte to be read.
+func (f *frameReader) position() framePos {
+	return framePos{
+		chunk:  f.chunk,
+		offset: uint32(f.pos),
+	}
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	for f.pos >= len(f.buf) {
+		if err := f.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, f.buf[f.pos:])
+	f.pos += n
+
+	return n, nil
+}
+
+func (f *frameReader) nextChunk() error {
+	_, err := io.ReadFull(f.r, f.header[:])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return errFrameCorrupt
+		}
+		return err
+	}
+
+	chunkType := f.header[0]
+	chunkLen := int(f.header[1]) | int(f.header[2])<<8 | int(f.header[3])<<16
+
+	if cap(f.src) < chunkLen {
+		f.src = make([]byte, chunkLen)
+	}
+	src := f.src[:chunkLen]
+	_, err = io.ReadFull(f.r, src)
+	if err != nil {
+		return errFrameCorrupt
+	}
+
+	chunk := f.offset
+	f.offset += int64(len(f.header) + chunkLen)
+
+	switch {
+	case chunkType == frameChunkCompressed, chunkType == frameChunkUncompressed:
+		if chunkLen < 4 {
+			return errFrameCorrupt
+		}
+		data := src[4:]
+		if chunkType == frameChunkCompressed {
+			n, err := snappy.DecodedLen(data)
+			if err != nil {
+				return err
+			}
+			// length comes from input, which may be corrupted
+			if n > frameMaxBlockSize {
+				return errFrameCorrupt
+			}
+			if cap(f.buf) < n {
+				f.buf = make([]byte, n)
+			}
+			data, err = snappy.Decode(f.buf[:n], data)
+			if err != nil {
+				return err
+			}
+		} else {
+			if len(data) > frameMaxBlockSize {
+				return errFrameCorrupt
+			}
+			if cap(f.buf) < len(data) {
+				f.buf = make([]byte, len(data))
+			}
+			copy(f.buf[:len(data)], data)
+			data = f.buf[:len(data)]
+		}
+		if bytesToUint32(src[:4]) != frameCrc(data) {
+			return errFrameChecksum
+		}
+		f.chunk = chunk
+		f.buf = data
+		f.pos = 0
+	case chunkType == frameChunkStreamId:
+		if string(src) != frameMagicBody {
+			return errFrameCorrupt
+		}
+	case chunkType >= 0x02 && chunkType <= 0x7f:
+		// reserved unskippable chunks
+		return errFrameCorrupt
+	}
+
+	// padding and reserved skippable chunks are ignored
+	return nil
+}
+
+// frameCrc implements masked checksum used by snappy framing format.
+func frameCrc(b []byte) uint32 {
+	c := crc32.Update(0, crcTable, b)
+	return c>>15 | c<<17 + 0xa282ead8
+}
+
+// frameWriter encodes snappy framing format same as snappy.Writer,
+// but keeps track of file offsets of chunks, so position of written
+// data can be recorded.
+type frameWriter struct {
+	w       io.Writer
+	offset  int64
+	buf     []byte
+	enc     []byte
+	started bool
+}
+
+// newFrameWriter returns writer of snappy stream written to w, which
+// is positioned at given offset of the file.
+func newFrameWriter(w io.Writer, offset int64) *frameWriter {
+	return &frameWriter{
+		w:      w,
+		offset: offset,
+		buf:    make([]byte, 0, frameMaxBlockSize),
+	}
+}
+
+// position returns position of the next byte to be written.
+func (f *frameWriter) position() framePos {
+	return framePos{
+		chunk:  f.offset,
+		offset: uint32(len(f.buf)),
+	}
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(f.buf[len(f.buf):cap(f.buf)], p)
+		f.buf = f.buf[:len(f.buf)+n]
+		p = p[n:]
+		written += n
+		if len(f.buf) == cap(f.buf) {
+			if err := f.Flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// Flush writes any buffered data as a chunk.
+func (f *frameWriter) Flush() error {
+	if !f.started {
+		if err := f.writeChunk(frameChunkStreamId, []byte(frameMagicBody), nil); err != nil {
+			return err
+		}
+		f.started = true
+	}
+
+	if len(f.buf) == 0 {
+		return nil
+	}
+
+	crc := uint32ToBytes(frameCrc(f.buf))
+	f.enc = snappy.Encode(f.enc[:cap(f.enc)], f.buf)
+
+	var err error
+	// same as snappy.Writer, keep data uncompressed if compression
+	// does not save at least 12.5%
+	if len(f.enc) >= len(f.buf)-len(f.buf)/8 {
+		err = f.writeChunk(frameChunkUncompressed, crc, f.buf)
+	} else {
+		err = f.writeChunk(frameChunkCompressed, crc, f.enc)
+	}
+	if err != nil {
+		return err
+	}
+
+	f.buf = f.buf[:0]
+
+	return nil
+}
+
+func (f *frameWriter) writeChunk(chunkType byte, prefix, data []byte) error {
+	chunkLen := len(prefix) + len(data)
+	header := []byte{chunkType, byte(chunkLen), byte(chunkLen >> 8), byte(chunkLen >> 16)}
+
+	for _, b := range [][]byte{header, prefix, data} {
+		_, err := f.w.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+	f.offset += int64(len(header) + chunkLen)
+
+	return nil
+}
@@ -1,5 +1,5 @@
 module github.com/akamensky/kvndb
 
-go 1.17
+go 1.18
 
 require github.com/golang/snappy v0.0.4
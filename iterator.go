@@ -0,0 +1,179 @@
+package kvndb
+
+import (
+	"sort"
+)
+
+// Iterator iterates over entries of datastore in ascending order of
+// keys. Datastore stays locked until iterator is closed, so iteration
+// can stop at any point without draining anything.
+type Iterator interface {
+	// Seek positions iterator right before the first entry with key
+	// greater or equal to given key, so that following Next moves to
+	// that entry.
+	Seek(key []byte)
+
+	// Next advances iterator to the next entry. It returns false when
+	// there are no more entries or an error occurred.
+	Next() bool
+
+	// Key returns key of the current entry.
+	Key() []byte
+
+	// Value returns copy of value of the current entry, unless
+	// datastore was created with WithUnsafeGet.
+	Value() []byte
+
+	// Err returns error which stopped iteration, if any.
+	Err() error
+
+	// Close releases datastore. It MUST be called when done with
+	// iterator, and is safe to call more than once.
+	Close() error
+}
+
+func (d *db) NewIterator() (Iterator, error) {
+	d.lock()
+
+	if d.isClosed {
+		d.mutex.Unlock()
+		return nil, ErrAlreadyClosed
+	}
+
+	if !d.opts.orderedIndex {
+		d.mutex.Unlock()
+		return nil, ErrNotOrdered
+	}
+
+	d.removeExpired()
+
+	if e, ok := d.data.(*orderedEngine); ok {
+		return &iterator{
+			d:    d,
+			e:    e,
+			prev: e.index.head,
+		}, nil
+	}
+
+	// wrapping engines, such as lazy one, keep some keys out of the
+	// index, so keys are sorted up front the same way Range does
+	keys := make([]string, 0, d.data.len())
+	collect := func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}
+	var err error
+	if re, ok := d.data.(rangeEngine); ok {
+		err = re.ascend("", "", false, collect)
+	} else {
+		err = ascendSorted(d.data, "", "", false, collect)
+	}
+	if err != nil {
+		d.mutex.Unlock()
+		return nil, err
+	}
+
+	return &iterator{
+		d:    d,
+		keys: keys,
+	}, nil
+}
+
+type iterator struct {
+	d *db
+	// e is ordered engine iterated by its index, nil when iterating
+	// over keys
+	e *orderedEngine
+	// prev is node right before the next one, head of the index
+	// before the first entry
+	prev *skiplistNode
+	// keys are sorted keys of all entries and next is position of the
+	// next one, when engine is not ordered engine itself
+	keys   []string
+	next   int
+	key    []byte
+	value  []byte
+	err    error
+	closed bool
+}
+
+func (it *iterator) Seek(key []byte) {
+	if it.closed {
+		return
+	}
+
+	if it.e == nil {
+		it.next = sort.SearchStrings(it.keys, string(key))
+	} else {
+		it.prev = it.e.index.findPrev(string(key))[0]
+	}
+	it.key = nil
+	it.value = nil
+	it.err = nil
+}
+
+func (it *iterator) Next() bool {
+	if it.closed || it.err != nil {
+		return false
+	}
+
+	var key string
+	var node *skiplistNode
+	if it.e == nil {
+		if it.next >= len(it.keys) {
+			it.key = nil
+			it.value = nil
+			return false
+		}
+		key = it.keys[it.next]
+	} else {
+		node = it.prev.next[0]
+		if node == nil {
+			it.key = nil
+			it.value = nil
+			return false
+		}
+		key = node.key
+	}
+
+	value, err := it.d.data.get(key)
+	if err != nil {
+		it.key = nil
+		it.value = nil
+		it.err = wrapKeyError("get", []byte(key), err)
+		return false
+	}
+
+	if it.e == nil {
+		it.next++
+	} else {
+		it.prev = node
+	}
+	it.key = []byte(key)
+	it.value = it.d.safeValue(value)
+
+	return true
+}
+
+func (it *iterator) Key() []byte {
+	return it.key
+}
+
+func (it *iterator) Value() []byte {
+	return it.value
+}
+
+func (it *iterator) Err() error {
+	return it.err
+}
+
+func (it *iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+
+	it.closed = true
+	it.d.mutex.Unlock()
+
+	return nil
+}
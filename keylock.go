@@ -0,0 +1,84 @@
+package kvndb
+
+import (
+	"sync"
+)
+
+// keyLocks is a set of striped locks serializing writers of the same
+// key, while letting writers of different keys proceed. Methods are
+// no-op on nil keyLocks, so callers need no checks whether key
+// locking is enabled.
+type keyLocks struct {
+	stripes []sync.Mutex
+}
+
+func newKeyLocks(n int) *keyLocks {
+	if n <= 0 {
+		n = defaultKeyLockStripes
+	}
+
+	return &keyLocks{
+		stripes: make([]sync.Mutex, n),
+	}
+}
+
+const (
+	defaultKeyLockStripes = 256
+)
+
+// stripe returns lock guarding given key, picked by FNV-1a hash.
+func (l *keyLocks) stripe(key []byte) *sync.Mutex {
+	h := uint32(2166136261)
+	for _, b := range key {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+
+	return &l.stripes[h%uint32(len(l.stripes))]
+}
+
+func (l *keyLocks) lock(key []byte) {
+	if l == nil {
+		return
+	}
+
+	l.stripe(key).Lock()
+}
+
+func (l *keyLocks) tryLock(key []byte) bool {
+	if l == nil {
+		return true
+	}
+
+	return l.stripe(key).TryLock()
+}
+
+func (l *keyLocks) unlock(key []byte) {
+	if l == nil {
+		return
+	}
+
+	l.stripe(key).Unlock()
+}
+
+// lockAll locks all stripes, in order, for operations replacing data
+// of any key.
+func (l *keyLocks) lockAll() {
+	if l == nil {
+		return
+	}
+
+	for i := range l.stripes {
+		l.stripes[i].Lock()
+	}
+}
+
+func (l *keyLocks) unlockAll() {
+	if l == nil {
+		return
+	}
+
+	for i := range l.stripes {
+		l.stripes[i].Unlock()
+	}
+}
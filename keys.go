@@ -0,0 +1,88 @@
+package kvndb
+
+// Composite keys encode every part followed by keyPartEnd, with zero
+// bytes inside parts escaped as keyPartEscape. Terminated parts keep
+// byte order of parts, unlike length prefixes, and no part can be
+// mistaken for a separator, unlike separator characters.
+var (
+	keyPartEnd    = []byte{0x00, 0x01}
+	keyPartEscape = []byte{0x00, 0xff}
+)
+
+// Key builds composite key from given parts. Composite keys sort by
+// their parts in order, so e.g. all keys of Key("user", id, ...) for
+// one id are adjacent and ordered by the remaining parts. Parts may
+// contain any bytes.
+func Key(parts ...string) []byte {
+	size := 0
+	for _, part := range parts {
+		size += len(part) + len(keyPartEnd)
+	}
+
+	result := make([]byte, 0, size)
+	for _, part := range parts {
+		for i := 0; i < len(part); i++ {
+			if part[i] == 0x00 {
+				result = append(result, keyPartEscape...)
+			} else {
+				result = append(result, part[i])
+			}
+		}
+		result = append(result, keyPartEnd...)
+	}
+
+	return result
+}
+
+// SplitKey returns parts of composite key built by Key, ErrBadKey if
+// key is not one.
+func SplitKey(key []byte) ([]string, error) {
+	parts := make([]string, 0)
+	part := make([]byte, 0)
+	for i := 0; i < len(key); i++ {
+		if key[i] != 0x00 {
+			part = append(part, key[i])
+			continue
+		}
+		if i+1 == len(key) {
+			return nil, ErrBadKey
+		}
+		i++
+		switch key[i] {
+		case keyPartEnd[1]:
+			parts = append(parts, string(part))
+			part = part[:0]
+		case keyPartEscape[1]:
+			part = append(part, 0x00)
+		default:
+			return nil, ErrBadKey
+		}
+	}
+	if len(part) > 0 {
+		return nil, ErrBadKey
+	}
+
+	return parts, nil
+}
+
+// KeyRange returns range of all composite keys starting with given
+// parts, to be passed to Range. Unlike plain prefix of Key("user", "1"),
+// it does not include keys of "user" "10".
+func KeyRange(parts ...string) (start, end []byte) {
+	start = Key(parts...)
+
+	return start, PrefixEnd(start)
+}
+
+// PrefixEnd returns the smallest key greater than all keys starting
+// with given prefix, so Range(prefix, PrefixEnd(prefix)) iterates over
+// keys with that prefix. It returns nil, which means no upper bound, if
+// there is no such key.
+func PrefixEnd(prefix []byte) []byte {
+	end, ok := prefixEnd(string(prefix))
+	if !ok {
+		return nil
+	}
+
+	return []byte(end)
+}
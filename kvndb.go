@@ -1,28 +1,90 @@
 package kvndb
 
 import (
-	"encoding/hex"
+	"context"
+	"errors"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
 	maxHistory uint = 999_999
-)
 
-type DB interface {
-	// Put adds or updates entry for given key.
-	Put(key, value []byte) error
+	defaultBatchSize = 1000
+)
 
-	// Get returns value for given key, ErrKeyNotFound if key
-	// does not exist.
+// ReadOnlyDB is the part of datastore interface which does not
+// modify data.
+type ReadOnlyDB interface {
+	// Get returns copy of value for given key, ErrKeyNotFound if key
+	// does not exist. Returned value may be modified freely, unless
+	// datastore was created with WithUnsafeGet.
 	Get(key []byte) ([]byte, error)
 
-	// Delete removes entry for given key.
-	Delete(key []byte) error
+	// Has reports whether entry for given key exists.
+	Has(key []byte) (bool, error)
+
+	// TryGet is the same as Get, but instead of waiting for other
+	// operation to finish it returns ErrBusy.
+	TryGet(key []byte) ([]byte, error)
+
+	// GetReader returns reader over value for given key,
+	// ErrKeyNotFound if key does not exist. Values stored in value
+	// log are read from disk incrementally. Returned reader MUST
+	// be closed.
+	GetReader(key []byte) (io.ReadCloser, error)
+
+	// GetMeta returns metadata of entry for given key, ErrKeyNotFound
+	// if key does not exist and ErrNoMeta if datastore was not created
+	// with WithEntryMeta.
+	GetMeta(key []byte) (Meta, error)
 
 	// Size returns the number of currently stored entries.
 	Size() uint64
 
+	// SizeBytes returns approximate number of bytes taken in memory
+	// by keys and values of stored entries, including per-entry
+	// overhead. Values kept in value log are not counted.
+	SizeBytes() uint64
+
+	// SizeHistogram returns number of values of sizes falling into
+	// buckets bounded by given sizes. For bounds [64, 1024] buckets
+	// are "0-63", "64-1023" and "1024+". Empty buckets are included,
+	// non-positive and duplicate bounds are ignored. All values are
+	// visited, including ones stored in value log. If reading value
+	// log fails, error is logged and only values visited before it
+	// are counted.
+	SizeHistogram(buckets []int) map[string]uint64
+
+	// TopKeysByAccess returns up to n keys with the highest access
+	// frequency, most accessed first. It returns ErrNoAccessFrequency
+	// unless datastore was created with WithAccessFrequency.
+	TopKeysByAccess(n int) ([]KeyAccess, error)
+
+	// TopKeysBySize returns up to n keys with the biggest values,
+	// biggest first.
+	TopKeysBySize(n int) ([]KeySize, error)
+
+	// Stats returns size of datastore and counters of operations
+	// since it was created.
+	Stats() Stats
+
+	// Revision returns revision of data, which is incremented on
+	// every modification, including Load. Revision is recorded in
+	// snapshots, loading one advances revision to at least the one
+	// of saved data, so replica restored from snapshot can tell how
+	// far it is behind datastore which saved it.
+	Revision() uint64
+
+	// ModifiedSince reports whether data was modified since it had
+	// given revision.
+	ModifiedSince(rev uint64) bool
+
 	// Keys returns a channel that will iterate	over keys of all
 	// entries.This operation is synchronous, which means all
 	// other operations will be	blocked until all values are read.
@@ -37,14 +99,171 @@ type DB interface {
 	// until the channel is closed. Best to use `range`.
 	KeysAndValues() (<-chan *Tuple, error)
 
+	// NewIterator returns iterator over all entries in ascending
+	// order of keys. It returns ErrNotOrdered unless datastore was
+	// created with WithOrderedIndex. All other operations are blocked
+	// until iterator is closed.
+	NewIterator() (Iterator, error)
+
+	// KeysBatched is the same as Keys, but sends keys in batches of
+	// up to n, which is much cheaper for large datastores. n of 0
+	// selects default of 1000.
+	KeysBatched(n int) (<-chan [][]byte, error)
+
+	// KeysAndValuesBatched is the same as KeysAndValues, but sends
+	// entries in batches of up to n. n of 0 selects default of 1000.
+	KeysAndValuesBatched(n int) (<-chan []*Tuple, error)
+
+	// KeysMatching returns a channel that will iterate over keys
+	// matching glob pattern, where `*` matches any sequence of
+	// characters, `?` matches one character and `\` escapes the
+	// next one. Characters are UTF-8 runes, invalid UTF-8 bytes are
+	// matched one by one. With ordered index only keys starting with
+	// literal prefix of pattern are visited. This operation is
+	// synchronous, which means all other operations will be blocked
+	// until all values are read. You MUST read all values until the
+	// channel is closed. Best to use `range`.
+	KeysMatching(pattern string) (<-chan []byte, error)
+
+	// KeysRegexp is the same as KeysMatching, but keys are matched
+	// by regular expression, which is not anchored unless it says
+	// so. Only with ordered index and expression starting with `^`
+	// and a literal prefix, keys without that prefix are not visited.
+	KeysRegexp(re *regexp.Regexp) (<-chan []byte, error)
+
+	// FindValues returns entries which values satisfy pred, at most
+	// limit of them, or all if limit is 0. Values are visited in no
+	// particular order, pred MUST NOT modify or keep them. All other
+	// operations are blocked until search is done.
+	FindValues(pred func(value []byte) bool, limit int) ([]*Tuple, error)
+
+	// Range returns a channel that will iterate over entries with
+	// keys in range [start, end) in ascending byte order. nil `end`
+	// means range has no upper bound. Unless datastore was created
+	// with ordered index, all keys are sorted at query time. This
+	// operation is synchronous, which means all other operations
+	// will be blocked until all values are read. You MUST read all
+	// values until the channel is closed. Best to use `range`.
+	Range(start, end []byte) (<-chan *Tuple, error)
+
+	// Close reset the data store and set status to closed. After
+	// this no operations can be done. It waits for operations in
+	// progress, such as Save, to finish first. If datastore was
+	// created with WithFinalSave, snapshot is saved before closing.
+	Close() error
+}
+
+type DB interface {
+	ReadOnlyDB
+
+	// GetUnsafe is the same as Get, but returns stored value itself
+	// rather than its copy, saving allocation on hot paths. Returned
+	// value MUST NOT be modified, as that silently changes stored
+	// data, and is only valid until entry is updated or deleted.
+	GetUnsafe(key []byte) ([]byte, error)
+
+	// Put adds or updates entry for given key. Value is copied, so
+	// caller may reuse it afterwards, unless datastore was created
+	// with WithUnsafePut. Keys are always copied.
+	Put(key, value []byte) error
+
+	// PutUnsafe is the same as Put, but keeps value itself rather
+	// than its copy, saving allocation for bulk loads. Value MUST NOT
+	// be modified afterwards, as that silently changes stored data.
+	PutUnsafe(key, value []byte) error
+
+	// PutTTL is the same as Put, but entry expires after given ttl.
+	// Expired entries are removed by background sweeper if datastore
+	// was created with WithSweeper. TTL is not persisted in
+	// snapshots, loaded entries never expire.
+	PutTTL(key, value []byte, ttl time.Duration) error
+
+	// PutRevision is the same as Put, but returns revision of entry
+	// after the put, as would be returned by GetMeta. It returns
+	// ErrNoMeta without putting entry if datastore was not created
+	// with WithEntryMeta.
+	PutRevision(key, value []byte) (uint64, error)
+
+	// PutIfRevision puts entry only if its current revision, as
+	// returned by GetMeta, is expected one, failing with
+	// ErrRevisionMismatch otherwise. Expected revision of 0 means
+	// entry must not exist. It returns ErrNoMeta if datastore was
+	// not created with WithEntryMeta.
+	PutIfRevision(key, value []byte, expected uint64) error
+
+	// TryPut is the same as Put, but instead of waiting for other
+	// operation to finish it returns ErrBusy.
+	TryPut(key, value []byte) error
+
+	// PutReader adds or updates entry for given key with exactly
+	// `size` bytes of value read from `r`. When value log is enabled
+	// and value is over threshold, it is streamed directly to disk
+	// without being held in memory. All other operations are blocked
+	// until value is read. Negative size is rejected with
+	// ErrInvalidSize.
+	PutReader(key []byte, r io.Reader, size int64) error
+
+	// Delete removes entry for given key.
+	Delete(key []byte) error
+
+	// DoWithKey atomically replaces value for given key with result
+	// of fn called with current value, nil if key does not exist. If
+	// fn returns nil, entry is deleted. If fn returns error, nothing
+	// is changed and the error is returned. Unless datastore was
+	// created with key locks, all other operations are blocked until
+	// fn returns. fn MUST NOT call methods of datastore, as that
+	// deadlocks.
+	DoWithKey(key []byte, fn func(current []byte) ([]byte, error)) error
+
 	// Save will write a snapshot of data into provided
 	// directory path. If snapshot successful it will clean up
 	// keeping only `hist` number of snapshots. This operation
 	// is synchronous, which means all other operations will be
-	// blocked until it is done. `hist` value of 0 will only
-	// save current copy. Value of 1 will keep current and previous.
+	// blocked until it is done, except Put, TryPut, Delete and Get
+	// when datastore was created with WithSaveBuffer. `hist` value
+	// of 0 will only save current copy. Value of 1 will keep current
+	// and previous. With WithSkipUnchanged it returns ErrNotModified
+	// instead of writing snapshot identical to the last one saved to
+	// the same directory.
 	Save(dir string, hist uint) error
 
+	// SaveTo writes a snapshot of data into given blob store,
+	// keeping only `hist` previous snapshots in it, like Save. Data is
+	// staged in temporary directory, all other operations are blocked
+	// only while it is written there. Blob store must not be shared by
+	// datastores saving to it at the same time.
+	SaveTo(store BlobStore, hist uint) error
+
+	// Backup writes snapshot of current data, its checksum and
+	// manifest describing it to w as single gzip compressed tar
+	// archive, for RestoreBackup. Snapshot is staged in temporary
+	// directory, all other operations are blocked while it is
+	// written there.
+	Backup(w io.Writer) error
+
+	// BeforeSave registers hook called before every Save with
+	// statistics of data about to be saved. If hook returns an error,
+	// nothing is written and Save returns it, so existing snapshots
+	// are not rotated out by a bad state. Hook runs while datastore
+	// is locked, so it MUST NOT call datastore methods. Nil removes
+	// the hook.
+	BeforeSave(fn func(stats Stats) error)
+
+	// AfterSave registers hook called with details of every snapshot
+	// written by Save, e.g. to upload it elsewhere. Hook error is
+	// returned by Save, but snapshot stays in place and counts as
+	// saved. Hook runs while datastore is locked, so it MUST NOT call
+	// datastore methods. Nil removes the hook.
+	AfterSave(fn func(info SnapshotInfo) error)
+
+	// OnRetire registers hook called by Save with details of every
+	// old snapshot before it is removed to keep `hist` snapshots,
+	// e.g. to copy it to cold storage. If hook returns an error, that
+	// snapshot is kept and hook is called for it again by the next
+	// Save. Hook runs while datastore is locked, so it MUST NOT call
+	// datastore methods. Nil removes the hook.
+	OnRetire(fn func(info SnapshotInfo) error)
+
 	// Load will load data from snapshot. It will replace any
 	// current data completely (not merge/update). It will
 	// always load latest found snapshot version. This operation
@@ -52,13 +271,116 @@ type DB interface {
 	// blocked until it is done.
 	Load(dir string) error
 
+	// LoadContext is the same as Load, but gives up when ctx is done,
+	// returning its error. If it is interrupted by ctx or by error
+	// reading snapshot, entries loaded so far are kept and the next
+	// LoadContext of the same snapshot continues where the previous
+	// one stopped, unless data was modified in between. Snapshot
+	// checksum is verified after all records are loaded, on mismatch
+	// data is reset.
+	LoadContext(ctx context.Context, dir string) error
+
+	// LoadPrefix is the same as Load, but only loads entries which
+	// keys start with given prefix. If snapshot was saved with
+	// footer index, records that do not match are not read at all.
+	LoadPrefix(dir string, prefix []byte) error
+
+	// LoadMerge merges records of the latest snapshot into current
+	// data. Keys that do not exist are added, values of existing
+	// keys are resolved by conflict, e.g. KeepExisting or
+	// PreferSnapshot, or by update time with WithLastWriteWins. If
+	// merge fails midway, records merged so far are kept. This
+	// operation is synchronous, which means all other operations will
+	// be blocked until it is done.
+	LoadMerge(dir string, conflict ConflictPolicy) error
+
+	// LoadFrom replaces data with records of the latest snapshot in
+	// given blob store saved by SaveTo, streaming them from it. Like
+	// Load, data is reset if there is no snapshot or loading fails.
+	LoadFrom(store BlobStore) error
+
+	// Restore replaces data with records of snapshot file or archive
+	// written by Backup read from r, e.g. object storage download or
+	// stdin, without writing it to snapshot directory. Records are
+	// loaded as they are read, except for snapshots saved with
+	// WithSnapshotIndex, which are staged in temporary file first.
+	// Snapshot in archive is verified against its checksum. If reading
+	// fails, data is reset. All other operations are blocked until it
+	// is done.
+	Restore(r io.Reader) error
+
+	// ApplyPatch applies patch written by WritePatch. Patch is read
+	// whole before any change is made, so incomplete or corrupted
+	// patch changes nothing. With WithLastWriteWins only operations
+	// later than current writes of their entries are applied. All
+	// other operations are blocked while changes are applied.
+	ApplyPatch(r io.Reader) error
+
+	// Health returns report on state of datastore suitable for
+	// readiness probes. It waits for datastore lock like any other
+	// operation, how long that took is part of the report.
+	Health() HealthReport
+
+	// LastSave returns report of the last successful Save, nil if
+	// there was none.
+	LastSave() *Report
+
+	// LastLoad returns report of the last successful Load,
+	// LoadContext, LoadPrefix or LoadMerge, nil if there was none.
+	LastLoad() *Report
+
 	// Wait will block until a previously started operation frees
 	// mutex. If datastore was already closed, it is a no-op.
 	Wait()
 
-	// Close reset the data store and set status to closed. After
-	// this no operations can be done.
-	Close() error
+	// WaitContext is the same as Wait, but gives up waiting when
+	// ctx is done, returning its error.
+	WaitContext(ctx context.Context) error
+
+	// WaitTimeout is the same as Wait, but gives up waiting after
+	// given timeout, returning context.DeadlineExceeded.
+	WaitTimeout(timeout time.Duration) error
+
+	// WaitFor returns value of given key, waiting until entry exists
+	// or ctx is done, in which case ctx error is returned.
+	WaitFor(ctx context.Context, key []byte) ([]byte, error)
+
+	// Events returns channel of notifications about entries being
+	// put, deleted or expired. It returns nil unless datastore was
+	// created with WithEvents. Channel is closed when datastore is
+	// closed.
+	Events() <-chan Event
+
+	// Subscribe returns subscription to events about entries with
+	// keys starting with given prefix, buffering up to buffer events
+	// handled according to policy. Every subscriber gets its own
+	// channel, so one slow subscriber does not affect others unless
+	// policy is Block.
+	Subscribe(prefix []byte, buffer int, policy DropPolicy) (*Subscription, error)
+
+	// Clone returns independent copy of datastore with the same
+	// options, except expvar publication and final save, which stay
+	// with the original. Values are shared rather than copied, which
+	// is safe since datastore never modifies stored values in place.
+	// All other operations are blocked until clone is made.
+	Clone() (DB, error)
+
+	// ReadOnlyView returns handle to datastore which allows only
+	// operations of ReadOnlyDB, for components which must never
+	// modify data. Handle can't be converted back to DB. Closing it
+	// does not close datastore.
+	ReadOnlyView() ReadOnlyDB
+
+	// CopyTo puts all entries into dst, which may be any DB
+	// implementation. Entries already present in dst are kept unless
+	// overwrite is set. All other operations are blocked until copy
+	// is done, so dst MUST NOT be waiting on this datastore.
+	CopyTo(dst DB, overwrite bool) error
+
+	// Reset removes all entries. If datastore was closed, it is
+	// reopened empty with the same options, so a handle shared by
+	// many components can be reused instead of replaced.
+	Reset() error
 }
 
 type Tuple struct {
@@ -66,75 +388,529 @@ type Tuple struct {
 	Value []byte
 }
 
+// HealthReport describes state of datastore.
+type HealthReport struct {
+	// Open is false after datastore was closed.
+	Open bool
+	// LockLatency is how long it took to acquire datastore lock.
+	LockLatency time.Duration
+	// SinceLastSave is time since the last successful Save finished,
+	// 0 if there was none.
+	SinceLastSave time.Duration
+	// LastSaveErr is error of the last Save, nil if it succeeded.
+	LastSaveErr error
+	// LastLoadErr is error of the last Load or its variants, nil if
+	// it succeeded or there was no snapshot to load.
+	LastLoadErr error
+}
+
+// ConflictPolicy resolves value of key existing both in datastore and
+// in snapshot merged by LoadMerge. It returns value to keep, nil to
+// delete the entry, or error to abort the merge.
+type ConflictPolicy func(key, current, snapshot []byte) ([]byte, error)
+
+// KeepExisting is ConflictPolicy keeping current value.
+func KeepExisting(_, current, _ []byte) ([]byte, error) {
+	return current, nil
+}
+
+// PreferSnapshot is ConflictPolicy replacing current value with one
+// from snapshot.
+func PreferSnapshot(_, _, snapshot []byte) ([]byte, error) {
+	return snapshot, nil
+}
+
 type db struct {
-	data     map[string][]byte
+	data     engine
+	opts     *options
 	mutex    *sync.Mutex
+	keyLocks *keyLocks
+	meta     *metaTable
+	access   *accessTable
+	resume   *loadProgress
+	stats    *stats
+	saveErr  error
+	loadErr  error
+	ttl      *ttlTable
+	lastSave *Report
+	lastLoad *Report
 	isClosed bool
+	// revision is incremented on every modification of data,
+	// savedRevision is revision of data in the last saved snapshot
+	revision      uint64
+	savedRevision uint64
+
+	stopSweeper chan struct{}
+	events      *events
+	changes     *changeLog
+	waiters     map[string][]chan struct{}
+	subscribers []*subscriber
+	beforeSave  func(stats Stats) error
+	afterSave   func(info SnapshotInfo) error
+	onRetire    func(info SnapshotInfo) error
+	saveBuffer  *saveBuffer
+	limiter     *rateLimiter
 }
 
 func (d *db) Put(key, value []byte) error {
-	d.mutex.Lock()
+	return d.PutUnsafe(key, d.ownValue(value))
+}
+
+func (d *db) PutUnsafe(key, value []byte) error {
+	if err := d.allowWrite(len(key) + len(value)); err != nil {
+		return err
+	}
+	d.keyLocks.lock(key)
+	defer d.keyLocks.unlock(key)
+	if d.lockWrite(key, value, false) {
+		return nil
+	}
 	defer d.mutex.Unlock()
 
+	return d.put(key, value)
+}
+
+func (d *db) TryPut(key, value []byte) error {
+	if !d.keyLocks.tryLock(key) {
+		return ErrBusy
+	}
+	defer d.keyLocks.unlock(key)
+	if err := d.allowWrite(len(key) + len(value)); err != nil {
+		return err
+	}
+	value = d.ownValue(value)
+	if d.saveBuffer.tryAdd(key, value, false) {
+		return nil
+	}
+	if !d.mutex.TryLock() {
+		// put was not attempted, so it does not count towards limit
+		d.limiter.refund(len(key) + len(value))
+		return ErrBusy
+	}
+	defer d.mutex.Unlock()
+
+	return d.put(key, value)
+}
+
+// ownValue returns copy of value given by caller, so caller can't
+// modify stored data through it, unless datastore was created with
+// WithUnsafePut.
+func (d *db) ownValue(value []byte) []byte {
+	if value == nil || d.opts.unsafePut {
+		return value
+	}
+
+	c := make([]byte, len(value))
+	copy(c, value)
+
+	return c
+}
+
+func (d *db) put(key, value []byte) error {
 	if d.isClosed {
 		return ErrAlreadyClosed
 	}
 
-	d.data[hex.EncodeToString(key)] = value
+	d.stats.countPut()
+	err := d.checkMemory(len(key) + len(value))
+	if err != nil {
+		return wrapKeyError("put", key, err)
+	}
+	err = d.data.put(string(key), value)
+	if err != nil {
+		return wrapKeyError("put", key, err)
+	}
+
+	d.modified()
+	d.meta.touch(string(key), d.revision)
+	d.access.touch(string(key))
+	d.ttl.remove(string(key))
+	d.notify(EventPut, key, value)
+	d.wakeWaiters(string(key))
+
+	return nil
+}
+
+// checkMemory returns ErrMemoryLimit if adding n bytes would take
+// memory held by entries over limit set by WithMemoryLimit.
+func (d *db) checkMemory(n int) error {
+	if d.opts.memoryLimit > 0 && d.data.memSize()+int64(n) > d.opts.memoryLimit {
+		return ErrMemoryLimit
+	}
 
 	return nil
 }
 
 func (d *db) Get(key []byte) ([]byte, error) {
-	d.mutex.Lock()
+	value, err := d.GetUnsafe(key)
+
+	return d.safeValue(value), err
+}
+
+func (d *db) GetUnsafe(key []byte) ([]byte, error) {
+	if value, ok, err := d.saveBuffer.get(key); ok {
+		return value, wrapKeyError("get", key, err)
+	}
+
+	d.lock()
+	defer d.mutex.Unlock()
+
+	return d.get(key)
+}
+
+func (d *db) Has(key []byte) (bool, error) {
+	d.lock()
 	defer d.mutex.Unlock()
 
+	if d.isClosed {
+		return false, ErrAlreadyClosed
+	}
+
+	if d.expire(string(key)) {
+		return false, nil
+	}
+
+	_, err := d.data.get(string(key))
+	if err == ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, wrapKeyError("get", key, err)
+	}
+
+	return true, nil
+}
+
+func (d *db) TryGet(key []byte) ([]byte, error) {
+	if !d.mutex.TryLock() {
+		return nil, ErrBusy
+	}
+	defer d.mutex.Unlock()
+
+	value, err := d.get(key)
+
+	return d.safeValue(value), err
+}
+
+// safeValue returns copy of stored value, so caller can't modify
+// stored data through it, unless datastore was created with
+// WithUnsafeGet. All reads returning values use it, except GetUnsafe.
+func (d *db) safeValue(value []byte) []byte {
+	if value == nil || d.opts.unsafeGet {
+		return value
+	}
+
+	c := make([]byte, len(value))
+	copy(c, value)
+
+	return c
+}
+
+func (d *db) get(key []byte) ([]byte, error) {
 	if d.isClosed {
 		return nil, ErrAlreadyClosed
 	}
 
-	value, ok := d.data[hex.EncodeToString(key)]
-	if !ok {
-		return nil, ErrKeyNotFound
+	d.stats.countGet()
+	if d.expire(string(key)) {
+		d.stats.countMiss()
+		return nil, wrapKeyError("get", key, ErrKeyNotFound)
 	}
+	value, err := d.data.get(string(key))
+	if err == ErrKeyNotFound {
+		d.stats.countMiss()
+	}
+	if err != nil {
+		return nil, wrapKeyError("get", key, err)
+	}
+	d.stats.countHit()
+	d.access.touch(string(key))
 
 	return value, nil
 }
 
+func (d *db) PutReader(key []byte, r io.Reader, size int64) error {
+	if size < 0 {
+		return wrapKeyError("put", key, ErrInvalidSize)
+	}
+	if err := d.allowWrite(len(key) + int(size)); err != nil {
+		return err
+	}
+	d.keyLocks.lock(key)
+	defer d.keyLocks.unlock(key)
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return ErrAlreadyClosed
+	}
+
+	d.stats.countPut()
+	err := d.checkMemory(len(key) + int(size))
+	if err != nil {
+		return wrapKeyError("put", key, err)
+	}
+	err = putReader(d.data, string(key), r, size)
+	if err != nil {
+		return wrapKeyError("put", key, err)
+	}
+
+	d.modified()
+	d.meta.touch(string(key), d.revision)
+	d.access.touch(string(key))
+	d.ttl.remove(string(key))
+	d.notify(EventPut, key, nil)
+	d.wakeWaiters(string(key))
+
+	return nil
+}
+
+func (d *db) GetReader(key []byte) (io.ReadCloser, error) {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return nil, ErrAlreadyClosed
+	}
+
+	d.stats.countGet()
+	if d.expire(string(key)) {
+		d.stats.countMiss()
+		return nil, wrapKeyError("get", key, ErrKeyNotFound)
+	}
+	r, err := getReader(d.data, string(key))
+	if err == ErrKeyNotFound {
+		d.stats.countMiss()
+	}
+	if err != nil {
+		return nil, wrapKeyError("get", key, err)
+	}
+	d.stats.countHit()
+	d.access.touch(string(key))
+
+	return r, nil
+}
+
 func (d *db) Delete(key []byte) error {
-	d.mutex.Lock()
+	if err := d.allowWrite(len(key)); err != nil {
+		return err
+	}
+	d.keyLocks.lock(key)
+	defer d.keyLocks.unlock(key)
+	if d.lockWrite(key, nil, true) {
+		return nil
+	}
 	defer d.mutex.Unlock()
 
+	return d.delete(key)
+}
+
+func (d *db) delete(key []byte) error {
 	if d.isClosed {
 		return ErrAlreadyClosed
 	}
 
-	delete(d.data, hex.EncodeToString(key))
+	d.stats.countDelete()
+	// deleting missing key is not a change anyone needs to hear about
+	if d.remove(string(key)) {
+		d.notify(EventDelete, key, nil)
+	}
 
 	return nil
 }
 
+// modified records data was modified, so it differs from both the
+// last saved snapshot and partially loaded one.
+func (d *db) modified() {
+	d.resume = nil
+	d.revision++
+}
+
+// remove removes entry for given key along with its metadata,
+// reporting whether it existed. Data is only modified if it did.
+func (d *db) remove(key string) bool {
+	ok := d.data.delete(key)
+	d.meta.remove(key)
+	d.access.remove(key)
+	d.ttl.remove(key)
+	if !ok {
+		return false
+	}
+	d.modified()
+
+	return true
+}
+
+func (d *db) GetMeta(key []byte) (Meta, error) {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return Meta{}, ErrAlreadyClosed
+	}
+	if d.meta == nil {
+		return Meta{}, ErrNoMeta
+	}
+
+	m, ok := d.meta.get(string(key))
+	if !ok || d.expire(string(key)) {
+		return Meta{}, wrapKeyError("get", key, ErrKeyNotFound)
+	}
+
+	return m.export(), nil
+}
+
+func (d *db) DoWithKey(key []byte, fn func(current []byte) ([]byte, error)) error {
+	// new value is not known yet, so only key is counted
+	if err := d.allowWrite(len(key)); err != nil {
+		return err
+	}
+	// without key locks the whole datastore stays locked while fn runs
+	if d.keyLocks == nil {
+		d.lock()
+		defer d.mutex.Unlock()
+
+		current, err := d.getCurrent(key)
+		if err != nil {
+			return err
+		}
+		value, err := fn(current)
+		if err != nil {
+			return err
+		}
+		return d.replace(key, d.ownValue(value))
+	}
+
+	d.keyLocks.lock(key)
+	defer d.keyLocks.unlock(key)
+
+	d.lock()
+	current, err := d.getCurrent(key)
+	d.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	value, err := fn(current)
+	if err != nil {
+		return err
+	}
+	value = d.ownValue(value)
+
+	d.lock()
+	defer d.mutex.Unlock()
+
+	return d.replace(key, value)
+}
+
+// getCurrent returns value for given key, nil if key does not exist.
+func (d *db) getCurrent(key []byte) ([]byte, error) {
+	value, err := d.get(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, nil
+	}
+
+	return value, err
+}
+
+// replace puts given value for given key, or deletes entry if value
+// is nil.
+func (d *db) replace(key, value []byte) error {
+	if value == nil {
+		return d.delete(key)
+	}
+
+	return d.put(key, value)
+}
+
 func (d *db) Size() uint64 {
-	d.mutex.Lock()
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return 0
+	}
+
+	return uint64(d.data.len())
+}
+
+func (d *db) SizeBytes() uint64 {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return 0
+	}
+
+	return uint64(d.data.memSize())
+}
+
+func (d *db) SizeHistogram(buckets []int) map[string]uint64 {
+	sorted := append([]int{}, buckets...)
+	sort.Ints(sorted)
+	bounds := make([]int, 0, len(sorted))
+	for _, b := range sorted {
+		if b > 0 && (len(bounds) == 0 || b != bounds[len(bounds)-1]) {
+			bounds = append(bounds, b)
+		}
+	}
+
+	labels := make([]string, len(bounds)+1)
+	lower := 0
+	for i, upper := range bounds {
+		labels[i] = strconv.Itoa(lower) + "-" + strconv.Itoa(upper-1)
+		lower = upper
+	}
+	labels[len(bounds)] = strconv.Itoa(lower) + "+"
+
+	result := make(map[string]uint64, len(labels))
+	for _, label := range labels {
+		result[label] = 0
+	}
+
+	d.lock()
 	defer d.mutex.Unlock()
 
-	return uint64(len(d.data))
+	if d.isClosed {
+		return result
+	}
+
+	d.removeExpired()
+
+	// value log read error ends iteration, histogram is approximate
+	// anyway
+	err := d.data.forEach(func(_ string, value []byte) error {
+		i := sort.SearchInts(bounds, len(value)+1)
+		result[labels[i]]++
+		return nil
+	})
+	if err != nil {
+		d.opts.logger.Errorf("kvndb: size histogram is incomplete, failed to read values: %v", err)
+	}
+
+	return result
 }
 
 func (d *db) Keys() (<-chan []byte, error) {
-	d.mutex.Lock()
+	d.lock()
 
 	if d.isClosed {
+		d.mutex.Unlock()
 		return nil, ErrAlreadyClosed
 	}
 
+	d.removeExpired()
+
 	ch := make(chan []byte)
 
 	go func() {
 		defer d.mutex.Unlock()
-		for key := range d.data {
-			ch <- hexToBytes(key)
-		}
+		// there is no way to report iteration error over channel,
+		// it can only come from reading value log and ends iteration
+		_ = d.data.forEach(func(key string, _ []byte) error {
+			ch <- []byte(key)
+			return nil
+		})
 		close(ch)
 	}()
 
@@ -142,21 +918,90 @@ func (d *db) Keys() (<-chan []byte, error) {
 }
 
 func (d *db) KeysAndValues() (<-chan *Tuple, error) {
-	d.mutex.Lock()
+	d.lock()
 
 	if d.isClosed {
+		d.mutex.Unlock()
 		return nil, ErrAlreadyClosed
 	}
 
+	d.removeExpired()
+
 	ch := make(chan *Tuple)
 
 	go func() {
 		defer d.mutex.Unlock()
-		for key, val := range d.data {
+		// there is no way to report iteration error over channel,
+		// it can only come from reading value log and ends iteration
+		_ = d.data.forEach(func(key string, val []byte) error {
 			ch <- &Tuple{
-				Key:   hexToBytes(key),
-				Value: val,
+				Key:   []byte(key),
+				Value: d.safeValue(val),
 			}
+			return nil
+		})
+		close(ch)
+	}()
+
+	return ch, nil
+}
+
+func (d *db) KeysBatched(n int) (<-chan [][]byte, error) {
+	tuples, err := d.KeysAndValuesBatched(n)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan [][]byte)
+
+	go func() {
+		defer close(ch)
+		for batch := range tuples {
+			keys := make([][]byte, len(batch))
+			for i, t := range batch {
+				keys[i] = t.Key
+			}
+			ch <- keys
+		}
+	}()
+
+	return ch, nil
+}
+
+func (d *db) KeysAndValuesBatched(n int) (<-chan []*Tuple, error) {
+	if n <= 0 {
+		n = defaultBatchSize
+	}
+
+	d.lock()
+
+	if d.isClosed {
+		d.mutex.Unlock()
+		return nil, ErrAlreadyClosed
+	}
+
+	d.removeExpired()
+
+	ch := make(chan []*Tuple)
+
+	go func() {
+		defer d.mutex.Unlock()
+		batch := make([]*Tuple, 0, n)
+		// there is no way to report iteration error over channel,
+		// it can only come from reading value log and ends iteration
+		_ = d.data.forEach(func(key string, val []byte) error {
+			batch = append(batch, &Tuple{
+				Key:   []byte(key),
+				Value: d.safeValue(val),
+			})
+			if len(batch) == n {
+				ch <- batch
+				batch = make([]*Tuple, 0, n)
+			}
+			return nil
+		})
+		if len(batch) > 0 {
+			ch <- batch
 		}
 		close(ch)
 	}()
@@ -164,10 +1009,161 @@ func (d *db) KeysAndValues() (<-chan *Tuple, error) {
 	return ch, nil
 }
 
+func (d *db) KeysMatching(pattern string) (<-chan []byte, error) {
+	return d.keysMatching(globPrefix(pattern), func(key string) bool {
+		return globMatch(pattern, key)
+	})
+}
+
+func (d *db) KeysRegexp(re *regexp.Regexp) (<-chan []byte, error) {
+	// literal prefix only constrains keys when regexp is anchored
+	prefix := ""
+	if strings.HasPrefix(re.String(), "^") {
+		prefix, _ = re.LiteralPrefix()
+	}
+
+	return d.keysMatching(prefix, func(key string) bool {
+		return re.MatchString(key)
+	})
+}
+
+// keysMatching returns channel of keys starting with given prefix for
+// which match returns true.
+func (d *db) keysMatching(prefix string, match func(key string) bool) (<-chan []byte, error) {
+	d.lock()
+
+	if d.isClosed {
+		d.mutex.Unlock()
+		return nil, ErrAlreadyClosed
+	}
+
+	d.removeExpired()
+
+	ch := make(chan []byte)
+
+	go func() {
+		defer d.mutex.Unlock()
+		// there is no way to report iteration error over channel,
+		// it can only come from reading value log and ends iteration
+		_ = forEachMatching(d.data, prefix, match, func(key string) error {
+			ch <- []byte(key)
+			return nil
+		})
+		close(ch)
+	}()
+
+	return ch, nil
+}
+
+// errLimitReached stops iteration once enough entries were found.
+var errLimitReached = errors.New("kvndb: limit reached")
+
+func (d *db) FindValues(pred func(value []byte) bool, limit int) ([]*Tuple, error) {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return nil, ErrAlreadyClosed
+	}
+
+	d.removeExpired()
+
+	result := make([]*Tuple, 0)
+	err := d.data.forEach(func(key string, value []byte) error {
+		if !pred(value) {
+			return nil
+		}
+		result = append(result, &Tuple{
+			Key:   []byte(key),
+			Value: d.safeValue(value),
+		})
+		if limit > 0 && len(result) >= limit {
+			return errLimitReached
+		}
+		return nil
+	})
+	if err != nil && err != errLimitReached {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (d *db) Range(start, end []byte) (<-chan *Tuple, error) {
+	d.lock()
+
+	if d.isClosed {
+		d.mutex.Unlock()
+		return nil, ErrAlreadyClosed
+	}
+
+	d.removeExpired()
+
+	ch := make(chan *Tuple)
+
+	go func() {
+		defer d.mutex.Unlock()
+		send := func(key string) error {
+			val, err := d.data.get(key)
+			if err != nil {
+				return err
+			}
+			ch <- &Tuple{
+				Key:   []byte(key),
+				Value: d.safeValue(val),
+			}
+			return nil
+		}
+		// there is no way to report iteration error over channel,
+		// it can only come from reading value log and ends iteration
+		if re, ok := d.data.(rangeEngine); ok {
+			_ = re.ascend(string(start), string(end), end != nil, send)
+		} else {
+			_ = ascendSorted(d.data, string(start), string(end), end != nil, send)
+		}
+		close(ch)
+	}()
+
+	return ch, nil
+}
+
+func (d *db) BeforeSave(fn func(stats Stats) error) {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	d.beforeSave = fn
+}
+
+func (d *db) AfterSave(fn func(info SnapshotInfo) error) {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	d.afterSave = fn
+}
+
+func (d *db) OnRetire(fn func(info SnapshotInfo) error) {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	d.onRetire = fn
+}
+
 func (d *db) Save(dir string, hist uint) error {
-	d.mutex.Lock()
+	if d.saveBuffer.start() {
+		d.lock()
+		defer d.mutex.Unlock()
+		defer d.applySaveBuffer()
+
+		return d.save(dir, hist)
+	}
+
+	d.lock()
 	defer d.mutex.Unlock()
 
+	return d.save(dir, hist)
+}
+
+func (d *db) save(dir string, hist uint) error {
 	if d.isClosed {
 		return ErrAlreadyClosed
 	}
@@ -176,18 +1172,216 @@ func (d *db) Save(dir string, hist uint) error {
 		return ErrTooMuchHistory
 	}
 
-	return save(d, dir, hist)
+	d.removeExpired()
+
+	if d.opts.skipUnchanged && d.lastSave != nil && d.lastSave.Dir == dir && d.revision == d.savedRevision {
+		d.opts.logger.Debugf("kvndb: data was not modified since snapshot %d, skipped saving to %s", d.lastSave.Id, dir)
+		return ErrNotModified
+	}
+
+	if d.beforeSave != nil {
+		err := d.beforeSave(d.currentStats())
+		if err != nil {
+			err = wrapSnapshotError("before save", dir, 0, err)
+			d.saveErr = err
+			d.opts.logger.Errorf("kvndb: refused to save snapshot to %s: %v", dir, err)
+			return err
+		}
+	}
+
+	err := save(d, dir, hist)
+	if err == nil && d.afterSave != nil {
+		info := d.lastSave.snapshotInfo()
+		err = wrapSnapshotError("after save", dir, info.Id, d.afterSave(info))
+	}
+	d.saveErr = err
+	if err != nil {
+		d.opts.logger.Errorf("kvndb: failed to save snapshot to %s: %v", dir, err)
+	}
+
+	return err
 }
 
 func (d *db) Load(dir string) error {
-	d.mutex.Lock()
+	d.keyLocks.lockAll()
+	defer d.keyLocks.unlockAll()
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return ErrAlreadyClosed
+	}
+
+	err := load(d, dir, nil, nil)
+	d.setLoadErr(err)
+	if err != nil && !errors.Is(err, ErrSnapshotNotFound) {
+		d.opts.logger.Errorf("kvndb: failed to load snapshot from %s: %v", dir, err)
+	}
+
+	return err
+}
+
+func (d *db) LoadContext(ctx context.Context, dir string) error {
+	d.keyLocks.lockAll()
+	defer d.keyLocks.unlockAll()
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return ErrAlreadyClosed
+	}
+
+	err := loadResumable(ctx, d, dir)
+	d.setLoadErr(err)
+	if err != nil && !errors.Is(err, ErrSnapshotNotFound) && ctx.Err() == nil {
+		d.opts.logger.Errorf("kvndb: failed to load snapshot from %s: %v", dir, err)
+	}
+
+	return err
+}
+
+func (d *db) LoadPrefix(dir string, prefix []byte) error {
+	d.keyLocks.lockAll()
+	defer d.keyLocks.unlockAll()
+	d.lock()
 	defer d.mutex.Unlock()
 
 	if d.isClosed {
 		return ErrAlreadyClosed
 	}
 
-	return load(d, dir)
+	err := load(d, dir, prefix, nil)
+	d.setLoadErr(err)
+	if err != nil && !errors.Is(err, ErrSnapshotNotFound) {
+		d.opts.logger.Errorf("kvndb: failed to load snapshot from %s: %v", dir, err)
+	}
+
+	return err
+}
+
+func (d *db) LoadMerge(dir string, conflict ConflictPolicy) error {
+	d.keyLocks.lockAll()
+	defer d.keyLocks.unlockAll()
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return ErrAlreadyClosed
+	}
+
+	err := load(d, dir, nil, conflict)
+	d.setLoadErr(err)
+	if err != nil && !errors.Is(err, ErrSnapshotNotFound) {
+		d.opts.logger.Errorf("kvndb: failed to merge snapshot from %s: %v", dir, err)
+	}
+
+	return err
+}
+
+func (d *db) ApplyPatch(r io.Reader) error {
+	ops, err := readPatch(r)
+	if err != nil {
+		return err
+	}
+
+	d.keyLocks.lockAll()
+	defer d.keyLocks.unlockAll()
+	d.lock()
+	defer d.mutex.Unlock()
+
+	for _, op := range ops {
+		if d.opts.lastWriteWins && op.ts != 0 {
+			err = d.applyLatest(op)
+		} else if op.op == patchOpDelete {
+			err = d.delete(op.key)
+		} else {
+			err = d.put(op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyLatest applies patch operation unless entry was written later
+// than it. Entry put by patch gets time of the operation.
+func (d *db) applyLatest(op patchOp) error {
+	key := string(op.key)
+	m, ok := d.meta.get(key)
+	if ok {
+		current, err := d.data.get(key)
+		if err != nil && err != ErrKeyNotFound {
+			return err
+		}
+		// deletion wins over put made at the same time
+		if op.op == patchOpDelete && m.updated > op.ts {
+			return nil
+		}
+		if op.op == patchOpPut && !laterWrite(op.ts, op.value, m.updated, current) {
+			return nil
+		}
+	}
+
+	if op.op == patchOpDelete {
+		return d.delete(op.key)
+	}
+
+	err := d.put(op.key, op.value)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		m.created = op.ts
+	}
+	m.updated = op.ts
+	m.revision = d.revision
+	d.meta.set(key, m)
+
+	return nil
+}
+
+// setLoadErr records result of the last load for Health. Missing
+// snapshot is not an error there, new datastore has none.
+func (d *db) setLoadErr(err error) {
+	if errors.Is(err, ErrSnapshotNotFound) {
+		err = nil
+	}
+	d.loadErr = err
+	d.wakeAllWaiters()
+}
+
+func (d *db) Health() HealthReport {
+	start := time.Now()
+	d.lock()
+	defer d.mutex.Unlock()
+
+	report := HealthReport{
+		Open:        !d.isClosed,
+		LockLatency: time.Since(start),
+		LastSaveErr: d.saveErr,
+		LastLoadErr: d.loadErr,
+	}
+	if d.lastSave != nil {
+		report.SinceLastSave = time.Since(d.lastSave.Started.Add(d.lastSave.Duration))
+	}
+
+	return report
+}
+
+func (d *db) LastSave() *Report {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	return d.lastSave.copy()
+}
+
+func (d *db) LastLoad() *Report {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	return d.lastLoad.copy()
 }
 
 func (d *db) Wait() {
@@ -195,28 +1389,154 @@ func (d *db) Wait() {
 	defer d.mutex.Unlock()
 }
 
+func (d *db) WaitContext(ctx context.Context) error {
+	done := make(chan struct{})
+
+	// if ctx is done first, this goroutine lingers until mutex is
+	// freed, there is no way to abandon waiting for sync.Mutex
+	go func() {
+		d.mutex.Lock()
+		d.mutex.Unlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *db) WaitTimeout(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return d.WaitContext(ctx)
+}
+
 func (d *db) Close() error {
-	d.mutex.Lock()
+	d.lock()
 	defer d.mutex.Unlock()
 
 	if d.isClosed {
 		return ErrAlreadyClosed
 	}
 
+	if d.opts.finalSaveDir != "" {
+		err := d.save(d.opts.finalSaveDir, d.opts.finalSaveHist)
+		if err != nil && err != ErrNotModified {
+			return err
+		}
+	}
+
+	if d.stopSweeper != nil {
+		close(d.stopSweeper)
+		d.stopSweeper = nil
+	}
+
+	d.closeEvents()
+	d.changes.reset()
+	d.changes = nil
+	d.wakeAllWaiters()
+
+	err := d.data.close()
 	d.data = nil
+	d.meta = nil
+	d.access = nil
+	d.ttl = nil
+	d.resume = nil
 	d.isClosed = true
 
-	return nil
+	return err
+}
+
+func (d *db) Reset() error {
+	d.keyLocks.lockAll()
+	defer d.keyLocks.unlockAll()
+	d.lock()
+	defer d.mutex.Unlock()
+
+	d.modified()
+	d.changes.reset()
+
+	if d.isClosed {
+		d.data = d.opts.newEngine()
+		if d.opts.entryMeta {
+			d.meta = newMetaTable(d.opts.clock)
+		}
+		if d.opts.accessDecay > 0 {
+			d.access = newAccessTable(d.opts.accessLogFactor, d.opts.accessDecay, d.opts.clock)
+		}
+		if d.opts.sweepInterval > 0 {
+			d.startSweeper(d.opts.sweepInterval, d.opts.sweepLimit)
+		}
+		if d.opts.events {
+			d.events = newEvents(d.opts.eventsBuffer, d.opts.eventsPolicy)
+		}
+		if d.opts.changeLogSize > 0 {
+			d.changes = newChangeLog(d.opts.changeLogSize)
+		}
+		d.isClosed = false
+		return nil
+	}
+
+	return resetData(d, nil)
+}
+
+// New creates new datastore configured with given options.
+func New(opts ...Option) DB {
+	return newDb(opts...)
 }
 
-func New() DB {
-	return newDb()
+func newDb(opts ...Option) *db {
+	return newDbWithOptions(newOptions(opts))
 }
 
-func newDb() *db {
-	return &db{
-		data:     make(map[string][]byte),
+func newDbWithOptions(o *options) *db {
+	d := &db{
+		data:     o.newEngine(),
+		opts:     o,
 		mutex:    &sync.Mutex{},
 		isClosed: false,
 	}
+
+	if o.keyLocks {
+		d.keyLocks = newKeyLocks(o.keyLockStripes)
+	}
+
+	if o.entryMeta {
+		d.meta = newMetaTable(o.clock)
+	}
+
+	if o.accessDecay > 0 {
+		d.access = newAccessTable(o.accessLogFactor, o.accessDecay, o.clock)
+	}
+
+	d.stats = &stats{}
+	if o.expvarName != "" {
+		d.publish(o.expvarName)
+	}
+
+	if o.sweepInterval > 0 {
+		d.startSweeper(o.sweepInterval, o.sweepLimit)
+	}
+
+	if o.events {
+		d.events = newEvents(o.eventsBuffer, o.eventsPolicy)
+	}
+
+	if o.saveBuffer {
+		d.saveBuffer = &saveBuffer{}
+	}
+
+	if o.changeLogSize > 0 {
+		d.changes = newChangeLog(o.changeLogSize)
+	}
+
+	if o.rateOps > 0 || o.rateBytes > 0 {
+		d.limiter = newRateLimiter(o.rateOps, o.rateBytes, o.clock)
+	}
+
+	return d
 }
@@ -2,11 +2,33 @@ package kvndb
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/golang/snappy"
 )
 
 func TestKvndbSaveLoad(t *testing.T) {
@@ -40,7 +62,7 @@ func TestKvndbSaveLoad(t *testing.T) {
 		t.Fatalf("loaded data size mismatch; test data size [%d], but loaded [%d]", len(testData), len(loadedData))
 	}
 	for k, tv := range testData {
-		if v, ok := loadedData[k]; ok {
+		if v, ok := loadedData[string(hexToBytes(k))]; ok {
 			if !bytes.Equal(tv, v) {
 				t.Fatalf("slices are not equal. expected [%s], but got [%s]", hex.EncodeToString(tv), hex.EncodeToString(v))
 			}
@@ -71,5 +93,3996 @@ func testKvndbLoad(t *testing.T, dir string) map[string][]byte {
 		t.Fatal(err)
 	}
 
-	return d.data
+	result := make(map[string][]byte)
+	err = d.data.forEach(func(key string, value []byte) error {
+		result[key] = value
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+func TestKvndbArena(t *testing.T) {
+	d := New(WithArena(64))
+
+	// overwrite the same keys enough times to trigger compaction
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 10; j++ {
+			key := []byte{byte(j)}
+			value := bytes.Repeat([]byte{byte(i)}, j+1)
+			if err := d.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := d.Delete([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	// value bigger than chunk gets dedicated chunk
+	big := bytes.Repeat([]byte{0xff}, 100)
+	if err := d.Put([]byte("big"), big); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Size() != 10 {
+		t.Fatalf("expected size [10], but got [%d]", d.Size())
+	}
+	if _, err := d.Get([]byte{0}); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected [%v], but got [%v]", ErrKeyNotFound, err)
+	}
+	for j := 1; j < 10; j++ {
+		v, err := d.Get([]byte{byte(j)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, bytes.Repeat([]byte{99}, j+1)) {
+			t.Fatalf("unexpected value for key [%d]: [%s]", j, hex.EncodeToString(v))
+		}
+	}
+	v, err := d.Get([]byte("big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, big) {
+		t.Fatalf("unexpected value for big key: [%s]", hex.EncodeToString(v))
+	}
+
+	// chunk offsets must fit into references
+	e := newArenaEngine(int(^uint(0) >> 1))
+	if uint64(e.chunkSize) > math.MaxUint32 {
+		t.Fatalf("expected chunk size to be capped, but got [%d]", e.chunkSize)
+	}
+}
+
+func hexToBytes(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+func TestKvndbValueLog(t *testing.T) {
+	dir := t.TempDir()
+	d := New(WithValueLog(dir, 16))
+
+	small := []byte("small")
+	if err := d.Put([]byte("small"), small); err != nil {
+		t.Fatal(err)
+	}
+	// overwrite the same large key enough times to trigger compaction
+	var large []byte
+	for i := 0; i < 10; i++ {
+		large = bytes.Repeat([]byte{byte(i)}, 32)
+		if err := d.Put([]byte("large"), large); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if d.Size() != 2 {
+		t.Fatalf("expected size [2], but got [%d]", d.Size())
+	}
+	for k, tv := range map[string][]byte{"small": small, "large": large} {
+		v, err := d.Get([]byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tv, v) {
+			t.Fatalf("slices are not equal. expected [%s], but got [%s]", hex.EncodeToString(tv), hex.EncodeToString(v))
+		}
+	}
+
+	// large value moving to memory must not linger in value log
+	if err := d.Put([]byte("large"), small); err != nil {
+		t.Fatal(err)
+	}
+	if d.Size() != 2 {
+		t.Fatalf("expected size [2], but got [%d]", d.Size())
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected value log to be removed on close, but found [%d] files", len(entries))
+	}
+
+	// truncated value log must not yield zero-filled values
+	d = New(WithValueLog(dir, 16))
+	defer d.Close()
+	if err := d.Put([]byte("large"), large); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ = os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("expected one value log file, but found [%d]", len(entries))
+	}
+	if err := os.Truncate(filepath.Join(dir, entries[0].Name()), 16); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get([]byte("large")); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected [%v], but got [%v]", io.ErrUnexpectedEOF, err)
+	}
+	// failed read is neither hit nor miss
+	if s := d.Stats(); s.Gets != 1 || s.Hits != 0 || s.Misses != 0 {
+		t.Fatalf("expected [1] get without hits and misses, but got %+v", s)
+	}
+}
+
+func TestKvndbStreaming(t *testing.T) {
+	dir := t.TempDir()
+	d := New(WithValueLog(dir, 16))
+
+	large := bytes.Repeat([]byte{0xab}, 100_000)
+	if err := d.PutReader([]byte("large"), bytes.NewReader(large), int64(len(large))); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutReader([]byte("short"), bytes.NewReader(large[:10]), 20); err == nil {
+		t.Fatal("expected error on short reader")
+	}
+	for _, p := range []DB{d, New()} {
+		if err := p.PutReader([]byte("negative"), bytes.NewReader(large), -1); !errors.Is(err, ErrInvalidSize) {
+			t.Fatalf("expected [%v], but got [%v]", ErrInvalidSize, err)
+		}
+	}
+
+	r, err := d.GetReader([]byte("large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// overwriting value and closing datastore must not affect open reader
+	for i := 0; i < 10; i++ {
+		if err := d.Put([]byte("large"), bytes.Repeat([]byte{byte(i)}, 32)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, large) {
+		t.Fatalf("streamed value mismatch, expected [%d] bytes, but got [%d]", len(large), len(v))
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected value log to be removed after reader closed, but found [%d] files", len(entries))
+	}
+}
+
+func TestKvndbRange(t *testing.T) {
+	for name, d := range map[string]DB{"sorted": New(), "indexed": New(WithOrderedIndex())} {
+		keys := []string{"b", "a", "d", "c", "e", "ab"}
+		for _, k := range keys {
+			if err := d.Put([]byte(k), []byte(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Delete([]byte("d")); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			start, end []byte
+			expected   string
+		}{
+			{nil, nil, "a,ab,b,c,e"},
+			{[]byte("ab"), []byte("c"), "ab,b"},
+			{[]byte("b"), nil, "b,c,e"},
+			{[]byte("c"), []byte("c"), ""},
+		}
+		for _, tt := range tests {
+			ch, err := d.Range(tt.start, tt.end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result := make([]string, 0)
+			for tuple := range ch {
+				if !bytes.Equal(tuple.Key, tuple.Value) {
+					t.Fatalf("%s: unexpected value [%s] for key [%s]", name, tuple.Value, tuple.Key)
+				}
+				result = append(result, string(tuple.Key))
+			}
+			if strings.Join(result, ",") != tt.expected {
+				t.Fatalf("%s: range [%s, %s) expected [%s], but got [%s]", name, tt.start, tt.end, tt.expected, strings.Join(result, ","))
+			}
+		}
+	}
+}
+
+func TestKvndbOpenLazy(t *testing.T) {
+	t.Run("scan", func(t *testing.T) {
+		testKvndbOpenLazy(t, New())
+	})
+	t.Run("index", func(t *testing.T) {
+		testKvndbOpenLazy(t, New(WithSnapshotIndex()))
+	})
+}
+
+func testKvndbOpenLazy(t *testing.T, src DB) {
+	dir := t.TempDir()
+
+	// values span several snappy chunks
+	testData := make(map[string][]byte)
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		value := make([]byte, 200)
+		rand.Read(value)
+		testData[string(key)] = value
+		if err := src.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.Save(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range [][]Option{nil, {WithLazyCache()}, {WithOrderedIndex()}} {
+		d, err := OpenLazy(dir, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Size() != uint64(len(testData)) {
+			t.Fatalf("expected size [%d], but got [%d]", len(testData), d.Size())
+		}
+		for k, tv := range testData {
+			v, err := d.Get([]byte(k))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(tv, v) {
+				t.Fatalf("slices are not equal. expected [%s], but got [%s]", hex.EncodeToString(tv), hex.EncodeToString(v))
+			}
+		}
+
+		if err := d.Put([]byte("key-0001"), []byte("updated")); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Delete([]byte("key-0002")); err != nil {
+			t.Fatal(err)
+		}
+		ch, err := d.Range([]byte("key-0000"), []byte("key-0004"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := make([]string, 0)
+		for tuple := range ch {
+			result = append(result, string(tuple.Key)+"="+strconv.Itoa(len(tuple.Value)))
+		}
+		if strings.Join(result, ",") != "key-0000=200,key-0001=7,key-0003=200" {
+			t.Fatalf("unexpected range result [%s]", strings.Join(result, ","))
+		}
+
+		count := 0
+		ch, err = d.KeysAndValues()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range ch {
+			count++
+		}
+		if count != len(testData)-1 {
+			t.Fatalf("expected [%d] entries, but got [%d]", len(testData)-1, count)
+		}
+
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestKvndbLoadLegacySnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	// snapshots without header are plain snappy stream of records
+	fd, err := os.Create(getSnapshotFilepath(dir, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := snappy.NewBufferedWriter(fd)
+	testData := map[string][]byte{"a": []byte("1"), "b": []byte("2")}
+	for k, v := range testData {
+		if _, err := w.Write(packBytes([]byte(k), v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writeSnapshotChecksum(1, dir, 0600, false); err != nil {
+		t.Fatal(err)
+	}
+
+	d := New()
+	if err := d.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	for k, tv := range testData {
+		v, err := d.Get([]byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tv, v) {
+			t.Fatalf("slices are not equal. expected [%s], but got [%s]", hex.EncodeToString(tv), hex.EncodeToString(v))
+		}
+	}
+}
+
+func TestKvndbLoadPrefix(t *testing.T) {
+	for name, src := range map[string]DB{"scan": New(), "index": New(WithSnapshotIndex())} {
+		dir := t.TempDir()
+		for _, k := range []string{"users/1", "users/2", "orders/1", "user"} {
+			if err := src.Put([]byte(k), []byte(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := src.Save(dir, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		d := New()
+		if err := d.Put([]byte("stale"), []byte("stale")); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.LoadPrefix(dir, []byte("users/")); err != nil {
+			t.Fatal(err)
+		}
+		if d.Size() != 2 {
+			t.Fatalf("%s: expected size [2], but got [%d]", name, d.Size())
+		}
+		for _, k := range []string{"users/1", "users/2"} {
+			v, err := d.Get([]byte(k))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(v) != k {
+				t.Fatalf("%s: unexpected value [%s] for key [%s]", name, v, k)
+			}
+		}
+	}
+}
+
+func TestManager(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := NewManager(dir, 1, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"users", "orders"} {
+		d, err := m.DB(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Put([]byte(name), []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.DB("../escape"); !errors.Is(err, ErrBadName) {
+		t.Fatalf("expected [%v], but got [%v]", ErrBadName, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = NewManager(dir, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	for _, name := range []string{"users", "orders"} {
+		d, err := m.DB(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := d.Get([]byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != name {
+			t.Fatalf("unexpected value [%s] for key [%s]", v, name)
+		}
+	}
+	if strings.Join(m.Names(), ",") != "orders,users" {
+		t.Fatalf("unexpected names [%s]", strings.Join(m.Names(), ","))
+	}
+}
+
+func TestManagerCloseSaveFailure(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := NewManager(dir, 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := m.DB("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = d.Put([]byte("a"), []byte("1"))
+
+	lock, err := lockDir(filepath.Join(dir, "users"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); !errors.Is(err, ErrDirLocked) {
+		t.Fatalf("expected [%v], but got [%v]", ErrDirLocked, err)
+	}
+	// unsaved data is kept until it can be saved
+	if v, err := d.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("expected datastore to stay open, but got [%s], [%v]", v, err)
+	}
+	if _, err := m.DB("users"); err != nil {
+		t.Fatalf("expected manager to stay open, but got [%v]", err)
+	}
+
+	if err := lock.unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get([]byte("a")); err != ErrAlreadyClosed {
+		t.Fatalf("expected [%v], but got [%v]", ErrAlreadyClosed, err)
+	}
+
+	l := New()
+	defer l.Close()
+	if err := l.Load(filepath.Join(dir, "users")); err != nil {
+		t.Fatal(err)
+	}
+	if l.Size() != 1 {
+		t.Fatalf("expected [1] entry, but got [%d]", l.Size())
+	}
+}
+
+func TestKvndbDirLock(t *testing.T) {
+	dir := t.TempDir()
+	d := New()
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Save(dir, 0); !errors.Is(err, ErrDirLocked) {
+		t.Fatalf("expected [%v], but got [%v]", ErrDirLocked, err)
+	}
+	if err := d.Load(dir); !errors.Is(err, ErrDirLocked) {
+		t.Fatalf("expected [%v], but got [%v]", ErrDirLocked, err)
+	}
+	if err := lock.unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Save(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKvndbSync(t *testing.T) {
+	dir := t.TempDir()
+	d := New(WithSync())
+	if err := d.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Save(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySnapshotChecksum(1, dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testLogger struct {
+	lines []string
+}
+
+func (l *testLogger) logf(level, format string, args ...interface{}) {
+	l.lines = append(l.lines, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Debugf(format string, args ...interface{}) { l.logf("DEBUG", format, args...) }
+func (l *testLogger) Infof(format string, args ...interface{})  { l.logf("INFO", format, args...) }
+func (l *testLogger) Warnf(format string, args ...interface{})  { l.logf("WARN", format, args...) }
+func (l *testLogger) Errorf(format string, args ...interface{}) { l.logf("ERROR", format, args...) }
+
+func TestKvndbLogger(t *testing.T) {
+	dir := t.TempDir()
+	logger := &testLogger{}
+	d := New(WithLogger(logger))
+
+	if err := d.Load(dir); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("expected [%v], but got [%v]", ErrSnapshotNotFound, err)
+	}
+	if err := d.Save(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Save(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"WARN kvndb: no snapshots to load in " + dir,
+		"DEBUG kvndb: saving snapshot 1 to " + dir,
+		"INFO kvndb: saved snapshot 1 with 0 entries to " + dir + " in ",
+		"DEBUG kvndb: saving snapshot 2 to " + dir,
+		"DEBUG kvndb: removing snapshot 1 from " + dir,
+		"INFO kvndb: saved snapshot 2 with 0 entries to " + dir + " in ",
+	}
+	if len(logger.lines) != len(expected) {
+		t.Fatalf("unexpected log lines:\n%s", strings.Join(logger.lines, "\n"))
+	}
+	for i, line := range logger.lines {
+		if !strings.HasPrefix(line, expected[i]) {
+			t.Fatalf("unexpected log lines:\n%s", strings.Join(logger.lines, "\n"))
+		}
+	}
+}
+
+func TestKvndbReport(t *testing.T) {
+	dir := t.TempDir()
+	d := New()
+	if d.LastSave() != nil || d.LastLoad() != nil {
+		t.Fatal("expected no reports before first Save and Load")
+	}
+
+	for _, k := range []string{"a", "b", "c"} {
+		if err := d.Put([]byte(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Save(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []*Report{d.LastSave(), d.LastLoad()} {
+		if r == nil {
+			t.Fatal("expected report")
+		}
+		fi, err := os.Stat(getSnapshotFilepath(dir, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checksum, err := readSnapshotChecksum(1, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Id != 1 || r.Entries != 3 || r.Bytes != fi.Size() || !bytes.Equal(r.Checksum, checksum) {
+			t.Fatalf("unexpected report %+v", r)
+		}
+	}
+}
+
+func TestKvndbSnapshotError(t *testing.T) {
+	dir := t.TempDir()
+	d := New()
+	if err := d.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Save(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(getChecksumFilepath(dir, 1), []byte("bad"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := d.Load(dir)
+	if !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("expected [%v], but got [%v]", ErrBadSnapshot, err)
+	}
+	var se *SnapshotError
+	if !errors.As(err, &se) {
+		t.Fatalf("expected SnapshotError, but got [%T]", err)
+	}
+	if se.Op != "load" || se.Dir != dir || se.Id != 1 {
+		t.Fatalf("unexpected error details [%s]", se)
+	}
+}
+
+func TestRecordReaderTruncated(t *testing.T) {
+	data := append(packBytes([]byte("a"), []byte("1")), packBytes([]byte("b"), []byte("2"))...)
+
+	// every cut inside of the second record must be reported
+	for cut := 15; cut < len(data); cut++ {
+		rr := newRecordReader(bytes.NewReader(data[:cut]))
+		if _, _, err := rr.next(); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := rr.next(); err != io.ErrUnexpectedEOF {
+			t.Fatalf("cut at [%d]: expected [%v], but got [%v]", cut, io.ErrUnexpectedEOF, err)
+		}
+	}
+
+	rr := newRecordReader(bytes.NewReader(data))
+	for _, k := range []string{"a", "b"} {
+		key, err := rr.skip()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(key) != k {
+			t.Fatalf("expected key [%s], but got [%s]", k, key)
+		}
+	}
+	if _, _, err := rr.next(); err != io.EOF {
+		t.Fatalf("expected [%v], but got [%v]", io.EOF, err)
+	}
+}
+
+func TestRecordReaderCompact(t *testing.T) {
+	value := bytes.Repeat([]byte("v"), 300)
+	first := packCompactRecord([]byte("a"), []byte("1"), nil)
+	data := append(first, packCompactRecord([]byte("b"), value, nil)...)
+	if len(first) != 4 {
+		t.Fatalf("expected record of 4 bytes, but got [%d]", len(first))
+	}
+
+	var buf bytes.Buffer
+	if err := writeCompactRecord(&buf, []byte("b"), value, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data[len(first):]) {
+		t.Fatal("expected written record to match packed one")
+	}
+
+	// every cut inside of the second record must be reported
+	for cut := len(first) + 1; cut < len(data); cut++ {
+		rr := newRecordReader(bytes.NewReader(data[:cut]))
+		rr.compact = true
+		if _, _, err := rr.next(); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := rr.next(); err != io.ErrUnexpectedEOF {
+			t.Fatalf("cut at [%d]: expected [%v], but got [%v]", cut, io.ErrUnexpectedEOF, err)
+		}
+	}
+
+	rr := newRecordReader(bytes.NewReader(data))
+	rr.compact = true
+	if key, err := rr.skip(); err != nil || string(key) != "a" {
+		t.Fatalf("expected key [a], but got [%s, %v]", key, err)
+	}
+	key, v, err := rr.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != "b" || !bytes.Equal(v, value) {
+		t.Fatalf("unexpected record [%s]", key)
+	}
+	if _, _, err := rr.next(); err != io.EOF {
+		t.Fatalf("expected [%v], but got [%v]", io.EOF, err)
+	}
+}
+
+func TestRecordReaderHugeLength(t *testing.T) {
+	// only header of the record, value itself would not fit in memory
+	data := []byte{1, 'a'}
+	data = append(data, 0x80, 0x80, 0x80, 0x80, 0x14)
+
+	rr := newRecordReader(bytes.NewReader(data))
+	rr.compact = true
+	key, vLen, err := rr.nextKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != "a" || vLen != 5<<30 {
+		t.Fatalf("expected value length [%d], but got [%d]", uint64(5<<30), vLen)
+	}
+}
+
+func TestReadSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	d := New()
+	testData := map[string][]byte{"a": []byte("1"), "b": []byte("2"), "c": []byte("3")}
+	for k, v := range testData {
+		if err := d.Put([]byte(k), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Save(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := ReadSnapshot(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for it.Next() {
+		if !bytes.Equal(testData[string(it.Key())], it.Value()) {
+			t.Fatalf("unexpected value [%s] for key [%s]", it.Value(), it.Key())
+		}
+		count++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if count != len(testData) {
+		t.Fatalf("expected [%d] records, but got [%d]", len(testData), count)
+	}
+
+	// checksum mismatch is reported after the last record
+	if err := os.WriteFile(getChecksumFilepath(dir, 1), []byte("bad"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	it, err = ReadSnapshot(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	for it.Next() {
+	}
+	if !errors.Is(it.Err(), ErrBadSnapshot) {
+		t.Fatalf("expected [%v], but got [%v]", ErrBadSnapshot, it.Err())
+	}
+}
+
+func TestKvndbWaitTimeout(t *testing.T) {
+	d := New()
+	if err := d.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// unread iteration keeps datastore locked
+	ch, err := d.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WaitTimeout(10 * time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected [%v], but got [%v]", context.DeadlineExceeded, err)
+	}
+	for range ch {
+	}
+	if err := d.WaitContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKvndbTry(t *testing.T) {
+	d := New()
+	if err := d.TryPut([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// unread iteration keeps datastore locked
+	ch, err := d.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.TryPut([]byte("a"), []byte("2")); !errors.Is(err, ErrBusy) {
+		t.Fatalf("expected [%v], but got [%v]", ErrBusy, err)
+	}
+	if _, err := d.TryGet([]byte("a")); !errors.Is(err, ErrBusy) {
+		t.Fatalf("expected [%v], but got [%v]", ErrBusy, err)
+	}
+	for range ch {
+	}
+
+	v, err := d.TryGet([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "1" {
+		t.Fatalf("expected value [1], but got [%s]", v)
+	}
+}
+
+func TestKvndbDoWithKey(t *testing.T) {
+	for name, d := range map[string]DB{"global": New(), "striped": New(WithKeyLocks(4))} {
+		incr := func(current []byte) ([]byte, error) {
+			n := 0
+			if current != nil {
+				n, _ = strconv.Atoi(string(current))
+			}
+			return []byte(strconv.Itoa(n + 1)), nil
+		}
+
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					if err := d.DoWithKey([]byte{byte(i % 2)}, incr); err != nil {
+						t.Error(err)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		for _, k := range []byte{0, 1} {
+			v, err := d.Get([]byte{k})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(v) != "400" {
+				t.Fatalf("%s: expected counter [400], but got [%s]", name, v)
+			}
+		}
+
+		// returning nil deletes entry, returning error changes nothing
+		errAbort := errors.New("abort")
+		if err := d.DoWithKey([]byte{0}, func([]byte) ([]byte, error) { return nil, errAbort }); err != errAbort {
+			t.Fatalf("%s: expected [%v], but got [%v]", name, errAbort, err)
+		}
+		if err := d.DoWithKey([]byte{0}, func([]byte) ([]byte, error) { return nil, nil }); err != nil {
+			t.Fatal(err)
+		}
+		if d.Size() != 1 {
+			t.Fatalf("%s: expected size [1], but got [%d]", name, d.Size())
+		}
+	}
+}
+
+func TestEngines(t *testing.T) {
+	vlogDir := t.TempDir()
+	engines := map[string]func() engine{
+		"map":     func() engine { return newMapEngine() },
+		"arena":   func() engine { return newArenaEngine(64) },
+		"hybrid":  func() engine { return newHybridEngine(newMapEngine(), vlogDir, 4, nopLogger{}) },
+		"ordered": func() engine { return newOrderedEngine(newArenaEngine(64)) },
+		"sealed": func() engine {
+			aead, _ := newValueCipher(make([]byte, 32))
+			return newSealedEngine(newMapEngine(), aead)
+		},
+	}
+
+	for name, newEngine := range engines {
+		e := newEngine()
+		for i := 0; i < 100; i++ {
+			if err := e.put(strconv.Itoa(i), []byte(strings.Repeat("v", i%10))); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		e.delete("0")
+		if err := e.put("1", []byte("updated")); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if size := e.memSize(); size <= 0 {
+			t.Fatalf("%s: expected positive memory size, but got [%d]", name, size)
+		}
+		if e.len() != 99 {
+			t.Fatalf("%s: expected len [99], but got [%d]", name, e.len())
+		}
+		if _, err := e.get("0"); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("%s: expected [%v], but got [%v]", name, ErrKeyNotFound, err)
+		}
+		if v, err := e.get("1"); err != nil || string(v) != "updated" {
+			t.Fatalf("%s: expected [updated], but got [%s] [%v]", name, v, err)
+		}
+
+		n := 0
+		err := e.forEach(func(key string, value []byte) error {
+			n++
+			if key != "1" && len(value) != len(strings.Repeat("v", mustAtoi(key)%10)) {
+				return fmt.Errorf("unexpected value [%s] for key [%s]", value, key)
+			}
+			return nil
+		})
+		if err != nil || n != 99 {
+			t.Fatalf("%s: expected 99 entries, but got [%d] [%v]", name, n, err)
+		}
+
+		if err = e.reset(); err != nil || e.len() != 0 || e.memSize() != 0 {
+			t.Fatalf("%s: expected empty engine after reset, but got [%d] [%v]", name, e.len(), err)
+		}
+		if err = e.close(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestKvndbValueEncryption(t *testing.T) {
+	d := newDb(WithValueEncryption(bytes.Repeat([]byte{1}, 32)))
+	secret := []byte("correct horse battery staple")
+	if err := d.Put([]byte("secret"), secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put([]byte("empty"), []byte{}); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := d.data.(*sealedEngine).engine.get("secret")
+	if bytes.Contains(raw, secret) {
+		t.Fatal("value is stored in plain text")
+	}
+
+	v, err := d.Get([]byte("secret"))
+	if err != nil || !bytes.Equal(v, secret) {
+		t.Fatalf("expected [%s], but got [%s] [%v]", secret, v, err)
+	}
+	v, err = d.Get([]byte("empty"))
+	if err != nil || v == nil || len(v) != 0 {
+		t.Fatalf("expected empty value, but got [%v] [%v]", v, err)
+	}
+
+	dir := t.TempDir()
+	if err = d.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	loaded := New()
+	if err = loaded.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	v, err = loaded.Get([]byte("secret"))
+	if err != nil || !bytes.Equal(v, secret) {
+		t.Fatalf("expected [%s], but got [%s] [%v]", secret, v, err)
+	}
+}
+
+func TestKvndbEntryMeta(t *testing.T) {
+	d := New(WithEntryMeta(), WithSnapshotIndex())
+	if err := d.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := d.Put([]byte("a"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put([]byte("b"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := d.GetMeta([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Updated.After(meta.Created) {
+		t.Fatalf("expected update after creation, but got created [%v] updated [%v]", meta.Created, meta.Updated)
+	}
+	if meta.Revision != 2 {
+		t.Fatalf("expected revision [2], but got [%d]", meta.Revision)
+	}
+	if _, err = d.GetMeta([]byte("c")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected [%v], but got [%v]", ErrKeyNotFound, err)
+	}
+
+	dir := t.TempDir()
+	if err = d.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, load := range []func(DB) error{
+		func(l DB) error { return l.Load(dir) },
+		func(l DB) error { return l.LoadPrefix(dir, []byte("a")) },
+	} {
+		loaded := New(WithEntryMeta())
+		if err = load(loaded); err != nil {
+			t.Fatal(err)
+		}
+		loadedMeta, err := loaded.GetMeta([]byte("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !loadedMeta.Created.Equal(meta.Created) || !loadedMeta.Updated.Equal(meta.Updated) || loadedMeta.Revision != meta.Revision {
+			t.Fatalf("expected [%v], but got [%v]", meta, loadedMeta)
+		}
+		if v, err := loaded.Get([]byte("a")); err != nil || string(v) != "2" {
+			t.Fatalf("expected [2], but got [%s] [%v]", v, err)
+		}
+	}
+
+	// revisions of recreated entries continue from datastore revision
+	if err = d.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Put([]byte("a"), []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	if recreated, err := d.GetMeta([]byte("a")); err != nil || recreated.Revision != d.Revision() || recreated.Revision <= meta.Revision {
+		t.Fatalf("expected revision [%d], but got [%d] [%v]", d.Revision(), recreated.Revision, err)
+	}
+
+	// datastores without metadata read such snapshots too
+	plain := New()
+	if err = plain.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = plain.GetMeta([]byte("a")); !errors.Is(err, ErrNoMeta) {
+		t.Fatalf("expected [%v], but got [%v]", ErrNoMeta, err)
+	}
+	lazy, err := OpenLazy(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := lazy.Get([]byte("b")); err != nil || string(v) != "3" {
+		t.Fatalf("expected [3], but got [%s] [%v]", v, err)
+	}
+	it, err := ReadSnapshot(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for it.Next() {
+		n++
+	}
+	if it.Err() != nil || n != 2 {
+		t.Fatalf("expected 2 records, but got [%d] [%v]", n, it.Err())
+	}
+	_ = it.Close()
+	_ = lazy.Close()
+}
+
+func TestOpenSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	d := New()
+	if err := d.Put([]byte("a"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Save(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put([]byte("a"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Save(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, expected := range map[uint]string{0: "new", 1: "old", 2: "new"} {
+		snap, err := OpenSnapshot(dir, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err := snap.Get([]byte("a")); err != nil || string(v) != expected {
+			t.Fatalf("snapshot %d: expected [%s], but got [%s] [%v]", id, expected, v, err)
+		}
+		if _, ok := snap.(DB); ok {
+			t.Fatalf("snapshot %d: expected read-only datastore not to be writable", id)
+		}
+		if err = snap.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = snap.Get([]byte("a")); err != ErrAlreadyClosed {
+			t.Fatalf("snapshot %d: expected [%v], but got [%v]", id, ErrAlreadyClosed, err)
+		}
+	}
+
+	if _, err := OpenSnapshot(dir, 3); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected [%v], but got [%v]", os.ErrNotExist, err)
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	d := New(WithSnapshotIndex())
+	for k, v := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+		if err := d.Put([]byte(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Save(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	_ = d.Delete([]byte("a"))
+	_ = d.Put([]byte("b"), []byte("changed"))
+	_ = d.Put([]byte("d"), []byte("4"))
+	if err := d.Save(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := DiffSnapshots(dir, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make([]string, 0)
+	for e := range ch {
+		result = append(result, fmt.Sprintf("%s %s %s %s", e.Kind, e.Key, e.Old, e.New))
+	}
+	expected := []string{"removed a 1 ", "changed b 2 changed", "added d  4"}
+	if strings.Join(result, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %q, but got %q", expected, result)
+	}
+}
+
+func TestKvndbLoadMerge(t *testing.T) {
+	dir := t.TempDir()
+	saved := New()
+	_ = saved.Put([]byte("a"), []byte("snapshot"))
+	_ = saved.Put([]byte("b"), []byte("snapshot"))
+	if err := saved.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	concat := func(_, current, snapshot []byte) ([]byte, error) {
+		return append(append([]byte{}, current...), snapshot...), nil
+	}
+	for name, tc := range map[string]struct {
+		policy   ConflictPolicy
+		expected string
+	}{
+		"keep":   {KeepExisting, "current"},
+		"prefer": {PreferSnapshot, "snapshot"},
+		"func":   {concat, "currentsnapshot"},
+	} {
+		d := New()
+		_ = d.Put([]byte("a"), []byte("current"))
+		_ = d.Put([]byte("c"), []byte("current"))
+		if err := d.LoadMerge(dir, tc.policy); err != nil {
+			t.Fatal(err)
+		}
+
+		if d.Size() != 3 {
+			t.Fatalf("%s: expected size [3], but got [%d]", name, d.Size())
+		}
+		for k, expected := range map[string]string{"a": tc.expected, "b": "snapshot", "c": "current"} {
+			if v, err := d.Get([]byte(k)); err != nil || string(v) != expected {
+				t.Fatalf("%s: expected [%s] for key [%s], but got [%s] [%v]", name, expected, k, v, err)
+			}
+		}
+	}
+}
+
+func TestPatch(t *testing.T) {
+	dir := t.TempDir()
+	d := New()
+	for i := 0; i < 100; i++ {
+		_ = d.Put([]byte(strconv.Itoa(i)), []byte("old"))
+	}
+	if err := d.Save(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		_ = d.Delete([]byte(strconv.Itoa(i)))
+		_ = d.Put([]byte(strconv.Itoa(i+10)), []byte("new"))
+		_ = d.Put([]byte(strconv.Itoa(i+100)), []byte("new"))
+	}
+	if err := d.Save(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	patch := &bytes.Buffer{}
+	if err := WritePatch(patch, dir, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	replica := New()
+	for i := 0; i < 100; i++ {
+		_ = replica.Put([]byte(strconv.Itoa(i)), []byte("old"))
+	}
+
+	// truncated patch changes nothing
+	truncated := bytes.NewReader(patch.Bytes()[:patch.Len()-1])
+	if err := replica.ApplyPatch(truncated); err == nil {
+		t.Fatal("expected error applying truncated patch")
+	}
+	if replica.Size() != 100 {
+		t.Fatalf("expected size [100], but got [%d]", replica.Size())
+	}
+
+	if err := replica.ApplyPatch(patch); err != nil {
+		t.Fatal(err)
+	}
+	if replica.Size() != d.Size() {
+		t.Fatalf("expected size [%d], but got [%d]", d.Size(), replica.Size())
+	}
+	ch, _ := d.KeysAndValues()
+	for tuple := range ch {
+		if v, err := replica.Get(tuple.Key); err != nil || !bytes.Equal(v, tuple.Value) {
+			t.Fatalf("expected [%s] for key [%s], but got [%s] [%v]", tuple.Value, tuple.Key, v, err)
+		}
+	}
+}
+
+func TestVerifySnapshot(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		dir := t.TempDir()
+		opts := []Option{}
+		if chunked {
+			opts = append(opts, WithChunkChecksums(1024))
+		}
+		d := New(opts...)
+		value := make([]byte, 64)
+		for i := 0; i < 1000; i++ {
+			rand.Read(value)
+			_ = d.Put([]byte(strconv.Itoa(i)), value)
+		}
+		if err := d.Save(dir, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		regions, err := VerifySnapshot(dir, 0)
+		if err != nil || len(regions) != 0 {
+			t.Fatalf("expected intact snapshot, but got %v [%v]", regions, err)
+		}
+
+		fd, err := os.OpenFile(getSnapshotFilepath(dir, 1), os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = fd.WriteAt([]byte("corrupted"), 5000); err != nil {
+			t.Fatal(err)
+		}
+		fi, _ := fd.Stat()
+		_ = fd.Close()
+
+		expected := CorruptRegion{Offset: 0, Size: fi.Size()}
+		if chunked {
+			expected = CorruptRegion{Offset: 4096, Size: 1024}
+		}
+		regions, err = VerifySnapshot(dir, 0)
+		if err != nil || len(regions) != 1 || regions[0] != expected {
+			t.Fatalf("expected [%v], but got %v [%v]", expected, regions, err)
+		}
+	}
+}
+
+// interruptingContext is done after Err was called given number of
+// times.
+type interruptingContext struct {
+	context.Context
+	calls int
+}
+
+func (c *interruptingContext) Err() error {
+	c.calls--
+	if c.calls < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestKvndbLoadContextResume(t *testing.T) {
+	dir := t.TempDir()
+	saved := New(WithChunkChecksums(64 << 10))
+	value := make([]byte, 1024)
+	for i := 0; i < 1000; i++ {
+		rand.Read(value)
+		_ = saved.Put([]byte(strconv.Itoa(i)), value)
+	}
+	if err := saved.Save(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := &testLogger{}
+	d := New(WithLogger(logger))
+	for _, calls := range []int{300, 300} {
+		ctx := &interruptingContext{Context: context.Background(), calls: calls}
+		if err := d.LoadContext(ctx, dir); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected [%v], but got [%v]", context.Canceled, err)
+		}
+	}
+	if d.Size() != 600 {
+		t.Fatalf("expected [600] entries loaded so far, but got [%d]", d.Size())
+	}
+	if err := d.LoadContext(context.Background(), dir); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed := 0
+	for _, line := range logger.lines {
+		if strings.HasPrefix(line, "INFO kvndb: resuming load") {
+			resumed++
+		}
+	}
+	if resumed != 2 {
+		t.Fatalf("expected load to be resumed twice, but got %q", logger.lines)
+	}
+	if d.Size() != 1000 || d.LastLoad() == nil {
+		t.Fatalf("expected complete load, but got [%d] entries", d.Size())
+	}
+	ch, _ := saved.KeysAndValues()
+	for tuple := range ch {
+		if v, err := d.Get(tuple.Key); err != nil || !bytes.Equal(v, tuple.Value) {
+			t.Fatalf("value mismatch for key [%s] [%v]", tuple.Key, err)
+		}
+	}
+
+	// modified data is not resumed
+	ctx := &interruptingContext{Context: context.Background(), calls: 300}
+	_ = d.LoadContext(ctx, dir)
+	_ = d.Put([]byte("extra"), []byte("value"))
+	if err := d.LoadContext(context.Background(), dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get([]byte("extra")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected [%v], but got [%v]", ErrKeyNotFound, err)
+	}
+}
+
+func TestKvndbFinalSave(t *testing.T) {
+	dir := t.TempDir()
+	d := New(WithFinalSave(dir, 0))
+	_ = d.Put([]byte("a"), []byte("1"))
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := New()
+	if err := loaded.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := loaded.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("expected [1], but got [%s] [%v]", v, err)
+	}
+
+	// failed final save keeps datastore open
+	d = New(WithFinalSave(dir+"/missing", 0))
+	_ = d.Put([]byte("a"), []byte("1"))
+	if err := d.Close(); err == nil {
+		t.Fatal("expected final save to fail")
+	}
+	if v, err := d.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("expected [1], but got [%s] [%v]", v, err)
+	}
+}
+
+func TestKvndbReset(t *testing.T) {
+	d := New(WithEntryMeta())
+	_ = d.Put([]byte("a"), []byte("1"))
+	if err := d.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if d.Size() != 0 {
+		t.Fatalf("expected size [0], but got [%d]", d.Size())
+	}
+
+	_ = d.Put([]byte("a"), []byte("1"))
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put([]byte("a"), []byte("1")); !errors.Is(err, ErrAlreadyClosed) {
+		t.Fatalf("expected [%v], but got [%v]", ErrAlreadyClosed, err)
+	}
+	if err := d.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetMeta([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if d.Size() != 1 {
+		t.Fatalf("expected size [1], but got [%d]", d.Size())
+	}
+}
+
+func TestKvndbExpvar(t *testing.T) {
+	d := New(WithExpvar("kvndb-test"))
+	_ = d.Put([]byte("a"), []byte("1"))
+	_ = d.Put([]byte("b"), []byte("2"))
+	_, _ = d.Get([]byte("a"))
+	_ = d.Delete([]byte("b"))
+	if err := d.Save(t.TempDir(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	published := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(expvar.Get("kvndb-test").String()), &published); err != nil {
+		t.Fatal(err)
+	}
+	for k, expected := range map[string]float64{"size": 1, "gets": 1, "puts": 2, "deletes": 1, "lastSaveId": 1} {
+		if published[k] != expected {
+			t.Fatalf("expected [%v] for [%s], but got [%v]", expected, k, published[k])
+		}
+	}
+}
+
+func TestKvndbHealth(t *testing.T) {
+	dir := t.TempDir()
+	d := New()
+
+	h := d.Health()
+	if !h.Open || h.SinceLastSave != 0 || h.LastSaveErr != nil || h.LastLoadErr != nil {
+		t.Fatalf("unexpected health of new datastore %+v", h)
+	}
+
+	if err := d.Save(dir+"/missing", 0); err == nil {
+		t.Fatal("expected save to fail")
+	}
+	if err := d.Load(dir); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("expected [%v], but got [%v]", ErrSnapshotNotFound, err)
+	}
+	h = d.Health()
+	if h.LastSaveErr == nil || h.LastLoadErr != nil {
+		t.Fatalf("unexpected health after failed save %+v", h)
+	}
+
+	if err := d.Save(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	_ = d.Close()
+	h = d.Health()
+	if h.Open || h.SinceLastSave <= 0 || h.LastSaveErr != nil {
+		t.Fatalf("unexpected health after save and close %+v", h)
+	}
+}
+
+func TestKvndbSizeBytes(t *testing.T) {
+	for name, d := range map[string]DB{"map": New(), "arena": New(WithArena(1024))} {
+		_ = d.Put([]byte("key"), make([]byte, 100))
+		expected := uint64(3 + 100 + mapEntryOverhead)
+		if d.SizeBytes() != expected {
+			t.Fatalf("%s: expected [%d], but got [%d]", name, expected, d.SizeBytes())
+		}
+		_ = d.Delete([]byte("key"))
+		if name == "map" && d.SizeBytes() != 0 {
+			t.Fatalf("%s: expected [0], but got [%d]", name, d.SizeBytes())
+		}
+	}
+}
+
+func TestKvndbSizeHistogram(t *testing.T) {
+	d := New()
+	for i, size := range []int{0, 63, 64, 1023, 1024, 5000} {
+		_ = d.Put([]byte(strconv.Itoa(i)), make([]byte, size))
+	}
+
+	h := d.SizeHistogram([]int{1024, 64})
+	expected := map[string]uint64{"0-63": 2, "64-1023": 2, "1024+": 2}
+	if fmt.Sprint(h) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, but got %v", expected, h)
+	}
+
+	// non-positive and duplicate bounds are ignored
+	h = d.SizeHistogram([]int{64, 1024, 0, 64, -1})
+	if fmt.Sprint(h) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, but got %v", expected, h)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users:1", false},
+		{"user:?", "user:12", false},
+		{"user:??", "user:12", true},
+		{"*:name", "user:1:name", true},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxbc", false},
+		{"?", "ж", true},
+		{"?", "\xff", true},
+		{"\\*", "*", true},
+		{"\\*", "a", false},
+	} {
+		if globMatch(tc.pattern, tc.key) != tc.match {
+			t.Fatalf("expected match of [%s] against [%s] to be [%v]", tc.pattern, tc.key, tc.match)
+		}
+	}
+}
+
+func TestKvndbKeysMatching(t *testing.T) {
+	for name, d := range map[string]DB{"unordered": New(), "ordered": New(WithOrderedIndex())} {
+		for _, k := range []string{"user:1", "user:2:name", "user:3", "users", "group:1"} {
+			_ = d.Put([]byte(k), []byte("v"))
+		}
+
+		ch, err := d.KeysMatching("user:?")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := make([]string, 0)
+		for k := range ch {
+			keys = append(keys, string(k))
+		}
+		sort.Strings(keys)
+		if strings.Join(keys, ",") != "user:1,user:3" {
+			t.Fatalf("%s: expected [user:1,user:3], but got %v", name, keys)
+		}
+	}
+}
+
+func TestKvndbKeysRegexp(t *testing.T) {
+	for name, d := range map[string]DB{"unordered": New(), "ordered": New(WithOrderedIndex())} {
+		for _, k := range []string{"user:1", "user:22", "user:x", "group:user:3"} {
+			_ = d.Put([]byte(k), []byte("v"))
+		}
+
+		for expr, expected := range map[string]string{
+			`^user:\d+$`: "user:1,user:22",
+			`user:\d`:    "group:user:3,user:1,user:22",
+		} {
+			ch, err := d.KeysRegexp(regexp.MustCompile(expr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys := make([]string, 0)
+			for k := range ch {
+				keys = append(keys, string(k))
+			}
+			sort.Strings(keys)
+			if strings.Join(keys, ",") != expected {
+				t.Fatalf("%s: expected [%s] for [%s], but got %v", name, expected, expr, keys)
+			}
+		}
+	}
+}
+
+func TestKvndbFindValues(t *testing.T) {
+	d := New()
+	for i := 0; i < 100; i++ {
+		_ = d.Put([]byte(strconv.Itoa(i)), []byte(fmt.Sprintf("value-%d", i%10)))
+	}
+	needle := func(value []byte) bool {
+		return bytes.Contains(value, []byte("-7"))
+	}
+
+	found, err := d.FindValues(needle, 0)
+	if err != nil || len(found) != 10 {
+		t.Fatalf("expected 10 entries, but got [%d] [%v]", len(found), err)
+	}
+	for _, tuple := range found {
+		if mustAtoi(string(tuple.Key))%10 != 7 {
+			t.Fatalf("unexpected entry [%s] [%s]", tuple.Key, tuple.Value)
+		}
+	}
+
+	found, err = d.FindValues(needle, 3)
+	if err != nil || len(found) != 3 {
+		t.Fatalf("expected 3 entries, but got [%d] [%v]", len(found), err)
+	}
+}
+
+func TestKvndbClone(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"map":     nil,
+		"arena":   {WithArena(64)},
+		"ordered": {WithOrderedIndex(), WithEntryMeta()},
+	} {
+		d := New(opts...)
+		for i := 0; i < 10; i++ {
+			_ = d.Put([]byte(strconv.Itoa(i)), []byte("original"))
+		}
+
+		c, err := d.Clone()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Revision() != d.Revision() || !c.ModifiedSince(0) {
+			t.Fatalf("%s: expected revision [%d], but got [%d]", name, d.Revision(), c.Revision())
+		}
+		for i := 0; i < 10; i++ {
+			_ = d.Put([]byte(strconv.Itoa(i+10)), []byte("original"))
+			_ = c.Put([]byte(strconv.Itoa(i)), []byte("clone"))
+		}
+		_ = d.Delete([]byte("0"))
+
+		if d.Size() != 19 || c.Size() != 10 {
+			t.Fatalf("%s: expected sizes [19] and [10], but got [%d] and [%d]", name, d.Size(), c.Size())
+		}
+		for i := 1; i < 20; i++ {
+			if v, err := d.Get([]byte(strconv.Itoa(i))); err != nil || string(v) != "original" {
+				t.Fatalf("%s: expected [original], but got [%s] [%v]", name, v, err)
+			}
+		}
+		for i := 0; i < 10; i++ {
+			if v, err := c.Get([]byte(strconv.Itoa(i))); err != nil || string(v) != "clone" {
+				t.Fatalf("%s: expected [clone], but got [%s] [%v]", name, v, err)
+			}
+		}
+	}
+}
+
+func TestKvndbSweeper(t *testing.T) {
+	d := New(WithSweeper(time.Millisecond, 10))
+	defer d.Close()
+
+	for i := 0; i < 100; i++ {
+		_ = d.PutTTL([]byte(strconv.Itoa(i)), []byte("v"), time.Millisecond)
+	}
+	_ = d.PutTTL([]byte("long"), []byte("v"), time.Hour)
+	_ = d.PutTTL([]byte("cleared"), []byte("v"), time.Millisecond)
+	_ = d.Put([]byte("cleared"), []byte("v"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for d.Size() != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if d.Size() != 2 {
+		t.Fatalf("expected expired entries to be removed, but got size [%d]", d.Size())
+	}
+	if s := d.Stats(); s.ExpiredBySweeper+s.ExpiredOnAccess != 100 {
+		t.Fatalf("expected 100 expired entries, but got %+v", s)
+	}
+	for _, k := range []string{"long", "cleared"} {
+		if _, err := d.Get([]byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestKvndbLazyExpiration(t *testing.T) {
+	d := New()
+	defer d.Close()
+
+	_ = d.PutTTL([]byte("a"), []byte("v"), time.Millisecond)
+	_ = d.PutTTL([]byte("b"), []byte("v"), time.Millisecond)
+	_ = d.PutTTL([]byte("long"), []byte("v"), time.Hour)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, err := d.Get([]byte("a")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, but got [%v]", err)
+	}
+	if ok, err := d.Has([]byte("b")); err != nil || ok {
+		t.Fatalf("expected expired entry to be absent, but got [%v, %v]", ok, err)
+	}
+	if ok, err := d.Has([]byte("long")); err != nil || !ok {
+		t.Fatalf("expected entry to exist, but got [%v, %v]", ok, err)
+	}
+
+	_ = d.PutTTL([]byte("c"), []byte("v"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	keys, err := d.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make([]string, 0)
+	for k := range keys {
+		result = append(result, string(k))
+	}
+	if len(result) != 1 || result[0] != "long" {
+		t.Fatalf("expected only [long], but got %v", result)
+	}
+	if d.Size() != 1 {
+		t.Fatalf("expected expired entries to be removed, but got size [%d]", d.Size())
+	}
+	if s := d.Stats(); s.ExpiredOnAccess != 3 || s.ExpiredBySweeper != 0 {
+		t.Fatalf("expected 3 entries expired on access, but got %+v", s)
+	}
+}
+
+func TestKvndbEvents(t *testing.T) {
+	d := New(WithEvents(10, DropNewest))
+	ch := d.Events()
+
+	_ = d.Put([]byte("a"), []byte("1"))
+	_ = d.Delete([]byte("a"))
+	_ = d.PutTTL([]byte("b"), []byte("2"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	_, _ = d.Get([]byte("b"))
+	_ = d.Close()
+
+	result := make([]string, 0)
+	for ev := range ch {
+		result = append(result, ev.Kind.String()+" "+string(ev.Key)+" "+string(ev.Value))
+	}
+	expected := []string{"put a 1", "delete a ", "put b 2", "expire b "}
+	if strings.Join(result, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v, but got %v", expected, result)
+	}
+}
+
+func TestKvndbEventsDropOldest(t *testing.T) {
+	d := New(WithEvents(2, DropOldest))
+	defer d.Close()
+
+	for i := 0; i < 5; i++ {
+		_ = d.Put([]byte(strconv.Itoa(i)), []byte("v"))
+	}
+
+	ch := d.Events()
+	for _, expected := range []string{"3", "4"} {
+		if ev := <-ch; string(ev.Key) != expected {
+			t.Fatalf("expected key [%s], but got [%s]", expected, ev.Key)
+		}
+	}
+}
+
+func TestKvndbWaitFor(t *testing.T) {
+	d := New()
+	defer d.Close()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = d.Put([]byte("other"), []byte("x"))
+		_ = d.Put([]byte("a"), []byte("1"))
+	}()
+
+	value, err := d.WaitFor(context.Background(), []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "1" {
+		t.Fatalf("expected [1], but got [%s]", value)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = d.WaitFor(ctx, []byte("missing"))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, but got [%v]", err)
+	}
+}
+
+func TestKvndbSubscribe(t *testing.T) {
+	d := New()
+	defer d.Close()
+
+	users, err := d.Subscribe([]byte("user/"), 10, DropNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := d.Subscribe(nil, 10, DropNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = d.Put([]byte("user/1"), []byte("a"))
+	_ = d.Put([]byte("group/1"), []byte("b"))
+	users.Cancel()
+	users.Cancel()
+	_ = d.Delete([]byte("user/1"))
+
+	keys := make([]string, 0)
+	for ev := range users.C {
+		keys = append(keys, string(ev.Key))
+	}
+	if strings.Join(keys, ",") != "user/1" {
+		t.Fatalf("expected [user/1], but got %v", keys)
+	}
+
+	if len(all.C) != 3 {
+		t.Fatalf("expected 3 events, but got [%d]", len(all.C))
+	}
+}
+
+func TestKvndbAfterSave(t *testing.T) {
+	dir := t.TempDir()
+
+	d := New()
+	defer d.Close()
+	_ = d.Put([]byte("a"), []byte("1"))
+
+	var info SnapshotInfo
+	d.AfterSave(func(i SnapshotInfo) error {
+		info = i
+		return nil
+	})
+	if err := d.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	if info.Id != 1 || info.Entries != 1 || len(info.Checksum) == 0 {
+		t.Fatalf("unexpected snapshot info %+v", info)
+	}
+	if _, err := os.Stat(info.Path); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := errors.New("upload failed")
+	d.AfterSave(func(SnapshotInfo) error {
+		return failed
+	})
+	if err := d.Save(dir, 1); !errors.Is(err, failed) {
+		t.Fatalf("expected hook error, but got [%v]", err)
+	}
+	if d.LastSave().Id != 2 {
+		t.Fatalf("expected snapshot 2 to be saved, but got [%d]", d.LastSave().Id)
+	}
+}
+
+func TestKvndbBeforeSave(t *testing.T) {
+	dir := t.TempDir()
+
+	d := New()
+	defer d.Close()
+	for i := 0; i < 10; i++ {
+		_ = d.Put([]byte(strconv.Itoa(i)), []byte("v"))
+	}
+
+	shrunk := errors.New("dataset shrunk")
+	d.BeforeSave(func(s Stats) error {
+		if s.LastSave != nil && s.Entries < int(s.LastSave.Entries)/2 {
+			return shrunk
+		}
+		return nil
+	})
+	if err := d.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 8; i++ {
+		_ = d.Delete([]byte(strconv.Itoa(i)))
+	}
+	if err := d.Save(dir, 1); !errors.Is(err, shrunk) {
+		t.Fatalf("expected save to be refused, but got [%v]", err)
+	}
+	if d.LastSave().Id != 1 {
+		t.Fatalf("expected snapshot 1 to stay the last, but got [%d]", d.LastSave().Id)
+	}
+}
+
+func TestKvndbCodec(t *testing.T) {
+	dir := t.TempDir()
+
+	d := New(WithCodec("ndjson"), WithSnapshotIndex())
+	defer d.Close()
+	for i := 0; i < 100; i++ {
+		_ = d.Put([]byte(strconv.Itoa(i)), []byte("value "+strconv.Itoa(i)))
+	}
+	_ = d.Put([]byte("empty"), []byte{})
+	if err := d.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// codec is taken from snapshot header, not from options
+	l := New()
+	defer l.Close()
+	if err := l.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if l.Size() != 101 {
+		t.Fatalf("expected 101 entries, but got [%d]", l.Size())
+	}
+	for _, k := range []string{"0", "42", "99", "empty"} {
+		expected, _ := d.Get([]byte(k))
+		value, err := l.Get([]byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, expected) {
+			t.Fatalf("expected [%s], but got [%s]", expected, value)
+		}
+	}
+
+	if _, err := OpenLazy(dir); !errors.Is(err, ErrUnsupportedCodec) {
+		t.Fatalf("expected ErrUnsupportedCodec, but got [%v]", err)
+	}
+}
+
+func TestKvndbCopyTo(t *testing.T) {
+	src := New()
+	defer src.Close()
+	dst := New()
+	defer dst.Close()
+
+	_ = src.Put([]byte("a"), []byte("1"))
+	_ = src.Put([]byte("b"), []byte("2"))
+	_ = dst.Put([]byte("a"), []byte("old"))
+
+	if err := src.CopyTo(dst, false); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := dst.Get([]byte("a")); string(v) != "old" {
+		t.Fatalf("expected existing entry to be kept, but got [%s]", v)
+	}
+	if v, _ := dst.Get([]byte("b")); string(v) != "2" {
+		t.Fatalf("expected [2], but got [%s]", v)
+	}
+
+	if err := src.CopyTo(dst, true); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := dst.Get([]byte("a")); string(v) != "1" {
+		t.Fatalf("expected entry to be overwritten, but got [%s]", v)
+	}
+	if err := src.CopyTo(src, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKvndbStats(t *testing.T) {
+	d := New()
+	defer d.Close()
+
+	_ = d.Put([]byte("a"), []byte("1"))
+	_ = d.Put([]byte("b"), []byte("2"))
+	_ = d.Delete([]byte("b"))
+	_, _ = d.Get([]byte("a"))
+	_, _ = d.Get([]byte("a"))
+	_, _ = d.Get([]byte("b"))
+
+	s := d.Stats()
+	if s.Entries != 1 || s.Gets != 3 || s.Hits != 2 || s.Misses != 1 || s.Puts != 2 || s.Deletes != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestKvndbAccessFrequency(t *testing.T) {
+	d := newDb(WithAccessFrequency(1, time.Hour))
+	defer d.Close()
+
+	_ = d.Put([]byte("hot"), []byte("1"))
+	_ = d.Put([]byte("cold"), []byte("2"))
+	for i := 0; i < 1000; i++ {
+		_, _ = d.Get([]byte("hot"))
+	}
+
+	hot, _ := d.access.get("hot")
+	cold, _ := d.access.get("cold")
+	if hot <= cold || cold != accessInitial {
+		t.Fatalf("expected hot key to have higher counter, but got [%d, %d]", hot, cold)
+	}
+
+	_ = d.Delete([]byte("hot"))
+	if _, ok := d.access.get("hot"); ok {
+		t.Fatal("expected counter of deleted entry to be removed")
+	}
+
+	d.access.decay = time.Millisecond
+	d.access.counters["cold"] = accessCounter{
+		count: accessInitial,
+		last:  d.access.period(),
+	}
+	time.Sleep(10 * time.Millisecond)
+	if cold, _ := d.access.get("cold"); cold >= accessInitial {
+		t.Fatalf("expected counter to decay, but got [%d]", cold)
+	}
+}
+
+func TestKvndbTopKeysByAccess(t *testing.T) {
+	d := newDb(WithAccessFrequency(1, time.Hour))
+	defer d.Close()
+
+	for i := 0; i < 10; i++ {
+		key := strconv.Itoa(i)
+		_ = d.Put([]byte(key), []byte("v"))
+		d.access.counters[key] = accessCounter{
+			count: uint8(10 + i%5),
+			last:  d.access.period(),
+		}
+	}
+
+	top, err := d.TopKeysByAccess(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0)
+	for _, ka := range top {
+		keys = append(keys, string(ka.Key))
+	}
+	if strings.Join(keys, ",") != "4,9,3" {
+		t.Fatalf("expected [4 9 3], but got %v", keys)
+	}
+
+	if _, err := New().TopKeysByAccess(3); err != ErrNoAccessFrequency {
+		t.Fatalf("expected ErrNoAccessFrequency, but got [%v]", err)
+	}
+}
+
+func TestKvndbTopKeysBySize(t *testing.T) {
+	d := New()
+	defer d.Close()
+
+	for i := 0; i < 100; i++ {
+		_ = d.Put([]byte(strconv.Itoa(i)), bytes.Repeat([]byte("v"), i))
+	}
+
+	top, err := d.TopKeysBySize(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 2 || string(top[0].Key) != "99" || top[0].Size != 99 || string(top[1].Key) != "98" {
+		t.Fatalf("unexpected top keys %v", top)
+	}
+}
+
+func TestKvndbJSON(t *testing.T) {
+	d := New()
+	defer d.Close()
+
+	type user struct {
+		Name string
+		Age  int
+	}
+
+	if err := PutJSON(d, []byte("u"), user{Name: "a", Age: 3}); err != nil {
+		t.Fatal(err)
+	}
+	var u user
+	if err := GetJSON(d, []byte("u"), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "a" || u.Age != 3 {
+		t.Fatalf("unexpected value %+v", u)
+	}
+
+	_ = d.Put([]byte("bad"), []byte("not json"))
+	var de *DecodeError
+	if err := GetJSON(d, []byte("bad"), &u); !errors.As(err, &de) || string(de.Key) != "bad" {
+		t.Fatalf("expected DecodeError, but got [%v]", err)
+	}
+	if err := GetJSON(d, []byte("missing"), &u); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, but got [%v]", err)
+	}
+}
+
+func TestKvndbGob(t *testing.T) {
+	d := New()
+	defer d.Close()
+
+	type state struct {
+		Counters map[string]int
+		Started  time.Time
+	}
+
+	in := state{
+		Counters: map[string]int{"a": 1},
+		Started:  time.Unix(100, 0),
+	}
+	if err := PutGob(d, []byte("s"), in); err != nil {
+		t.Fatal(err)
+	}
+	var out state
+	if err := GetGob(d, []byte("s"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Counters["a"] != 1 || !out.Started.Equal(in.Started) {
+		t.Fatalf("unexpected value %+v", out)
+	}
+
+	_ = d.Put([]byte("bad"), []byte("not gob"))
+	var de *DecodeError
+	if err := GetGob(d, []byte("bad"), &out); !errors.As(err, &de) {
+		t.Fatalf("expected DecodeError, but got [%v]", err)
+	}
+}
+
+func TestKvndbBatched(t *testing.T) {
+	d := New()
+	defer d.Close()
+
+	for i := 0; i < 25; i++ {
+		_ = d.Put([]byte(strconv.Itoa(i)), []byte("v"))
+	}
+
+	tuples, err := d.KeysAndValuesBatched(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := make([]int, 0)
+	for batch := range tuples {
+		sizes = append(sizes, len(batch))
+	}
+	if len(sizes) != 3 || sizes[0] != 10 || sizes[1] != 10 || sizes[2] != 5 {
+		t.Fatalf("unexpected batch sizes %v", sizes)
+	}
+
+	keys, err := d.KeysBatched(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for batch := range keys {
+		count += len(batch)
+	}
+	if count != 25 {
+		t.Fatalf("expected 25 keys, but got [%d]", count)
+	}
+}
+
+func TestKvndbIterator(t *testing.T) {
+	d := New(WithOrderedIndex())
+	defer d.Close()
+
+	for _, k := range []string{"d", "a", "c", "e", "b"} {
+		_ = d.Put([]byte(k), []byte("v"+k))
+	}
+
+	it, err := d.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0)
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	if strings.Join(keys, "") != "abcde" {
+		t.Fatalf("expected [abcde], but got %v", keys)
+	}
+
+	it.Seek([]byte("bb"))
+	if !it.Next() || string(it.Key()) != "c" || string(it.Value()) != "vc" {
+		t.Fatalf("expected entry [c] after seek, but got [%s]", it.Key())
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// datastore is released after close
+	if err := d.Put([]byte("f"), []byte("vf")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New().NewIterator(); err != ErrNotOrdered {
+		t.Fatalf("expected ErrNotOrdered, but got [%v]", err)
+	}
+
+	// lazily opened datastore keeps keys not yet read out of index
+	dir := t.TempDir()
+	if err := d.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	lazy, err := OpenLazy(dir, WithOrderedIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lazy.Close()
+	_ = lazy.Put([]byte("bb"), []byte("vbb"))
+	it, err = lazy.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = keys[:0]
+	for it.Next() {
+		keys = append(keys, string(it.Key())+"="+string(it.Value()))
+	}
+	if strings.Join(keys, ",") != "a=va,b=vb,bb=vbb,c=vc,d=vd,e=ve,f=vf" {
+		t.Fatalf("expected all entries in order, but got %v", keys)
+	}
+	it.Seek([]byte("c"))
+	if !it.Next() || string(it.Key()) != "c" {
+		t.Fatalf("expected entry [c] after seek, but got [%s]", it.Key())
+	}
+	_ = it.Close()
+}
+
+func TestKvndbSaveBuffer(t *testing.T) {
+	dir := t.TempDir()
+
+	d := New(WithSaveBuffer())
+	defer d.Close()
+	_ = d.Put([]byte("a"), []byte("1"))
+	_ = d.Put([]byte("b"), []byte("2"))
+
+	saving := make(chan struct{})
+	release := make(chan struct{})
+	d.BeforeSave(func(s Stats) error {
+		close(saving)
+		<-release
+		return nil
+	})
+	saved := make(chan error)
+	go func() {
+		saved <- d.Save(dir, 1)
+	}()
+	<-saving
+
+	// writes do not wait for save and are visible to Get right away
+	if err := d.Put([]byte("a"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := d.Get([]byte("a")); err != nil || string(value) != "3" {
+		t.Fatalf("expected buffered value [3], but got [%s] [%v]", value, err)
+	}
+	if _, err := d.Get([]byte("b")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected buffered delete, but got [%v]", err)
+	}
+
+	close(release)
+	if err := <-saved; err != nil {
+		t.Fatal(err)
+	}
+	if d.Size() != 1 {
+		t.Fatalf("expected buffered writes to be applied, but got [%d] entries", d.Size())
+	}
+
+	// snapshot holds data as of the start of save
+	l := New()
+	defer l.Close()
+	if err := l.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := l.Get([]byte("a")); string(value) != "1" || l.Size() != 2 {
+		t.Fatalf("expected snapshot without buffered writes, but got [%s] and [%d] entries", value, l.Size())
+	}
+}
+
+func TestKvndbSkipUnchanged(t *testing.T) {
+	dir := t.TempDir()
+
+	d := New(WithSkipUnchanged())
+	defer d.Close()
+	_ = d.Put([]byte("a"), []byte("1"))
+	if err := d.Save(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Save(dir, 2); err != ErrNotModified {
+		t.Fatalf("expected unchanged save to be skipped, but got [%v]", err)
+	}
+	if d.LastSave().Id != 1 {
+		t.Fatalf("expected snapshot 1 to stay the last, but got [%d]", d.LastSave().Id)
+	}
+
+	// other directory does not have the snapshot yet
+	if err := d.Save(t.TempDir(), 2); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = d.Delete([]byte("a"))
+	if err := d.Save(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if d.LastSave().Id != 2 {
+		t.Fatalf("expected snapshot 2 to be saved, but got [%d]", d.LastSave().Id)
+	}
+}
+
+func TestKvndbModifiedSince(t *testing.T) {
+	d := New()
+	defer d.Close()
+
+	rev := d.Revision()
+	if d.ModifiedSince(rev) {
+		t.Fatal("expected new datastore not to be modified")
+	}
+	_ = d.Put([]byte("a"), []byte("1"))
+	if !d.ModifiedSince(rev) {
+		t.Fatal("expected datastore to be modified by put")
+	}
+
+	rev = d.Revision()
+	_, _ = d.Get([]byte("a"))
+	if d.ModifiedSince(rev) {
+		t.Fatal("expected datastore not to be modified by get")
+	}
+	_ = d.Delete([]byte("a"))
+	if !d.ModifiedSince(rev) {
+		t.Fatal("expected datastore to be modified by delete")
+	}
+}
+
+func TestKvndbSnapshotRevision(t *testing.T) {
+	dir := t.TempDir()
+
+	d := New()
+	defer d.Close()
+	for i := 0; i < 10; i++ {
+		_ = d.Put([]byte(strconv.Itoa(i)), []byte("v"))
+	}
+	if err := d.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	if d.LastSave().Revision != d.Revision() {
+		t.Fatalf("expected saved revision [%d], but got [%d]", d.Revision(), d.LastSave().Revision)
+	}
+
+	l := New()
+	defer l.Close()
+	if err := l.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if l.LastLoad().Revision != d.Revision() || l.Revision() != d.Revision() {
+		t.Fatalf("expected loaded revision [%d], but got [%d] [%d]", d.Revision(), l.LastLoad().Revision, l.Revision())
+	}
+
+	_ = d.Put([]byte("a"), []byte("v"))
+	if behind := d.Revision() - l.Revision(); behind != 1 {
+		t.Fatalf("expected replica to be 1 revision behind, but got [%d]", behind)
+	}
+
+	lazy, err := OpenLazy(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lazy.Close()
+	if lazy.Revision() != l.Revision() {
+		t.Fatalf("expected lazily opened revision [%d], but got [%d]", l.Revision(), lazy.Revision())
+	}
+}
+
+func TestKvndbPutRevision(t *testing.T) {
+	d := New(WithEntryMeta())
+	defer d.Close()
+
+	for i := 0; i < 3; i++ {
+		_ = d.Put([]byte("b"), []byte("v"))
+		rev, err := d.PutRevision([]byte("a"), []byte("v"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rev != d.Revision() {
+			t.Fatalf("expected revision [%d], but got [%d]", d.Revision(), rev)
+		}
+	}
+	m, _ := d.GetMeta([]byte("a"))
+	if m.Revision != 6 {
+		t.Fatalf("expected meta revision [6], but got [%d]", m.Revision)
+	}
+
+	n := New()
+	defer n.Close()
+	if _, err := n.PutRevision([]byte("a"), []byte("v")); err != ErrNoMeta {
+		t.Fatalf("expected [%v], but got [%v]", ErrNoMeta, err)
+	}
+	if n.Size() != 0 {
+		t.Fatal("expected entry not to be put")
+	}
+}
+
+func TestKvndbPutIfRevision(t *testing.T) {
+	d := New(WithEntryMeta())
+	defer d.Close()
+
+	if err := d.PutIfRevision([]byte("a"), []byte("1"), 1); !errors.Is(err, ErrRevisionMismatch) {
+		t.Fatalf("expected missing entry to mismatch, but got [%v]", err)
+	}
+	if err := d.PutIfRevision([]byte("a"), []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutIfRevision([]byte("a"), []byte("2"), 0); !errors.Is(err, ErrRevisionMismatch) {
+		t.Fatalf("expected existing entry to mismatch, but got [%v]", err)
+	}
+	if err := d.PutIfRevision([]byte("a"), []byte("2"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := d.Get([]byte("a")); string(value) != "2" {
+		t.Fatalf("expected value [2], but got [%s]", value)
+	}
+
+	// revision read before entry was deleted and created again is stale
+	m, _ := d.GetMeta([]byte("a"))
+	if err := d.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutIfRevision([]byte("a"), []byte("3"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutIfRevision([]byte("a"), []byte("4"), m.Revision); !errors.Is(err, ErrRevisionMismatch) {
+		t.Fatalf("expected stale revision to mismatch, but got [%v]", err)
+	}
+	if err := d.PutIfRevision([]byte("a"), []byte("4"), 1); !errors.Is(err, ErrRevisionMismatch) {
+		t.Fatalf("expected stale revision to mismatch, but got [%v]", err)
+	}
+	if value, _ := d.Get([]byte("a")); string(value) != "3" {
+		t.Fatalf("expected value [3], but got [%s]", value)
+	}
+
+	n := New()
+	defer n.Close()
+	if err := n.PutIfRevision([]byte("a"), []byte("1"), 0); err != ErrNoMeta {
+		t.Fatalf("expected [%v], but got [%v]", ErrNoMeta, err)
+	}
+}
+
+func TestKvndbCompositeKeys(t *testing.T) {
+	parts := []string{"user", "a\x00b", "", "profile"}
+	split, err := SplitKey(Key(parts...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(split, "|") != strings.Join(parts, "|") || len(split) != len(parts) {
+		t.Fatalf("expected parts %q, but got %q", parts, split)
+	}
+	if _, err := SplitKey([]byte("user")); err != ErrBadKey {
+		t.Fatalf("expected [%v], but got [%v]", ErrBadKey, err)
+	}
+
+	// keys sort by parts, shorter part first
+	sorted := [][]byte{
+		Key("user", "1"),
+		Key("user", "1", "profile"),
+		Key("user", "1\x00"),
+		Key("user", "10"),
+		Key("user", "2"),
+	}
+	for i := 1; i < len(sorted); i++ {
+		if bytes.Compare(sorted[i-1], sorted[i]) >= 0 {
+			t.Fatalf("expected key %q to sort before %q", sorted[i-1], sorted[i])
+		}
+	}
+
+	d := New()
+	defer d.Close()
+	for _, key := range sorted {
+		_ = d.Put(key, []byte("v"))
+	}
+	ch, err := d.Range(KeyRange("user", "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make([]string, 0)
+	for tuple := range ch {
+		parts, _ := SplitKey(tuple.Key)
+		found = append(found, strings.Join(parts, "/"))
+	}
+	if strings.Join(found, ",") != "user/1,user/1/profile" {
+		t.Fatalf("expected keys of user 1, but got %q", found)
+	}
+}
+
+func TestKvndbDirectIO(t *testing.T) {
+	dir := t.TempDir()
+
+	d := New(WithDirectIO(), WithDSync(), WithSnapshotIndex())
+	defer d.Close()
+	// more than direct I/O buffer, with unaligned tail
+	for i := 0; i < 20000; i++ {
+		_ = d.Put([]byte(strconv.Itoa(i)), bytes.Repeat([]byte{byte(i)}, 100))
+	}
+	if err := d.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	l := New()
+	defer l.Close()
+	if err := l.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if l.Size() != 20000 {
+		t.Fatalf("expected [20000] entries, but got [%d]", l.Size())
+	}
+	if value, _ := l.Get([]byte("12345")); !bytes.Equal(value, bytes.Repeat([]byte{12345 % 256}, 100)) {
+		t.Fatal("expected value to survive direct I/O")
+	}
+}
+
+func TestKvndbStagingDir(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "snapshots")
+	staging := filepath.Join(base, "staging")
+	for _, p := range []string{dir, staging} {
+		if err := os.Mkdir(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := New(WithStagingDir(staging))
+	defer d.Close()
+	_ = d.Put([]byte("a"), []byte("1"))
+	if err := d.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(staging); len(entries) != 0 {
+		t.Fatalf("expected staging directory to be empty, but got [%d] files", len(entries))
+	}
+
+	l := New()
+	defer l.Close()
+	if err := l.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(WithStagingDir(filepath.Join(base, "missing")))
+	defer m.Close()
+	if err := m.Save(dir, 1); err == nil {
+		t.Fatal("expected missing staging directory to fail save")
+	}
+}
+
+func TestKvndbFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permissions are not supported on Windows")
+	}
+
+	dir := t.TempDir()
+	d := New(WithFileMode(0640), WithChunkChecksums(1024))
+	defer d.Close()
+	_ = d.Put([]byte("a"), []byte("1"))
+	if err := d.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{getSnapshotFilepath(dir, 1), getChecksumFilepath(dir, 1), getChunksFilepath(dir, 1)} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0640 {
+			t.Fatalf("expected %s to have mode [0640], but got [%o]", path, fi.Mode().Perm())
+		}
+	}
+}
+
+func TestKvndbOnRetire(t *testing.T) {
+	dir := t.TempDir()
+
+	d := New()
+	defer d.Close()
+	retired := make([]uint, 0)
+	failing := true
+	d.OnRetire(func(info SnapshotInfo) error {
+		if _, err := os.Stat(info.Path); err != nil {
+			return err
+		}
+		if failing {
+			return errors.New("cold storage is down")
+		}
+		retired = append(retired, info.Id)
+		return nil
+	})
+
+	for i := 0; i < 3; i++ {
+		_ = d.Put([]byte("a"), []byte(strconv.Itoa(i)))
+		if err := d.Save(dir, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// snapshots failed to retire are kept
+	if ids, _ := getAllSnapshotIds(dir); len(ids) != 3 {
+		t.Fatalf("expected [3] snapshots to be kept, but got %v", ids)
+	}
+
+	failing = false
+	if err := d.Save(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := getAllSnapshotIds(dir); len(ids) != 1 || ids[0] != 4 {
+		t.Fatalf("expected only snapshot 4 to be kept, but got %v", ids)
+	}
+	if len(retired) != 3 {
+		t.Fatalf("expected [3] snapshots to be retired, but got %v", retired)
+	}
+}
+
+func TestKvndbTrash(t *testing.T) {
+	dir := t.TempDir()
+
+	d := New(WithTrash(time.Hour))
+	defer d.Close()
+	for i := 0; i < 3; i++ {
+		if err := d.Save(dir, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ids, _ := getAllSnapshotIds(dir); len(ids) != 1 {
+		t.Fatalf("expected [1] snapshot to be kept, but got %v", ids)
+	}
+	if ids, _ := getAllSnapshotIds(getTrashDir(dir)); len(ids) != 2 {
+		t.Fatalf("expected [2] snapshots in trash, but got %v", ids)
+	}
+
+	// files past grace period are purged
+	old := time.Now().Add(-2 * time.Hour)
+	_ = os.Chtimes(filepath.Join(getTrashDir(dir), generateSnapshotName(1)), old, old)
+	if err := d.Save(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := getAllSnapshotIds(getTrashDir(dir)); len(ids) != 2 || ids[0] != 2 {
+		t.Fatalf("expected snapshots 2 and 3 in trash, but got %v", ids)
+	}
+}
+
+func TestKvndbManifest(t *testing.T) {
+	dir := t.TempDir()
+
+	d := New(WithManifest())
+	defer d.Close()
+	for i := 0; i < 3; i++ {
+		_ = d.Put([]byte(strconv.Itoa(i)), []byte("v"))
+		if err := d.Save(dir, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := ListSnapshots(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Id != 2 || entries[1].Id != 3 {
+		t.Fatalf("expected snapshots 2 and 3, but got %+v", entries)
+	}
+	last := d.LastSave()
+	if e := entries[1]; e.Entries != 3 || e.Bytes != last.Bytes || !bytes.Equal(e.Checksum, last.Checksum) || e.Revision != last.Revision {
+		t.Fatalf("expected manifest entry to match save report, but got %+v", e)
+	}
+
+	// without manifest directory is scanned
+	if err := os.Remove(getManifestFilepath(dir)); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = ListSnapshots(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || !bytes.Equal(entries[1].Checksum, last.Checksum) {
+		t.Fatalf("expected scanned snapshots 2 and 3, but got %+v", entries)
+	}
+}
+
+func TestKvndbVerifyAfterSave(t *testing.T) {
+	dir := t.TempDir()
+
+	d := New(WithVerifyAfterSave())
+	defer d.Close()
+	value := make([]byte, 64)
+	for i := 0; i < 1000; i++ {
+		rand.Read(value)
+		_ = d.Put([]byte(strconv.Itoa(i)), value)
+	}
+	if err := d.Save(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	checksum := d.LastSave().Checksum
+	if err := verifySavedSnapshot(dir, 1, checksum, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySavedSnapshot(dir, 1, checksum, 999); err != ErrBadSnapshot {
+		t.Fatalf("expected record count mismatch, but got [%v]", err)
+	}
+
+	fd, err := os.OpenFile(getSnapshotFilepath(dir, 1), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fd.WriteAt([]byte("corrupted"), 5000); err != nil {
+		t.Fatal(err)
+	}
+	_ = fd.Close()
+	if err := verifySavedSnapshot(dir, 1, checksum, 1000); !isCorruption(err) {
+		t.Fatalf("expected corruption to be detected, but got [%v]", err)
+	}
+}
+
+func TestKvndbVerifier(t *testing.T) {
+	dir := t.TempDir()
+
+	d := New()
+	defer d.Close()
+	value := make([]byte, 64)
+	for i := 0; i < 1000; i++ {
+		rand.Read(value)
+		_ = d.Put([]byte(strconv.Itoa(i)), value)
+	}
+	for i := 0; i < 2; i++ {
+		if err := d.Save(dir, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fd, err := os.OpenFile(getSnapshotFilepath(dir, 1), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fd.WriteAt([]byte("corrupted"), 5000); err != nil {
+		t.Fatal(err)
+	}
+	_ = fd.Close()
+
+	failures := make(chan VerifyFailure, 10)
+	v := StartVerifier(dir, 10*time.Millisecond, func(f VerifyFailure) {
+		failures <- f
+	})
+	defer v.Close()
+
+	select {
+	case f := <-failures:
+		if f.Id != 1 || f.Err != nil || len(f.Regions) != 1 {
+			t.Fatalf("expected snapshot 1 to be corrupted, but got %+v", f)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected corruption to be reported")
+	}
+
+	// non-positive interval selects default instead of panicking
+	def := StartVerifier(dir, 0, nil)
+	if def.interval != defaultVerifyInterval {
+		t.Fatalf("expected interval [%v], but got [%v]", defaultVerifyInterval, def.interval)
+	}
+	def.Close()
+}
+
+func TestKvndbDumpSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	d := New()
+	defer d.Close()
+	_ = d.Put([]byte("b"), []byte("second value"))
+	_ = d.Put([]byte("a"), []byte("v"))
+	if err := d.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := DumpSnapshot(out, dir, 0, DumpOptions{Preview: 6, Hash: true}); err != nil {
+		t.Fatal(err)
+	}
+	hashA := sha256.Sum256([]byte("v"))
+	hashB := sha256.Sum256([]byte("second value"))
+	expected := "61\t1\t" + hex.EncodeToString(hashA[:]) + "\t\"v\"\n" +
+		"62\t12\t" + hex.EncodeToString(hashB[:]) + "\t\"second\"\n"
+	if out.String() != expected {
+		t.Fatalf("expected dump %q, but got %q", expected, out.String())
+	}
+}
+
+func TestKvndbSnapshotJSON(t *testing.T) {
+	dir := t.TempDir()
+
+	d := New()
+	defer d.Close()
+	for i := 0; i < 100; i++ {
+		_ = d.Put([]byte(strconv.Itoa(i)), []byte("value "+strconv.Itoa(i)))
+	}
+	_ = d.Put([]byte("empty"), []byte{})
+	if err := d.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := SnapshotToJSON(buf, dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 101 {
+		t.Fatalf("expected [101] lines, but got [%d]", lines)
+	}
+
+	other := t.TempDir()
+	id, err := SnapshotFromJSON(buf, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 {
+		t.Fatalf("expected snapshot 1, but got [%d]", id)
+	}
+	l := New()
+	defer l.Close()
+	if err := l.Load(other); err != nil {
+		t.Fatal(err)
+	}
+	if l.Size() != 101 {
+		t.Fatalf("expected [101] entries, but got [%d]", l.Size())
+	}
+	if value, _ := l.Get([]byte("42")); string(value) != "value 42" {
+		t.Fatalf("expected value [value 42], but got [%s]", value)
+	}
+
+	if _, err := SnapshotFromJSON(strings.NewReader("not json"), other); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("expected [%v], but got [%v]", ErrBadSnapshot, err)
+	}
+	if ids, _ := getAllSnapshotIds(other); len(ids) != 1 {
+		t.Fatalf("expected failed import to leave no snapshot, but got %v", ids)
+	}
+
+	// failing to write checksum removes imported snapshot
+	if err := os.MkdirAll(filepath.Join(getChecksumFilepath(other, 2), "blocker"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SnapshotFromJSON(strings.NewReader(`{"key":"YQ==","value":"Yg=="}`+"\n"), other); err == nil {
+		t.Fatal("expected import to fail writing checksum")
+	}
+	if _, err := os.Stat(getSnapshotFilepath(other, 2)); !os.IsNotExist(err) {
+		t.Fatalf("expected snapshot without checksum to be removed, but got [%v]", err)
+	}
+}
+
+func TestKvndbInspectSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	d := New(WithSnapshotIndex(), WithEntryMeta())
+	defer d.Close()
+	for i := 0; i < 100; i++ {
+		_ = d.Put([]byte(strconv.Itoa(i)), []byte("v"))
+	}
+	if err := d.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := InspectSnapshot(getSnapshotFilepath(dir, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := d.LastSave()
+	if info.Id != 1 || info.Entries != 100 || info.Bytes != last.Bytes || !bytes.Equal(info.Checksum, last.Checksum) {
+		t.Fatalf("expected info to match save report, but got %+v", info)
+	}
+	if info.Version != snapshotVersion || !info.HasIndex || !info.HasMeta || info.Codec != "" || info.Revision != 100 {
+		t.Fatalf("expected info to match header, but got %+v", info)
+	}
+
+	// snapshot outside of its directory has no checksum
+	copied := filepath.Join(t.TempDir(), "copy")
+	data, _ := os.ReadFile(getSnapshotFilepath(dir, 1))
+	_ = os.WriteFile(copied, data, 0644)
+	info, err = InspectSnapshot(copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Id != 0 || info.Checksum != nil || info.Entries != 100 {
+		t.Fatalf("expected copied snapshot without id and checksum, but got %+v", info)
+	}
+}
+
+func TestKvndbFetchSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		_ = ServeSnapshots(l, dir)
+	}()
+
+	replica := t.TempDir()
+	if _, err := FetchSnapshot(l.Addr().String(), replica); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("expected missing snapshot to fail fetch, but got [%v]", err)
+	}
+
+	d := New()
+	defer d.Close()
+	for i := 0; i < 1000; i++ {
+		_ = d.Put([]byte(strconv.Itoa(i)), []byte("value"))
+	}
+	if err := d.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := FetchSnapshot(l.Addr().String(), replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 {
+		t.Fatalf("expected snapshot 1, but got [%d]", id)
+	}
+	r := New()
+	defer r.Close()
+	if err := r.Load(replica); err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != 1000 {
+		t.Fatalf("expected [1000] entries, but got [%d]", r.Size())
+	}
+}
+
+func TestKvndbFollow(t *testing.T) {
+	dir := t.TempDir()
+	d := New(WithChangeLog(3))
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		_ = ServeReplication(l, d, dir)
+	}()
+
+	_ = d.Put([]byte("a"), []byte("1"))
+	_ = d.Put([]byte("b"), []byte("2"))
+	if err := d.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	_ = d.Put([]byte("c"), []byte("3"))
+	_ = d.Delete([]byte("a"))
+
+	follower := New()
+	defer follower.Close()
+	has := func(key string) bool {
+		ok, _ := follower.Has([]byte(key))
+		return ok
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Follow(ctx, l.Addr().String(), t.TempDir(), follower)
+	}()
+
+	_ = d.Put([]byte("d"), []byte("4"))
+	deadline := time.Now().Add(5 * time.Second)
+	for !has("d") {
+		if time.Now().After(deadline) {
+			t.Fatal("expected follower to catch up")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, key := range []string{"b", "c", "d"} {
+		if !has(key) {
+			t.Fatalf("expected follower to have key [%s]", key)
+		}
+	}
+	if has("a") {
+		t.Fatal("expected deleted key to be deleted on follower")
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected follow to stop with context, but got [%v]", err)
+	}
+
+	// snapshot is older than retained changes
+	for i := 0; i < 3; i++ {
+		_ = d.Put([]byte("e"), []byte(strconv.Itoa(i)))
+	}
+	behind := New()
+	defer behind.Close()
+	err = Follow(context.Background(), l.Addr().String(), t.TempDir(), behind)
+	if err != ErrChangesTruncated {
+		t.Fatalf("expected [%v], but got [%v]", ErrChangesTruncated, err)
+	}
+
+	if err := d.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	done = make(chan error, 1)
+	go func() {
+		done <- Follow(context.Background(), l.Addr().String(), t.TempDir(), follower)
+	}()
+	_ = d.Put([]byte("f"), []byte("5"))
+	for !has("f") {
+		if time.Now().After(deadline) {
+			t.Fatal("expected follower to catch up")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := d.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != ErrChangesTruncated {
+		t.Fatalf("expected [%v] after leader reset, but got [%v]", ErrChangesTruncated, err)
+	}
+}
+
+func TestKvndbLastWriteWins(t *testing.T) {
+	dirA := t.TempDir()
+	dirB := t.TempDir()
+	a := New(WithLastWriteWins())
+	defer a.Close()
+	b := New(WithLastWriteWins())
+	defer b.Close()
+
+	_ = a.Put([]byte("key"), []byte("older"))
+	_ = b.Put([]byte("key"), []byte("newer"))
+	_ = a.Put([]byte("a"), []byte("a"))
+	if err := a.Save(dirA, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Save(dirB, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.LoadMerge(dirB, KeepExisting); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.LoadMerge(dirA, KeepExisting); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []DB{a, b} {
+		value, err := d.Get([]byte("key"))
+		if err != nil || string(value) != "newer" {
+			t.Fatalf("expected [newer], but got [%s] [%v]", value, err)
+		}
+		if d.Size() != 2 {
+			t.Fatalf("expected [2] entries, but got [%d]", d.Size())
+		}
+	}
+
+	// write made after merge is later than merged one
+	_ = a.Put([]byte("key"), []byte("latest"))
+	if err := a.Save(dirA, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.LoadMerge(dirA, KeepExisting); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := b.Get([]byte("key")); string(value) != "latest" {
+		t.Fatalf("expected [latest], but got [%s]", value)
+	}
+
+	// patch operations older than local writes are not applied
+	dir := t.TempDir()
+	p := New(WithEntryMeta())
+	defer p.Close()
+	_ = p.Put([]byte("x"), []byte("1"))
+	_ = p.Put([]byte("y"), []byte("1"))
+	if err := p.Save(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	_ = p.Put([]byte("x"), []byte("2"))
+	_ = p.Delete([]byte("y"))
+	_ = p.Put([]byte("z"), []byte("2"))
+	if err := p.Save(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	patch := &bytes.Buffer{}
+	if err := WritePatch(patch, dir, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(WithLastWriteWins())
+	defer c.Close()
+	_ = c.Put([]byte("x"), []byte("local"))
+	_ = c.Put([]byte("y"), []byte("local"))
+	if err := c.ApplyPatch(patch); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{"x": "local", "y": "local", "z": "2"} {
+		value, err := c.Get([]byte(key))
+		if err != nil || string(value) != expected {
+			t.Fatalf("expected [%s] for key [%s], but got [%s] [%v]", expected, key, value, err)
+		}
+	}
+}
+
+func TestKvndbMergeSnapshots(t *testing.T) {
+	inputs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	for i, dir := range inputs {
+		d := New()
+		_ = d.Put([]byte("common"), []byte(strconv.Itoa(i)))
+		_ = d.Put([]byte("only"+strconv.Itoa(i)), []byte("value"))
+		if err := d.Save(dir, 1); err != nil {
+			t.Fatal(err)
+		}
+		_ = d.Close()
+	}
+
+	out := t.TempDir()
+	sum := func(key, current, snapshot []byte) ([]byte, error) {
+		return []byte(strconv.Itoa(mustAtoi(string(current)) + mustAtoi(string(snapshot)))), nil
+	}
+	id, err := MergeSnapshots(out, sum, inputs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 {
+		t.Fatalf("expected snapshot 1, but got [%d]", id)
+	}
+
+	d := New()
+	defer d.Close()
+	if err := d.Load(out); err != nil {
+		t.Fatal(err)
+	}
+	if d.Size() != 4 {
+		t.Fatalf("expected [4] entries, but got [%d]", d.Size())
+	}
+	if value, _ := d.Get([]byte("common")); string(value) != "3" {
+		t.Fatalf("expected [3], but got [%s]", value)
+	}
+
+	// the last input wins by default, out may be one of inputs
+	id, err = MergeSnapshots(inputs[0], nil, inputs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Load(inputs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := d.Get([]byte("common")); id != 2 || string(value) != "2" {
+		t.Fatalf("expected [2] in snapshot 2, but got [%s] in snapshot [%d]", value, id)
+	}
+
+	if _, err := MergeSnapshots(out, nil, t.TempDir()); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("expected [%v], but got [%v]", ErrSnapshotNotFound, err)
+	}
+
+	// failing to write checksum removes merged snapshot
+	if err := os.MkdirAll(filepath.Join(getChecksumFilepath(out, 2), "blocker"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MergeSnapshots(out, nil, inputs...); err == nil {
+		t.Fatal("expected merge to fail writing checksum")
+	}
+	if _, err := os.Stat(getSnapshotFilepath(out, 2)); !os.IsNotExist(err) {
+		t.Fatalf("expected snapshot without checksum to be removed, but got [%v]", err)
+	}
+}
+
+func TestKvndbBackup(t *testing.T) {
+	d := New(WithEntryMeta())
+	defer d.Close()
+	for i := 0; i < 100; i++ {
+		_ = d.Put([]byte(strconv.Itoa(i)), []byte("value"))
+	}
+
+	archive := &bytes.Buffer{}
+	if err := d.Backup(archive); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	r := New(WithManifest())
+	defer r.Close()
+	_ = r.Put([]byte("x"), []byte("y"))
+	if err := r.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	id, err := RestoreBackup(bytes.NewReader(archive.Bytes()), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 2 {
+		t.Fatalf("expected snapshot 2, but got [%d]", id)
+	}
+	if err := r.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != 100 {
+		t.Fatalf("expected [100] entries, but got [%d]", r.Size())
+	}
+	entries, err := ListSnapshots(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].Id != 2 || entries[1].Entries != 100 || entries[1].Revision != d.Revision() {
+		t.Fatalf("expected restored snapshot in manifest, but got %+v", entries)
+	}
+
+	// corrupted snapshot is not restored
+	corrupted := append([]byte(nil), archive.Bytes()...)
+	gr, _ := gzip.NewReader(bytes.NewReader(corrupted))
+	raw, _ := io.ReadAll(gr)
+	// flip byte of snapshot records, past tar header of snapshot file
+	raw[bytes.Index(raw, []byte(generateSnapshotName(1)))+512+64] ^= 0xff
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	_, _ = gw.Write(raw)
+	_ = gw.Close()
+	if _, err := RestoreBackup(buf, dir); err == nil {
+		t.Fatal("expected corrupted backup to fail restore")
+	}
+	if ids, _ := getAllSnapshotIds(dir); len(ids) != 2 {
+		t.Fatalf("expected corrupted snapshot to be removed, but got %v", ids)
+	}
+}
+
+func TestKvndbRestore(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithSnapshotIndex()}, {WithEntryMeta()}, {WithCodec("ndjson")}} {
+		dir := t.TempDir()
+		d := New(opts...)
+		for i := 0; i < 1000; i++ {
+			_ = d.Put([]byte(strconv.Itoa(i)), []byte("value"))
+		}
+		if err := d.Save(dir, 1); err != nil {
+			t.Fatal(err)
+		}
+		archive := &bytes.Buffer{}
+		if err := d.Backup(archive); err != nil {
+			t.Fatal(err)
+		}
+		_ = d.Close()
+
+		snapshot, err := os.ReadFile(getSnapshotFilepath(dir, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range []io.Reader{bytes.NewReader(snapshot), archive} {
+			d := New()
+			_ = d.Put([]byte("x"), []byte("y"))
+			if err := d.Restore(r); err != nil {
+				t.Fatal(err)
+			}
+			if d.Size() != 1000 {
+				t.Fatalf("expected [1000] entries, but got [%d]", d.Size())
+			}
+			if report := d.LastLoad(); report == nil || report.Entries != 1000 || report.Revision != 1000 {
+				t.Fatalf("expected report of restored data, but got %+v", report)
+			}
+			_ = d.Close()
+		}
+
+		r := New()
+		_ = r.Put([]byte("x"), []byte("y"))
+		if err := r.Restore(bytes.NewReader(snapshot[:len(snapshot)/2])); err == nil {
+			t.Fatal("expected truncated snapshot to fail restore")
+		}
+		if r.Size() != 0 {
+			t.Fatalf("expected data to be reset, but got [%d] entries", r.Size())
+		}
+		_ = r.Close()
+	}
+}
+
+func TestKvndbSaveToBlobStore(t *testing.T) {
+	store := NewFSBlobStore(t.TempDir())
+	d := New()
+	defer d.Close()
+	for i := 0; i < 5; i++ {
+		_ = d.Put([]byte(strconv.Itoa(i)), []byte("value"))
+		if err := d.SaveTo(store, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names, err := store.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	expected := []string{"000003.kvndb", "000003.sha256", "000004.kvndb", "000004.sha256", "000005.kvndb", "000005.sha256"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v, but got %v", expected, names)
+	}
+
+	r := New()
+	defer r.Close()
+	if err := r.LoadFrom(store); err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != 5 {
+		t.Fatalf("expected [5] entries, but got [%d]", r.Size())
+	}
+	if report := r.LastLoad(); report == nil || report.Id != 5 {
+		t.Fatalf("expected report of snapshot 5, but got %+v", report)
+	}
+
+	// snapshot without checksum is incomplete and skipped
+	if err := store.Delete("000005.sha256"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.LoadFrom(store); err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != 4 {
+		t.Fatalf("expected [4] entries, but got [%d]", r.Size())
+	}
+
+	if _, err := store.Get("missing"); err != ErrBlobNotFound {
+		t.Fatalf("expected [%v], but got [%v]", ErrBlobNotFound, err)
+	}
+	if err := r.LoadFrom(NewFSBlobStore(t.TempDir())); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("expected [%v], but got [%v]", ErrSnapshotNotFound, err)
+	}
+}
+
+func TestKvndbS3BlobStore(t *testing.T) {
+	var mutex sync.Mutex
+	objects := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/bucket/")
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/bucket":
+			// list at most two keys per page to exercise continuation
+			keys := make([]string, 0)
+			for key := range objects {
+				if strings.HasPrefix(key, r.URL.Query().Get("prefix")) && key > r.URL.Query().Get("continuation-token") {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			truncated := len(keys) > 2
+			if truncated {
+				keys = keys[:2]
+			}
+			fmt.Fprint(w, "<ListBucketResult>")
+			for _, key := range keys {
+				fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", key)
+			}
+			if truncated {
+				fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>", keys[1])
+			}
+			fmt.Fprint(w, "</ListBucketResult>")
+		case r.Method == http.MethodPut:
+			objects[name], _ = io.ReadAll(r.Body)
+		case r.Method == http.MethodGet:
+			value, ok := objects[name]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(value)
+		case r.Method == http.MethodDelete:
+			delete(objects, name)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	store := NewS3BlobStore(S3Config{
+		Endpoint:  server.URL,
+		Bucket:    "bucket",
+		Prefix:    "kvndb/",
+		AccessKey: "key",
+		SecretKey: "secret",
+	})
+	d := New()
+	defer d.Close()
+	for i := 0; i < 3; i++ {
+		_ = d.Put([]byte(strconv.Itoa(i)), []byte("value"))
+		if err := d.SaveTo(store, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(objects) != 4 || objects["kvndb/000003.kvndb"] == nil {
+		t.Fatalf("expected 2 snapshots with checksums under prefix, but got %d objects", len(objects))
+	}
+
+	r := New()
+	defer r.Close()
+	if err := r.LoadFrom(store); err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != 3 {
+		t.Fatalf("expected [3] entries, but got [%d]", r.Size())
+	}
+	if _, err := store.Get("missing"); err != ErrBlobNotFound {
+		t.Fatalf("expected [%v], but got [%v]", ErrBlobNotFound, err)
+	}
+
+	denied := NewS3BlobStore(S3Config{Endpoint: server.URL, Bucket: "bucket"})
+	if _, err := denied.List(""); err == nil {
+		t.Fatal("expected unsigned request to fail")
+	}
+}
+
+func TestKvndbSSHBlobStore(t *testing.T) {
+	// fake ssh client runs script given as its last argument locally
+	dir := t.TempDir()
+	command := filepath.Join(t.TempDir(), "ssh")
+	if err := os.WriteFile(command, []byte("#!/bin/sh\nfor arg; do script=$arg; done\nexec sh -c \"$script\"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	store := NewSSHBlobStore(SSHConfig{
+		Host:    "backup@localhost",
+		Dir:     dir,
+		Command: command,
+	})
+
+	d := New()
+	defer d.Close()
+	for i := 0; i < 3; i++ {
+		_ = d.Put([]byte(strconv.Itoa(i)), []byte("value"))
+		if err := d.SaveTo(store, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names, err := store.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 4 {
+		t.Fatalf("expected 2 snapshots with checksums, but got %v", names)
+	}
+
+	r := New()
+	defer r.Close()
+	if err := r.LoadFrom(store); err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != 3 {
+		t.Fatalf("expected [3] entries, but got [%d]", r.Size())
+	}
+
+	if err := store.Put("empty", strings.NewReader(""), 0); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := store.Get("empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := io.ReadAll(rc); len(value) != 0 || rc.Close() != nil {
+		t.Fatalf("expected empty object, but got [%s]", value)
+	}
+	if _, err := store.Get("missing"); err != ErrBlobNotFound {
+		t.Fatalf("expected [%v], but got [%v]", ErrBlobNotFound, err)
+	}
+	if err := store.Put("short", strings.NewReader("abc"), 4); err == nil {
+		t.Fatal("expected short object to fail put")
+	}
+	if _, err := store.Get("short"); err != ErrBlobNotFound {
+		t.Fatalf("expected [%v], but got [%v]", ErrBlobNotFound, err)
+	}
+}
+
+func TestKvndbReadOnlyView(t *testing.T) {
+	d := New()
+	defer d.Close()
+	_ = d.Put([]byte("a"), []byte("1"))
+
+	var view ReadOnlyDB = d.ReadOnlyView()
+	if _, ok := view.(DB); ok {
+		t.Fatal("expected view not to implement DB")
+	}
+	if value, err := view.Get([]byte("a")); err != nil || string(value) != "1" {
+		t.Fatalf("expected [1], but got [%s] [%v]", value, err)
+	}
+
+	// view sees changes made through datastore
+	_ = d.Put([]byte("b"), []byte("2"))
+	if view.Size() != 2 {
+		t.Fatalf("expected [2] entries, but got [%d]", view.Size())
+	}
+	keys, err := view.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for range keys {
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("expected [2] keys, but got [%d]", n)
+	}
+
+	if err := view.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := d.Has([]byte("a")); err != nil || !ok {
+		t.Fatalf("expected datastore to stay open, but got [%v] [%v]", ok, err)
+	}
+}
+
+func TestKvndbRateLimit(t *testing.T) {
+	d := New(WithRateLimit(10, 0))
+	defer d.Close()
+
+	// burst of one second worth of operations is allowed
+	for i := 0; i < 10; i++ {
+		if err := d.Put([]byte(strconv.Itoa(i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Delete([]byte("0")); err != ErrRateLimited {
+		t.Fatalf("expected [%v], but got [%v]", ErrRateLimited, err)
+	}
+	if _, err := d.Get([]byte("0")); err != nil {
+		t.Fatalf("expected reads not to be limited, but got [%v]", err)
+	}
+	if stats := d.Stats(); stats.RateLimited != 1 || stats.Puts != 10 {
+		t.Fatalf("expected [10] puts and [1] rejection, but got %+v", stats)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if err := d.Delete([]byte("0")); err != nil {
+		t.Fatal(err)
+	}
+
+	// fractional rates allow one mutation, then one per 1/rate seconds
+	f := New(WithRateLimit(0.5, 0.5))
+	defer f.Close()
+	if err := f.Put([]byte("a"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Put([]byte("b"), []byte("value")); err != ErrRateLimited {
+		t.Fatalf("expected [%v], but got [%v]", ErrRateLimited, err)
+	}
+	l := newRateLimiter(4, 0, time.Now)
+	for i := 0; i < 4; i++ {
+		_ = l.allow(1)
+	}
+	l.ops.last = l.ops.last.Add(-250 * time.Millisecond)
+	if err := l.allow(1); err != nil {
+		t.Fatalf("expected token to be refilled, but got [%v]", err)
+	}
+	l = newRateLimiter(0.25, 0, time.Now)
+	_ = l.allow(1)
+	l.ops.last = l.ops.last.Add(-4 * time.Second)
+	if err := l.allow(1); err != nil {
+		t.Fatalf("expected token to be refilled at fractional rate, but got [%v]", err)
+	}
+
+	// TryPut failing with ErrBusy does not take token
+	one := New(WithRateLimit(1, 0))
+	defer one.Close()
+	one.(*db).mutex.Lock()
+	if err := one.TryPut([]byte("a"), []byte("value")); err != ErrBusy {
+		t.Fatalf("expected [%v], but got [%v]", ErrBusy, err)
+	}
+	one.(*db).mutex.Unlock()
+	if err := one.TryPut([]byte("a"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	b := New(WithRateLimit(0, 100))
+	defer b.Close()
+	// value over byte burst is allowed, but leaves limiter in debt
+	if err := b.Put([]byte("a"), make([]byte, 150)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put([]byte("b"), []byte("value")); err != ErrRateLimited {
+		t.Fatalf("expected [%v], but got [%v]", ErrRateLimited, err)
+	}
+}
+
+func TestKvndbGetCopy(t *testing.T) {
+	d := New()
+	defer d.Close()
+	_ = d.Put([]byte("a"), []byte("value"))
+
+	value, err := d.Get([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value[0] = 'X'
+	if value, _ := d.Get([]byte("a")); string(value) != "value" {
+		t.Fatalf("expected [value], but got [%s]", value)
+	}
+	if value, _ := d.TryGet([]byte("a")); string(value) != "value" {
+		t.Fatalf("expected [value], but got [%s]", value)
+	}
+
+	a, _ := d.GetUnsafe([]byte("a"))
+	b, _ := d.GetUnsafe([]byte("a"))
+	if &a[0] != &b[0] {
+		t.Fatal("expected GetUnsafe to return stored value")
+	}
+
+	_ = d.Put([]byte("empty"), []byte{})
+	if value, err := d.Get([]byte("empty")); err != nil || value == nil {
+		t.Fatalf("expected empty value, but got [%v] [%v]", value, err)
+	}
+
+	// bulk reads hand out copies too, also through read-only view
+	view := d.ReadOnlyView()
+	tuples, _ := view.KeysAndValues()
+	for tuple := range tuples {
+		if len(tuple.Value) > 0 {
+			tuple.Value[0] = 'X'
+		}
+	}
+	batches, _ := view.KeysAndValuesBatched(0)
+	for batch := range batches {
+		for _, tuple := range batch {
+			if len(tuple.Value) > 0 {
+				tuple.Value[0] = 'X'
+			}
+		}
+	}
+	tuples, _ = view.Range(nil, nil)
+	for tuple := range tuples {
+		if len(tuple.Value) > 0 {
+			tuple.Value[0] = 'X'
+		}
+	}
+	found, _ := view.FindValues(func(value []byte) bool { return len(value) > 0 }, 0)
+	found[0].Value[0] = 'X'
+	dst := New(WithUnsafePut())
+	defer dst.Close()
+	_ = d.CopyTo(dst, true)
+	copied, _ := dst.GetUnsafe([]byte("a"))
+	copied[0] = 'X'
+	if value, _ := d.Get([]byte("a")); string(value) != "value" {
+		t.Fatalf("expected [value], but got [%s]", value)
+	}
+
+	o := New(WithOrderedIndex())
+	defer o.Close()
+	_ = o.Put([]byte("a"), []byte("value"))
+	it, err := o.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for it.Next() {
+		it.Value()[0] = 'X'
+	}
+	_ = it.Close()
+	if value, _ := o.Get([]byte("a")); string(value) != "value" {
+		t.Fatalf("expected [value], but got [%s]", value)
+	}
+
+	u := New(WithUnsafeGet())
+	defer u.Close()
+	_ = u.Put([]byte("a"), []byte("value"))
+	a, _ = u.Get([]byte("a"))
+	b, _ = u.Get([]byte("a"))
+	if &a[0] != &b[0] {
+		t.Fatal("expected Get to return stored value with WithUnsafeGet")
+	}
+}
+
+func TestKvndbPutCopy(t *testing.T) {
+	d := New()
+	defer d.Close()
+
+	buf := []byte("value")
+	_ = d.Put([]byte("a"), buf)
+	_ = d.PutTTL([]byte("b"), buf, time.Hour)
+	_ = d.DoWithKey([]byte("c"), func(_ []byte) ([]byte, error) {
+		return buf, nil
+	})
+	copy(buf, "XXXXX")
+	for _, key := range []string{"a", "b", "c"} {
+		if value, _ := d.Get([]byte(key)); string(value) != "value" {
+			t.Fatalf("expected [value] for [%s], but got [%s]", key, value)
+		}
+	}
+
+	_ = d.PutUnsafe([]byte("d"), buf)
+	buf[0] = 'Y'
+	if value, _ := d.Get([]byte("d")); string(value) != "YXXXX" {
+		t.Fatalf("expected PutUnsafe to keep given value, but got [%s]", value)
+	}
+
+	u := New(WithUnsafePut())
+	defer u.Close()
+	_ = u.Put([]byte("a"), buf)
+	buf[0] = 'Z'
+	if value, _ := u.Get([]byte("a")); string(value) != "ZXXXX" {
+		t.Fatalf("expected Put to keep given value with WithUnsafePut, but got [%s]", value)
+	}
+}
+
+func TestKvndbIterateClosed(t *testing.T) {
+	d := New()
+	_ = d.Put([]byte("a"), []byte("1"))
+	_ = d.Close()
+
+	if _, err := d.Keys(); err != ErrAlreadyClosed {
+		t.Fatalf("expected [%v], but got [%v]", ErrAlreadyClosed, err)
+	}
+	if _, err := d.KeysAndValues(); err != ErrAlreadyClosed {
+		t.Fatalf("expected [%v], but got [%v]", ErrAlreadyClosed, err)
+	}
+
+	// failed iteration must not leave datastore locked
+	done := make(chan error)
+	go func() {
+		done <- d.Reset()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Reset after failed iteration not to block")
+	}
+	if err := d.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	_ = d.Close()
+}
+
+func TestKvndbSnapshotHeaderCorruption(t *testing.T) {
+	dir := t.TempDir()
+	d := New()
+	_ = d.Put([]byte("a"), []byte("1"))
+	if err := d.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	_ = d.Close()
+
+	path := getSnapshotFilepath(dir, 1)
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, size, err := readSnapshotHeader(bytes.NewReader(raw), int64(len(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flip bit in revision, which checksum file does not cover
+	raw[size-5] ^= 1
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if regions, err := VerifySnapshot(dir, 1); err != nil || len(regions) != 1 {
+		t.Fatalf("expected corrupted header to be reported, but got %v [%v]", regions, err)
+	}
+	if err := New().Load(dir); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("expected [%v], but got [%v]", ErrBadSnapshot, err)
+	}
+
+	// decoded length of chunk is bounded, so it can't force huge
+	// allocation
+	chunk := append([]byte{0, 0, 0, 0}, 0x80, 0x80, 0x80, 0x80, 0x04)
+	stream := append([]byte{frameChunkCompressed, byte(len(chunk)), 0, 0}, chunk...)
+	if _, err := io.ReadAll(newFrameReader(bytes.NewReader(stream), 0)); err != errFrameCorrupt {
+		t.Fatalf("expected [%v], but got [%v]", errFrameCorrupt, err)
+	}
+}
+
+func TestKvndbRestoreForgedLength(t *testing.T) {
+	for _, vLen := range []uint64{1 << 62, 1 << 30} {
+		header := (&snapshotHeader{version: snapshotVersion}).bytes()
+		record := []byte{1, 'a'}
+		lenBuf := make([]byte, 10)
+		record = append(record, lenBuf[:binary.PutUvarint(lenBuf, vLen)]...)
+		record = append(record, "short"...)
+
+		buf := bytes.NewBuffer(header)
+		fw := newFrameWriter(buf, int64(len(header)))
+		_, _ = fw.Write(record)
+		_ = fw.Flush()
+
+		d := New()
+		err := d.Restore(buf)
+		if !errors.Is(err, ErrBadSnapshot) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("expected forged length [%d] to fail restore, but got [%v]", vLen, err)
+		}
+		if d.Size() != 0 {
+			t.Fatalf("expected data to be reset, but got [%d] entries", d.Size())
+		}
+		_ = d.Close()
+	}
+}
+
+func TestKvndbOpenLazyFailureReleases(t *testing.T) {
+	dir, err := os.MkdirTemp(".", "temp-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// retrying failed open must not panic on expvar published twice
+	for i := 0; i < 2; i++ {
+		_, err = OpenLazy(dir, WithExpvar("kvndb-test-open-lazy"), WithSweeper(time.Millisecond, 0))
+		if !errors.Is(err, ErrSnapshotNotFound) {
+			t.Fatalf("expected [%v], but got [%v]", ErrSnapshotNotFound, err)
+		}
+		_, err = OpenSnapshot(dir, 0, WithExpvar("kvndb-test-open-lazy"))
+		if !errors.Is(err, ErrSnapshotNotFound) {
+			t.Fatalf("expected [%v], but got [%v]", ErrSnapshotNotFound, err)
+		}
+	}
+	if expvar.Get("kvndb-test-open-lazy") != nil {
+		t.Fatal("expected failed open not to publish expvar")
+	}
+
+	d := New()
+	_ = d.Put([]byte("a"), []byte("1"))
+	if err := d.Save(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	_ = d.Close()
+
+	l, err := OpenLazy(dir, WithExpvar("kvndb-test-open-lazy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if v, err := l.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("expected [1], but got [%s], [%v]", v, err)
+	}
+}
+
+func TestKvndbClock(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+
+	d := New(WithClock(clock), WithEntryMeta(), WithAccessFrequency(10, time.Minute), WithRateLimit(1, 0))
+	defer d.Close()
+
+	if err := d.PutTTL([]byte("a"), []byte("1"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	m, err := d.GetMeta([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Updated.Equal(now) {
+		t.Fatalf("expected update time [%v], but got [%v]", now, m.Updated)
+	}
+
+	// rate limiter refills by clock too
+	if err := d.Put([]byte("b"), []byte("2")); err != ErrRateLimited {
+		t.Fatalf("expected [%v], but got [%v]", ErrRateLimited, err)
+	}
+	now = now.Add(time.Second)
+	if err := d.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// access counters decay by clock, a in 10 periods down to 0
+	now = now.Add(10 * time.Minute)
+	top, err := d.TopKeysByAccess(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ka := range top {
+		if ka.Frequency != 0 {
+			t.Fatalf("expected key [%s] to decay, but got frequency [%d]", ka.Key, ka.Frequency)
+		}
+	}
+
+	now = now.Add(time.Hour)
+	if _, err := d.Get([]byte("a")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected entry to expire, but got [%v]", err)
+	}
+}
+
+func TestKvndbMemoryLimit(t *testing.T) {
+	d := New(WithMemoryLimit(1024))
+	defer d.Close()
+
+	if err := d.Put([]byte("a"), make([]byte, 512)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put([]byte("b"), make([]byte, 1024)); !errors.Is(err, ErrMemoryLimit) {
+		t.Fatalf("expected [%v], but got [%v]", ErrMemoryLimit, err)
+	}
+	if err := d.PutReader([]byte("b"), bytes.NewReader(make([]byte, 1024)), 1024); !errors.Is(err, ErrMemoryLimit) {
+		t.Fatalf("expected [%v], but got [%v]", ErrMemoryLimit, err)
+	}
+	if ok, _ := d.Has([]byte("b")); ok {
+		t.Fatal("expected rejected entry not to be stored")
+	}
+	if err := d.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put([]byte("b"), make([]byte, 512)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKvndbDeleteMissingUnmodified(t *testing.T) {
+	dir, err := os.MkdirTemp(".", "temp-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := New(WithSkipUnchanged())
+	defer d.Close()
+	_ = d.Put([]byte("a"), []byte("1"))
+	if err := d.Save(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	rev := d.Revision()
+	if err := d.Delete([]byte("missing")); err != nil {
+		t.Fatal(err)
+	}
+	if d.Revision() != rev {
+		t.Fatalf("expected revision [%d], but got [%d]", rev, d.Revision())
+	}
+	if d.ModifiedSince(rev) {
+		t.Fatal("expected deleting missing key not to modify data")
+	}
+	if err := d.Save(dir, 0); err != ErrNotModified {
+		t.Fatalf("expected [%v], but got [%v]", ErrNotModified, err)
+	}
+
+	if err := d.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if !d.ModifiedSince(rev) {
+		t.Fatal("expected deleting existing key to modify data")
+	}
+}
+
+func TestKvndbDeleteMissingNoEvent(t *testing.T) {
+	d := New(WithEvents(10, DropNewest), WithChangeLog(10))
+	defer d.Close()
+
+	sub, err := d.Subscribe(nil, 10, DropNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = d.Delete([]byte("missing"))
+	_ = d.Put([]byte("a"), []byte("1"))
+
+	for _, ch := range []<-chan Event{d.Events(), sub.C} {
+		e := <-ch
+		if e.Kind != EventPut {
+			t.Fatalf("expected put event, but got [%v] for [%s]", e.Kind, e.Key)
+		}
+	}
+	backlog, _, ok := d.(*db).changes.subscribe(0, d.Revision())
+	if !ok || len(backlog) != 1 || backlog[0].Kind != EventPut {
+		t.Fatalf("expected only put in change log, but got [%v]", backlog)
+	}
+}
+
+func TestKvndbLoadMergeClearsTTL(t *testing.T) {
+	dir, err := os.MkdirTemp(".", "temp-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := New()
+	_ = s.Put([]byte("a"), []byte("snapshot"))
+	_ = s.Put([]byte("b"), []byte("snapshot"))
+	if err := s.Save(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+
+	now := time.Unix(1000, 0)
+	d := New(WithClock(func() time.Time { return now }))
+	defer d.Close()
+	_ = d.PutTTL([]byte("a"), []byte("current"), time.Minute)
+	_ = d.PutTTL([]byte("b"), []byte("current"), time.Minute)
+
+	// a is replaced and b deleted by merge, neither keeps TTL
+	err = d.LoadMerge(dir, func(key, current, snapshot []byte) ([]byte, error) {
+		if string(key) == "b" {
+			return nil, nil
+		}
+		return snapshot, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.(*db).ttl.expires) != 0 {
+		t.Fatalf("expected merge to clear TTL, but got [%v]", d.(*db).ttl.expires)
+	}
+
+	now = now.Add(time.Hour)
+	if _, err := d.Get([]byte("a")); err != nil {
+		t.Fatalf("expected merged entry not to expire, but got [%v]", err)
+	}
+}
+
+func TestKvndbKeyLocksBulkWaits(t *testing.T) {
+	d := New(WithKeyLocks(4))
+	defer d.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- d.DoWithKey([]byte("a"), func(current []byte) ([]byte, error) {
+			close(started)
+			<-release
+			return []byte("1"), nil
+		})
+	}()
+	<-started
+
+	reset := make(chan error, 1)
+	go func() {
+		reset <- d.Reset()
+	}()
+	select {
+	case <-reset:
+		t.Fatal("expected Reset to wait for DoWithKey")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-reset; err != nil {
+		t.Fatal(err)
+	}
+	if d.Size() != 0 {
+		t.Fatalf("expected Reset to remove entry written before it, but got [%d] entries", d.Size())
+	}
+}
+
+func mustAtoi(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
 }
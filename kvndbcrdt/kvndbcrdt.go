@@ -0,0 +1,556 @@
+// Package kvndbcrdt provides conflict-free replicated data types stored
+// as kvndb values. Replicas of the same value updated independently on
+// different nodes converge to the same state once they are merged, in
+// any order and any number of times, without central coordination.
+//
+// Every node updating values must use its own unique node id.
+package kvndbcrdt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/akamensky/kvndb"
+)
+
+var (
+	ErrBadValue     = errors.New("kvndbcrdt: not a valid CRDT value")
+	ErrTypeMismatch = errors.New("kvndbcrdt: values of different types can not be merged")
+)
+
+const (
+	tagGCounter byte = iota + 1
+	tagPNCounter
+	tagLWWRegister
+	tagORSet
+)
+
+// Value is CRDT which can be stored as kvndb value.
+type Value interface {
+	// Bytes encodes value for storing in datastore.
+	Bytes() []byte
+	// Merge merges state of other value of the same type into this one.
+	Merge(other Value) error
+}
+
+// Parse decodes value encoded by Bytes of any type in this package.
+func Parse(b []byte) (Value, error) {
+	if len(b) == 0 {
+		return nil, ErrBadValue
+	}
+
+	d := &decoder{b: b[1:]}
+	var v Value
+	switch b[0] {
+	case tagGCounter:
+		v = d.gCounter()
+	case tagPNCounter:
+		v = &PNCounter{p: d.gCounter(), n: d.gCounter()}
+	case tagLWWRegister:
+		v = &LWWRegister{
+			value: d.bytes(),
+			ts:    int64(d.uvarint()),
+			node:  string(d.bytes()),
+		}
+	case tagORSet:
+		v = d.orSet()
+	default:
+		return nil, ErrBadValue
+	}
+	if d.err != nil || len(d.b) > 0 {
+		return nil, ErrBadValue
+	}
+
+	return v, nil
+}
+
+// Update atomically applies fn to value stored under given key in
+// datastore, zero if there is none, and stores the result. zero must be
+// new value of the type stored under key, otherwise Update fails with
+// ErrTypeMismatch.
+func Update(d kvndb.DB, key []byte, zero Value, fn func(v Value) error) error {
+	return d.DoWithKey(key, func(current []byte) ([]byte, error) {
+		v := zero
+		if current != nil {
+			stored, err := Parse(current)
+			if err != nil {
+				return nil, err
+			}
+			if current[0] != zero.Bytes()[0] {
+				return nil, ErrTypeMismatch
+			}
+			v = stored
+		}
+
+		err := fn(v)
+		if err != nil {
+			return nil, err
+		}
+
+		return v.Bytes(), nil
+	})
+}
+
+// Merge atomically merges given value, e.g. received from another node,
+// into value stored under given key in datastore.
+func Merge(d kvndb.DB, key []byte, v Value) error {
+	return d.DoWithKey(key, func(current []byte) ([]byte, error) {
+		if current == nil {
+			return v.Bytes(), nil
+		}
+
+		return mergeBytes(current, v.Bytes())
+	})
+}
+
+// Conflict is kvndb.ConflictPolicy merging CRDT values, so LoadMerge
+// of snapshot saved by another node converges with it.
+func Conflict(_, current, snapshot []byte) ([]byte, error) {
+	return mergeBytes(current, snapshot)
+}
+
+func mergeBytes(a, b []byte) ([]byte, error) {
+	va, err := Parse(a)
+	if err != nil {
+		return nil, err
+	}
+	vb, err := Parse(b)
+	if err != nil {
+		return nil, err
+	}
+
+	err = va.Merge(vb)
+	if err != nil {
+		return nil, err
+	}
+
+	return va.Bytes(), nil
+}
+
+// GCounter is grow-only counter.
+type GCounter struct {
+	counts map[string]uint64
+}
+
+func NewGCounter() *GCounter {
+	return &GCounter{
+		counts: make(map[string]uint64),
+	}
+}
+
+// Inc increments counter by n on behalf of given node.
+func (c *GCounter) Inc(node string, n uint64) {
+	c.counts[node] += n
+}
+
+// Value returns sum of increments of all nodes.
+func (c *GCounter) Value() uint64 {
+	var sum uint64
+	for _, n := range c.counts {
+		sum += n
+	}
+
+	return sum
+}
+
+func (c *GCounter) Merge(other Value) error {
+	o, ok := other.(*GCounter)
+	if !ok {
+		return ErrTypeMismatch
+	}
+
+	c.merge(o)
+
+	return nil
+}
+
+func (c *GCounter) merge(o *GCounter) {
+	for node, n := range o.counts {
+		if n > c.counts[node] {
+			c.counts[node] = n
+		}
+	}
+}
+
+func (c *GCounter) Bytes() []byte {
+	return c.appendTo([]byte{tagGCounter})
+}
+
+func (c *GCounter) appendTo(b []byte) []byte {
+	b = appendUvarint(b, uint64(len(c.counts)))
+	for _, node := range sortedNodes(c.counts) {
+		b = appendBytes(b, []byte(node))
+		b = appendUvarint(b, c.counts[node])
+	}
+
+	return b
+}
+
+// PNCounter is counter which can be both incremented and decremented.
+type PNCounter struct {
+	p *GCounter
+	n *GCounter
+}
+
+func NewPNCounter() *PNCounter {
+	return &PNCounter{
+		p: NewGCounter(),
+		n: NewGCounter(),
+	}
+}
+
+// Inc increments counter by n on behalf of given node.
+func (c *PNCounter) Inc(node string, n uint64) {
+	c.p.Inc(node, n)
+}
+
+// Dec decrements counter by n on behalf of given node.
+func (c *PNCounter) Dec(node string, n uint64) {
+	c.n.Inc(node, n)
+}
+
+// Value returns sum of increments less sum of decrements of all nodes.
+func (c *PNCounter) Value() int64 {
+	return int64(c.p.Value() - c.n.Value())
+}
+
+func (c *PNCounter) Merge(other Value) error {
+	o, ok := other.(*PNCounter)
+	if !ok {
+		return ErrTypeMismatch
+	}
+
+	c.p.merge(o.p)
+	c.n.merge(o.n)
+
+	return nil
+}
+
+func (c *PNCounter) Bytes() []byte {
+	return c.n.appendTo(c.p.appendTo([]byte{tagPNCounter}))
+}
+
+// LWWRegister holds single value, the one set last wins. Values set at
+// the same time are ordered by node id and then by value.
+type LWWRegister struct {
+	value []byte
+	ts    int64
+	node  string
+}
+
+func NewLWWRegister() *LWWRegister {
+	return &LWWRegister{}
+}
+
+// Set sets value on behalf of given node. Time of the write is current
+// time, unless it is not later than time of value being replaced.
+func (r *LWWRegister) Set(node string, value []byte) {
+	ts := time.Now().UnixNano()
+	if ts <= r.ts {
+		ts = r.ts + 1
+	}
+
+	r.value = append([]byte(nil), value...)
+	r.ts = ts
+	r.node = node
+}
+
+// Value returns current value, nil if it was never set.
+func (r *LWWRegister) Value() []byte {
+	return r.value
+}
+
+// Time returns time current value was set at.
+func (r *LWWRegister) Time() time.Time {
+	return time.Unix(0, r.ts)
+}
+
+func (r *LWWRegister) Merge(other Value) error {
+	o, ok := other.(*LWWRegister)
+	if !ok {
+		return ErrTypeMismatch
+	}
+
+	if r.later(o) {
+		return nil
+	}
+	r.value = append([]byte(nil), o.value...)
+	r.ts = o.ts
+	r.node = o.node
+
+	return nil
+}
+
+// later reports whether value of r wins over value of o.
+func (r *LWWRegister) later(o *LWWRegister) bool {
+	if r.ts != o.ts {
+		return r.ts > o.ts
+	}
+	if r.node != o.node {
+		return r.node > o.node
+	}
+
+	return bytes.Compare(r.value, o.value) >= 0
+}
+
+func (r *LWWRegister) Bytes() []byte {
+	b := appendBytes([]byte{tagLWWRegister}, r.value)
+	b = appendUvarint(b, uint64(r.ts))
+
+	return appendBytes(b, []byte(r.node))
+}
+
+// orTag uniquely identifies single addition of element to ORSet.
+type orTag struct {
+	node string
+	seq  uint64
+}
+
+// ORSet is observed-remove set. Element added concurrently with its
+// removal on another node stays in the set. Removed additions are
+// remembered forever, so set grows with every add.
+type ORSet struct {
+	// seq is the last sequence number of additions made by every node
+	seq     map[string]uint64
+	adds    map[string]map[orTag]struct{}
+	removed map[orTag]struct{}
+}
+
+func NewORSet() *ORSet {
+	return &ORSet{
+		seq:     make(map[string]uint64),
+		adds:    make(map[string]map[orTag]struct{}),
+		removed: make(map[orTag]struct{}),
+	}
+}
+
+// Add adds element to set on behalf of given node.
+func (s *ORSet) Add(node string, element []byte) {
+	s.seq[node]++
+	s.add(string(element), orTag{node: node, seq: s.seq[node]})
+}
+
+func (s *ORSet) add(element string, tag orTag) {
+	if _, ok := s.removed[tag]; ok {
+		return
+	}
+	tags, ok := s.adds[element]
+	if !ok {
+		tags = make(map[orTag]struct{})
+		s.adds[element] = tags
+	}
+	tags[tag] = struct{}{}
+}
+
+// Remove removes element from set. Only additions seen by this replica
+// are removed.
+func (s *ORSet) Remove(element []byte) {
+	for tag := range s.adds[string(element)] {
+		s.removed[tag] = struct{}{}
+	}
+	delete(s.adds, string(element))
+}
+
+// Contains reports whether element is in set.
+func (s *ORSet) Contains(element []byte) bool {
+	_, ok := s.adds[string(element)]
+	return ok
+}
+
+// Elements returns elements of set in ascending order.
+func (s *ORSet) Elements() [][]byte {
+	result := make([][]byte, 0, len(s.adds))
+	for _, element := range sortedElements(s.adds) {
+		result = append(result, []byte(element))
+	}
+
+	return result
+}
+
+// Len returns number of elements in set.
+func (s *ORSet) Len() int {
+	return len(s.adds)
+}
+
+func (s *ORSet) Merge(other Value) error {
+	o, ok := other.(*ORSet)
+	if !ok {
+		return ErrTypeMismatch
+	}
+
+	for node, seq := range o.seq {
+		if seq > s.seq[node] {
+			s.seq[node] = seq
+		}
+	}
+	for tag := range o.removed {
+		s.removed[tag] = struct{}{}
+	}
+	for element, tags := range s.adds {
+		for tag := range tags {
+			if _, ok := s.removed[tag]; ok {
+				delete(tags, tag)
+			}
+		}
+		if len(tags) == 0 {
+			delete(s.adds, element)
+		}
+	}
+	for element, tags := range o.adds {
+		for tag := range tags {
+			s.add(element, tag)
+		}
+	}
+
+	return nil
+}
+
+func (s *ORSet) Bytes() []byte {
+	b := appendUvarint([]byte{tagORSet}, uint64(len(s.seq)))
+	for _, node := range sortedNodes(s.seq) {
+		b = appendBytes(b, []byte(node))
+		b = appendUvarint(b, s.seq[node])
+	}
+
+	b = appendUvarint(b, uint64(len(s.adds)))
+	for _, element := range sortedElements(s.adds) {
+		b = appendBytes(b, []byte(element))
+		b = appendTags(b, s.adds[element])
+	}
+
+	return appendTags(b, s.removed)
+}
+
+func appendTags(b []byte, tags map[orTag]struct{}) []byte {
+	sorted := make([]orTag, 0, len(tags))
+	for tag := range tags {
+		sorted = append(sorted, tag)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].node != sorted[j].node {
+			return sorted[i].node < sorted[j].node
+		}
+		return sorted[i].seq < sorted[j].seq
+	})
+
+	b = appendUvarint(b, uint64(len(sorted)))
+	for _, tag := range sorted {
+		b = appendBytes(b, []byte(tag.node))
+		b = appendUvarint(b, tag.seq)
+	}
+
+	return b
+}
+
+func sortedNodes(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func sortedElements(m map[string]map[orTag]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, v)
+
+	return append(b, buf[:n]...)
+}
+
+func appendBytes(b, v []byte) []byte {
+	return append(appendUvarint(b, uint64(len(v))), v...)
+}
+
+// decoder reads encoded values, remembering the first error.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = ErrBadValue
+		return 0
+	}
+	d.b = d.b[n:]
+
+	return v
+}
+
+// count reads number of items, each taking at least one byte.
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.err = ErrBadValue
+		return 0
+	}
+
+	return int(n)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.count()
+	if d.err != nil {
+		return nil
+	}
+
+	v := append([]byte(nil), d.b[:n]...)
+	d.b = d.b[n:]
+
+	return v
+}
+
+func (d *decoder) gCounter() *GCounter {
+	c := NewGCounter()
+	for i, n := 0, d.count(); i < n && d.err == nil; i++ {
+		node := string(d.bytes())
+		c.counts[node] = d.uvarint()
+	}
+
+	return c
+}
+
+func (d *decoder) tags() map[orTag]struct{} {
+	tags := make(map[orTag]struct{})
+	for i, n := 0, d.count(); i < n && d.err == nil; i++ {
+		node := string(d.bytes())
+		tags[orTag{node: node, seq: d.uvarint()}] = struct{}{}
+	}
+
+	return tags
+}
+
+func (d *decoder) orSet() *ORSet {
+	s := NewORSet()
+	for i, n := 0, d.count(); i < n && d.err == nil; i++ {
+		node := string(d.bytes())
+		s.seq[node] = d.uvarint()
+	}
+	for i, n := 0, d.count(); i < n && d.err == nil; i++ {
+		element := string(d.bytes())
+		s.adds[element] = d.tags()
+	}
+	s.removed = d.tags()
+
+	return s
+}
@@ -0,0 +1,150 @@
+package kvndbcrdt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/akamensky/kvndb"
+)
+
+func TestCounters(t *testing.T) {
+	a := NewPNCounter()
+	b := NewPNCounter()
+	a.Inc("a", 5)
+	b.Inc("b", 3)
+	b.Dec("b", 1)
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Merge(a); err != nil {
+		t.Fatal(err)
+	}
+	// merging again changes nothing
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	if a.Value() != 7 || b.Value() != 7 {
+		t.Fatalf("expected both counters to be [7], but got [%d] and [%d]", a.Value(), b.Value())
+	}
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Fatal("expected converged counters to encode the same")
+	}
+
+	if err := a.Merge(NewGCounter()); err != ErrTypeMismatch {
+		t.Fatalf("expected [%v], but got [%v]", ErrTypeMismatch, err)
+	}
+}
+
+func TestLWWRegister(t *testing.T) {
+	a := NewLWWRegister()
+	b := NewLWWRegister()
+	a.Set("a", []byte("first"))
+	b.Set("b", []byte("second"))
+	// make sure write of b is later regardless of clock resolution
+	if err := b.Merge(a); err != nil {
+		t.Fatal(err)
+	}
+	b.Set("b", []byte("second"))
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	if string(a.Value()) != "second" {
+		t.Fatalf("expected [second], but got [%s]", a.Value())
+	}
+}
+
+func TestORSet(t *testing.T) {
+	a := NewORSet()
+	a.Add("a", []byte("x"))
+	a.Add("a", []byte("y"))
+
+	b := NewORSet()
+	if err := b.Merge(a); err != nil {
+		t.Fatal(err)
+	}
+	// concurrent removal and addition of the same element
+	b.Remove([]byte("x"))
+	a.Add("a", []byte("x"))
+	b.Remove([]byte("y"))
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Merge(a); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*ORSet{a, b} {
+		if !s.Contains([]byte("x")) || s.Contains([]byte("y")) || s.Len() != 1 {
+			t.Fatalf("expected set of [x], but got %q", s.Elements())
+		}
+	}
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Fatal("expected converged sets to encode the same")
+	}
+
+	v, err := Parse(a.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v.Bytes(), a.Bytes()) {
+		t.Fatal("expected parsed set to encode the same")
+	}
+	if _, err := Parse(a.Bytes()[:len(a.Bytes())-1]); err != ErrBadValue {
+		t.Fatalf("expected [%v], but got [%v]", ErrBadValue, err)
+	}
+}
+
+func TestDatastore(t *testing.T) {
+	dir := t.TempDir()
+	a := kvndb.New()
+	defer a.Close()
+	b := kvndb.New()
+	defer b.Close()
+
+	key := []byte("hits")
+	inc := func(node string) func(v Value) error {
+		return func(v Value) error {
+			v.(*GCounter).Inc(node, 1)
+			return nil
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := Update(a, key, NewGCounter(), inc("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Update(b, key, NewGCounter(), inc("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Update(b, key, NewORSet(), nil); err != ErrTypeMismatch {
+		t.Fatalf("expected [%v], but got [%v]", ErrTypeMismatch, err)
+	}
+
+	if err := a.Save(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.LoadMerge(dir, Conflict); err != nil {
+		t.Fatal(err)
+	}
+	value, err := b.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := Parse(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.(*GCounter).Value() != 4 {
+		t.Fatalf("expected [4], but got [%d]", v.(*GCounter).Value())
+	}
+
+	if err := Merge(a, key, v); err != nil {
+		t.Fatal(err)
+	}
+	value, _ = a.Get(key)
+	if v, _ := Parse(value); v.(*GCounter).Value() != 4 {
+		t.Fatalf("expected [4], but got [%d]", v.(*GCounter).Value())
+	}
+}
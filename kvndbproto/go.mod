@@ -0,0 +1,12 @@
+module github.com/akamensky/kvndb/kvndbproto
+
+go 1.18
+
+require (
+	github.com/akamensky/kvndb v0.0.0
+	google.golang.org/protobuf v1.33.0
+)
+
+require github.com/golang/snappy v0.0.4 // indirect
+
+replace github.com/akamensky/kvndb => ../
@@ -0,0 +1,37 @@
+// Package kvndbproto stores protobuf messages in kvndb datastore. It is
+// a separate module, so kvndb itself does not depend on protobuf.
+package kvndbproto
+
+import (
+	"github.com/akamensky/kvndb"
+	"google.golang.org/protobuf/proto"
+)
+
+// PutProto puts m encoded in protobuf wire format under given key.
+func PutProto(d kvndb.DB, key []byte, m proto.Message) error {
+	value, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return d.Put(key, value)
+}
+
+// GetProto decodes protobuf value of given key into m. If stored value
+// is not valid for m, *kvndb.DecodeError is returned.
+func GetProto(d kvndb.ReadOnlyDB, key []byte, m proto.Message) error {
+	value, err := d.Get(key)
+	if err != nil {
+		return err
+	}
+
+	err = proto.Unmarshal(value, m)
+	if err != nil {
+		return &kvndb.DecodeError{
+			Key: key,
+			Err: err,
+		}
+	}
+
+	return nil
+}
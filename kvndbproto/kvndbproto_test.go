@@ -0,0 +1,31 @@
+package kvndbproto
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/akamensky/kvndb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestProto(t *testing.T) {
+	d := kvndb.New()
+	defer d.Close()
+
+	if err := PutProto(d, []byte("a"), wrapperspb.String("hello")); err != nil {
+		t.Fatal(err)
+	}
+	var m wrapperspb.StringValue
+	if err := GetProto(d, []byte("a"), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.GetValue() != "hello" {
+		t.Fatalf("expected [hello], but got [%s]", m.GetValue())
+	}
+
+	_ = d.Put([]byte("bad"), []byte{0xff})
+	var de *kvndb.DecodeError
+	if err := GetProto(d, []byte("bad"), &m); !errors.As(err, &de) {
+		t.Fatalf("expected DecodeError, but got [%v]", err)
+	}
+}
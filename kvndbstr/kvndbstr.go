@@ -0,0 +1,71 @@
+// Package kvndbstr wraps kvndb datastore for use with string keys and
+// values, sparing conversions from and to []byte at every call.
+package kvndbstr
+
+import (
+	"time"
+
+	"github.com/akamensky/kvndb"
+)
+
+// DB is datastore with string keys and values. All methods behave the
+// same as methods of wrapped kvndb.DB with the same name.
+type DB struct {
+	db kvndb.DB
+}
+
+// Wrap returns string layer over given datastore.
+func Wrap(db kvndb.DB) *DB {
+	return &DB{
+		db: db,
+	}
+}
+
+// Unwrap returns wrapped datastore, e.g. to Save or Close it.
+func (s *DB) Unwrap() kvndb.DB {
+	return s.db
+}
+
+func (s *DB) Put(key, value string) error {
+	return s.db.Put([]byte(key), []byte(value))
+}
+
+func (s *DB) PutTTL(key, value string, ttl time.Duration) error {
+	return s.db.PutTTL([]byte(key), []byte(value), ttl)
+}
+
+func (s *DB) Get(key string) (string, error) {
+	value, err := s.db.Get([]byte(key))
+	if err != nil {
+		return "", err
+	}
+
+	return string(value), nil
+}
+
+func (s *DB) Has(key string) (bool, error) {
+	return s.db.Has([]byte(key))
+}
+
+func (s *DB) Delete(key string) error {
+	return s.db.Delete([]byte(key))
+}
+
+// Keys returns channel of all keys, see kvndb.DB.Keys.
+func (s *DB) Keys() (<-chan string, error) {
+	keys, err := s.db.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan string)
+
+	go func() {
+		defer close(ch)
+		for key := range keys {
+			ch <- string(key)
+		}
+	}()
+
+	return ch, nil
+}
@@ -0,0 +1,40 @@
+package kvndbstr
+
+import (
+	"testing"
+
+	"github.com/akamensky/kvndb"
+)
+
+func TestStringLayer(t *testing.T) {
+	d := Wrap(kvndb.New())
+	defer d.Unwrap().Close()
+
+	if err := d.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	value, err := d.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "1" {
+		t.Fatalf("expected [1], but got [%s]", value)
+	}
+
+	keys, err := d.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := range keys {
+		if key != "a" {
+			t.Fatalf("expected key [a], but got [%s]", key)
+		}
+	}
+
+	if err := d.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get("a"); err != kvndb.ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, but got [%v]", err)
+	}
+}
@@ -0,0 +1,324 @@
+package kvndb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"sort"
+)
+
+// OpenLazy creates datastore backed by the latest snapshot found in
+// given directory. At startup only index of keys is built, values are
+// read from snapshot on first access. Snapshot file is kept open until
+// datastore is closed or its data is replaced by Load.
+func OpenLazy(dir string, opts ...Option) (DB, error) {
+	o := newOptions(opts)
+
+	// snapshot is opened before datastore is created, so failing to
+	// open it leaves no sweeper running and no expvar published
+	e, err := openLazyEngine(dir, 0, o.lazyCache)
+	if err != nil {
+		return nil, err
+	}
+
+	d := newDbWithOptions(o)
+	// values are not read at startup, neither is their metadata
+	d.meta = nil
+	e.engine = d.data
+	d.data = e
+	d.revision = e.snap.header.revision
+
+	return d, nil
+}
+
+// OpenSnapshot opens snapshot with given id in given directory for
+// reading, without affecting any datastore using that directory. This
+// allows querying older generations of data side by side with the
+// current one. Id of 0 opens the latest snapshot. Like with OpenLazy,
+// values are read from snapshot on access, and the file is kept open
+// until returned datastore is closed.
+func OpenSnapshot(dir string, id uint, opts ...Option) (ReadOnlyDB, error) {
+	o := newOptions(opts)
+
+	e, err := openLazyEngine(dir, id, o.lazyCache)
+	if err != nil {
+		return nil, err
+	}
+
+	d := newDbWithOptions(o)
+	d.meta = nil
+	e.engine = d.data
+	d.data = e
+	d.revision = e.snap.header.revision
+
+	return &snapshotView{
+		ReadOnlyDB: d,
+	}, nil
+}
+
+// openLazyEngine opens snapshot with given id, or the latest snapshot
+// if id is 0. Caller sets engine holding modified entries.
+func openLazyEngine(dir string, id uint, cache bool) (e *lazyEngine, err error) {
+	defer func() {
+		err = wrapSnapshotError("open", dir, id, err)
+	}()
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+
+	if id == 0 {
+		id, err = getMaxSnapshotId(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		// if id == 0 there is no snapshots to load
+		if id == 0 {
+			return nil, ErrSnapshotNotFound
+		}
+	}
+
+	return newLazyEngine(nil, dir, id, cache)
+}
+
+// lazyEngine serves entries not yet modified from snapshot file, all
+// modifications go to wrapped engine.
+type lazyEngine struct {
+	engine
+	snap  *snapshotFile
+	index map[string]framePos
+	cache bool
+}
+
+func newLazyEngine(e engine, dir string, id uint, cache bool) (*lazyEngine, error) {
+	s, err := openSnapshotFile(dir, id)
+	if err != nil {
+		return nil, err
+	}
+	if s.codec != nil {
+		_ = s.Close()
+		return nil, ErrUnsupportedCodec
+	}
+
+	// snapshots with footer index do not need scanning, corruption
+	// of records is detected by chunk checksums on access
+	var index map[string]framePos
+	if s.hasIndex() {
+		index, err = s.readIndex()
+	} else {
+		index, err = scanSnapshotIndex(s, dir, id)
+	}
+	if err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+
+	return &lazyEngine{
+		engine: e,
+		snap:   s,
+		index:  index,
+		cache:  cache,
+	}, nil
+}
+
+// scanSnapshotIndex builds index of records positions and verifies
+// snapshot checksum in one pass.
+func scanSnapshotIndex(s *snapshotFile, dir string, id uint) (map[string]framePos, error) {
+	storedHash, err := readSnapshotChecksum(id, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+	fr := s.body()
+	rr := s.records(io.TeeReader(fr, hasher))
+	index := make(map[string]framePos)
+	for {
+		pos := fr.position()
+		key, err := rr.skip()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		index[string(key)] = pos
+	}
+
+	if !bytes.Equal(storedHash, hasher.Sum(nil)) {
+		return nil, ErrBadSnapshot
+	}
+
+	return index, nil
+}
+
+func (e *lazyEngine) get(key string) ([]byte, error) {
+	pos, ok := e.index[key]
+	if !ok {
+		return e.engine.get(key)
+	}
+
+	value, _, err := e.snap.readAt(key, pos)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.cache {
+		err = e.engine.put(key, value)
+		if err != nil {
+			return nil, err
+		}
+		delete(e.index, key)
+	}
+
+	return value, nil
+}
+
+func (e *lazyEngine) put(key string, value []byte) error {
+	err := e.engine.put(key, value)
+	if err != nil {
+		return err
+	}
+
+	delete(e.index, key)
+
+	return nil
+}
+
+func (e *lazyEngine) delete(key string) bool {
+	_, ok := e.index[key]
+	delete(e.index, key)
+
+	return e.engine.delete(key) || ok
+}
+
+func (e *lazyEngine) len() int {
+	return e.engine.len() + len(e.index)
+}
+
+// memSize only counts index entries of values not read yet, not their
+// keys, which are not tracked.
+func (e *lazyEngine) memSize() int64 {
+	return e.engine.memSize() + int64(len(e.index))*mapEntryOverhead
+}
+
+func (e *lazyEngine) forEach(fn func(key string, value []byte) error) error {
+	err := e.engine.forEach(fn)
+	if err != nil {
+		return err
+	}
+
+	if len(e.index) == 0 {
+		return nil
+	}
+
+	// read remaining values sequentially rather than seeking for each
+	rr := e.snap.records(e.snap.body())
+	for {
+		key, value, err := rr.next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if _, ok := e.index[string(key)]; !ok {
+			continue
+		}
+		if err := fn(string(key), value); err != nil {
+			return err
+		}
+	}
+}
+
+func (e *lazyEngine) reset() error {
+	err := e.release()
+	if err != nil {
+		return err
+	}
+
+	return e.engine.reset()
+}
+
+func (e *lazyEngine) close() error {
+	err := e.release()
+	if err != nil {
+		return err
+	}
+
+	return e.engine.close()
+}
+
+// release closes snapshot file, after that all entries are served by
+// wrapped engine.
+func (e *lazyEngine) release() error {
+	e.index = make(map[string]framePos)
+	if e.snap == nil {
+		return nil
+	}
+
+	err := e.snap.Close()
+	e.snap = nil
+
+	return err
+}
+
+func (e *lazyEngine) putReader(key string, r io.Reader, size int64) error {
+	err := putReader(e.engine, key, r, size)
+	if err != nil {
+		return err
+	}
+
+	delete(e.index, key)
+
+	return nil
+}
+
+func (e *lazyEngine) getReader(key string) (io.ReadCloser, error) {
+	if _, ok := e.index[key]; ok {
+		value, err := e.get(key)
+		if err != nil {
+			return nil, err
+		}
+		return readCloser(value), nil
+	}
+
+	return getReader(e.engine, key)
+}
+
+func (e *lazyEngine) ascend(start, end string, hasEnd bool, fn func(key string) error) error {
+	keys := make([]string, 0)
+	collect := func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}
+
+	var err error
+	if re, ok := e.engine.(rangeEngine); ok {
+		err = re.ascend(start, end, hasEnd, collect)
+	} else {
+		err = ascendSorted(e.engine, start, end, hasEnd, collect)
+	}
+	if err != nil {
+		return err
+	}
+
+	for key := range e.index {
+		if key >= start && (!hasEnd || key < end) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
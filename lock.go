@@ -0,0 +1,35 @@
+package kvndb
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	lockFileName = "LOCK"
+)
+
+// dirLock is an advisory lock of snapshot directory, held for the
+// duration of Save and Load so that several datastores, possibly in
+// different processes, never work with the same directory at once.
+type dirLock struct {
+	fd *os.File
+}
+
+func getLockFilepath(dir string) string {
+	return filepath.Join(dir, lockFileName)
+}
+
+// writePid records process holding the lock, to help operators
+// figuring out who holds it.
+func (l *dirLock) writePid() error {
+	err := l.fd.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.fd.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+
+	return err
+}
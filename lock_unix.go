@@ -0,0 +1,46 @@
+//go:build !windows
+// +build !windows
+
+package kvndb
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockDir acquires lock of given directory, ErrDirLocked if it is
+// already locked.
+func lockDir(dir string) (*dirLock, error) {
+	fd, err := os.OpenFile(getLockFilepath(dir), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(fd.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		_ = fd.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrDirLocked
+		}
+		return nil, err
+	}
+
+	l := &dirLock{fd: fd}
+	err = l.writePid()
+	if err != nil {
+		_ = l.unlock()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *dirLock) unlock() error {
+	err := syscall.Flock(int(l.fd.Fd()), syscall.LOCK_UN)
+	if err != nil {
+		_ = l.fd.Close()
+		return err
+	}
+
+	return l.fd.Close()
+}
@@ -0,0 +1,40 @@
+//go:build windows
+// +build windows
+
+package kvndb
+
+import (
+	"os"
+)
+
+// lockDir acquires lock of given directory, ErrDirLocked if it is
+// already locked. Lock file is created exclusively and removed on
+// unlock, so lock file left by crashed process must be removed
+// manually.
+func lockDir(dir string) (*dirLock, error) {
+	fd, err := os.OpenFile(getLockFilepath(dir), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, ErrDirLocked
+		}
+		return nil, err
+	}
+
+	l := &dirLock{fd: fd}
+	err = l.writePid()
+	if err != nil {
+		_ = l.unlock()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *dirLock) unlock() error {
+	err := l.fd.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(l.fd.Name())
+}
@@ -0,0 +1,235 @@
+package kvndb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Manager manages lifecycle of several named datastores, each stored
+// in its own subdirectory of base directory.
+type Manager struct {
+	dir      string
+	hist     uint
+	interval time.Duration
+	opts     []Option
+	logger   Logger
+	dirMode  os.FileMode
+	dbs      map[string]DB
+	// saved holds revisions of datastores as of their last save
+	saved    map[string]uint64
+	mutex    *sync.Mutex
+	stop     chan struct{}
+	wg       *sync.WaitGroup
+	lastErr  error
+	isClosed bool
+}
+
+// NewManager creates manager of datastores rooted in given base
+// directory. Every datastore is created with given options and keeps
+// `hist` number of previous snapshots. If `interval` is not zero all
+// datastores are saved periodically.
+func NewManager(dir string, hist uint, interval time.Duration, opts ...Option) (*Manager, error) {
+	if hist > maxHistory {
+		return nil, ErrTooMuchHistory
+	}
+
+	o := newOptions(opts)
+	err := os.MkdirAll(dir, o.dirPerm())
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		dir:      dir,
+		hist:     hist,
+		interval: interval,
+		opts:     opts,
+		logger:   o.logger,
+		dirMode:  o.dirPerm(),
+		dbs:      make(map[string]DB),
+		saved:    make(map[string]uint64),
+		mutex:    &sync.Mutex{},
+		stop:     make(chan struct{}),
+		wg:       &sync.WaitGroup{},
+	}
+
+	m.startAutosave()
+
+	return m, nil
+}
+
+// DB returns datastore with given name, opening it and loading its
+// latest snapshot on first call.
+func (m *Manager) DB(name string) (DB, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.isClosed {
+		return nil, ErrAlreadyClosed
+	}
+
+	if d, ok := m.dbs[name]; ok {
+		return d, nil
+	}
+
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, ErrBadName
+	}
+
+	dir := m.dbDir(name)
+	err := os.MkdirAll(dir, m.dirMode)
+	if err != nil {
+		return nil, err
+	}
+
+	d := New(m.opts...)
+	err = d.Load(dir)
+	if err != nil && !errors.Is(err, ErrSnapshotNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		// loaded data is already saved
+		m.saved[name] = d.Revision()
+	}
+
+	m.dbs[name] = d
+
+	return d, nil
+}
+
+// Names returns sorted names of all opened datastores.
+func (m *Manager) Names() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	names := make([]string, 0, len(m.dbs))
+	for name := range m.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Save saves snapshots of all opened datastores, returning first
+// encountered error.
+func (m *Manager) Save() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.isClosed {
+		return ErrAlreadyClosed
+	}
+
+	return m.saveAll()
+}
+
+// Err returns error of the last failed autosave, if any.
+func (m *Manager) Err() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.lastErr
+}
+
+// Close stops autosave, saves and closes all opened datastores. After
+// this no operations can be done. If saving fails, error is returned
+// and manager stays open along with all datastores and autosave, so no
+// unsaved data is lost and Close can be retried.
+func (m *Manager) Close() error {
+	m.mutex.Lock()
+	if m.isClosed {
+		m.mutex.Unlock()
+		return ErrAlreadyClosed
+	}
+	m.isClosed = true
+	close(m.stop)
+	m.mutex.Unlock()
+
+	// autosave may be waiting for mutex, so it must be released first
+	m.wg.Wait()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	err := m.saveAll()
+	if err != nil {
+		m.isClosed = false
+		m.stop = make(chan struct{})
+		m.startAutosave()
+		return err
+	}
+
+	for _, d := range m.dbs {
+		closeErr := d.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	m.dbs = nil
+
+	return err
+}
+
+func (m *Manager) dbDir(name string) string {
+	return filepath.Join(m.dir, name)
+}
+
+func (m *Manager) saveAll() error {
+	var result error
+	for name, d := range m.dbs {
+		rev, ok := m.saved[name]
+		if ok && !d.ModifiedSince(rev) {
+			continue
+		}
+		rev = d.Revision()
+		err := d.Save(m.dbDir(name), m.hist)
+		if err == nil || err == ErrNotModified {
+			m.saved[name] = rev
+			continue
+		}
+		if result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
+
+// startAutosave starts saving all datastores every interval, unless
+// interval is zero.
+func (m *Manager) startAutosave() {
+	if m.interval > 0 {
+		m.wg.Add(1)
+		go m.autosave()
+	}
+}
+
+func (m *Manager) autosave() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.mutex.Lock()
+			if !m.isClosed {
+				m.logger.Debugf("kvndb: autosaving %d datastores in %s", len(m.dbs), m.dir)
+				if err := m.saveAll(); err != nil {
+					m.logger.Errorf("kvndb: autosave in %s failed: %v", m.dir, err)
+					m.lastErr = err
+				}
+			}
+			m.mutex.Unlock()
+		}
+	}
+}
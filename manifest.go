@@ -0,0 +1,151 @@
+package kvndb
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// manifestName is name of file in snapshot directory describing all
+// snapshots in it, written when datastore is created with WithManifest.
+const manifestName = "MANIFEST"
+
+func getManifestFilepath(dir string) string {
+	return filepath.Join(dir, manifestName)
+}
+
+// SnapshotEntry describes snapshot as returned by ListSnapshots.
+type SnapshotEntry struct {
+	// Id is id of snapshot.
+	Id uint `json:"id"`
+	// Bytes is size of snapshot file.
+	Bytes int64 `json:"bytes"`
+	// Checksum is checksum of snapshot.
+	Checksum []byte `json:"checksum"`
+	// Entries is number of entries in snapshot, 0 if not known.
+	Entries uint64 `json:"entries"`
+	// Revision is revision of data in snapshot, 0 if not known.
+	Revision uint64 `json:"revision"`
+	// Created is time snapshot was written.
+	Created time.Time `json:"created"`
+}
+
+// ListSnapshots returns snapshots in given directory, oldest first. If
+// directory has manifest written by datastore created with
+// WithManifest, snapshots are described by it, otherwise directory is
+// scanned and only details stored alongside snapshots are returned.
+func ListSnapshots(dir string) ([]SnapshotEntry, error) {
+	entries, err := readManifest(dir)
+	if err == nil {
+		return entries, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	ids, err := getAllSnapshotIds(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries = make([]SnapshotEntry, 0, len(ids))
+	for _, id := range ids {
+		fi, err := os.Stat(getSnapshotFilepath(dir, id))
+		if err != nil {
+			return nil, err
+		}
+		checksum, err := readSnapshotChecksum(id, dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		entries = append(entries, SnapshotEntry{
+			Id:       id,
+			Bytes:    fi.Size(),
+			Checksum: checksum,
+			Created:  fi.ModTime(),
+		})
+	}
+
+	return entries, nil
+}
+
+func readManifest(dir string) ([]SnapshotEntry, error) {
+	data, err := os.ReadFile(getManifestFilepath(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]SnapshotEntry, 0)
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, ErrBadManifest
+	}
+
+	return entries, nil
+}
+
+// updateManifest adds snapshot saved with report to manifest of given
+// directory and drops snapshots no longer in it. Manifest is replaced
+// atomically.
+func updateManifest(dir string, report *Report, o *options) error {
+	entries, err := readManifest(dir)
+	if err != nil && !os.IsNotExist(err) {
+		o.logger.Warnf("kvndb: rewriting manifest of %s: %v", dir, err)
+	}
+
+	ids, err := getAllSnapshotIds(dir)
+	if err != nil {
+		return err
+	}
+	kept := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		kept[id] = true
+	}
+
+	result := make([]SnapshotEntry, 0, len(ids))
+	for _, e := range entries {
+		if kept[e.Id] && e.Id != report.Id {
+			result = append(result, e)
+		}
+	}
+	result = append(result, SnapshotEntry{
+		Id:       report.Id,
+		Bytes:    report.Bytes,
+		Checksum: report.Checksum,
+		Entries:  report.Entries,
+		Revision: report.Revision,
+		Created:  report.Started,
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := getManifestFilepath(dir)
+	tmp := path + ".tmp"
+	err = writeFile(tmp, data, o.filePerm(0666), o.sync)
+	if err != nil {
+		return err
+	}
+	err = o.setFileAttrs(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+
+	if o.sync {
+		return syncDir(dir)
+	}
+
+	return nil
+}
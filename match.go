@@ -0,0 +1,110 @@
+package kvndb
+
+import (
+	"unicode/utf8"
+)
+
+// globMatch reports whether key matches glob pattern. `*` matches any
+// sequence of characters, `?` matches exactly one character and `\`
+// escapes the character following it. Characters are UTF-8 encoded
+// runes, bytes which are not valid UTF-8 are matched one by one.
+func globMatch(pattern, key string) bool {
+	// position to backtrack to after the last `*`, -1 if none
+	starPattern, starKey := -1, -1
+	p, k := 0, 0
+	for k < len(key) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starPattern, starKey = p, k
+				p++
+				continue
+			case '?':
+				_, width := utf8.DecodeRuneInString(key[k:])
+				p++
+				k += width
+				continue
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == key[k] {
+					p += 2
+					k++
+					continue
+				}
+			default:
+				if pattern[p] == key[k] {
+					p++
+					k++
+					continue
+				}
+			}
+		}
+
+		// mismatch, let the last `*` consume one more character
+		if starPattern < 0 {
+			return false
+		}
+		_, width := utf8.DecodeRuneInString(key[starKey:])
+		starKey += width
+		p, k = starPattern+1, starKey
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
+
+// globPrefix returns literal prefix of glob pattern, which all
+// matching keys start with.
+func globPrefix(pattern string) string {
+	prefix := make([]byte, 0, len(pattern))
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?':
+			return string(prefix)
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+		}
+		prefix = append(prefix, pattern[i])
+	}
+
+	return string(prefix)
+}
+
+// prefixEnd returns the smallest key greater than all keys starting
+// with given prefix, false if there is no such key.
+func prefixEnd(prefix string) (string, bool) {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1]), true
+		}
+	}
+
+	return "", false
+}
+
+// forEachMatching calls fn for every key for which match returns true.
+// All matching keys must start with given prefix, with ordered index
+// only such keys are visited.
+func forEachMatching(e engine, prefix string, match func(key string) bool, fn func(key string) error) error {
+	visit := func(key string) error {
+		if !match(key) {
+			return nil
+		}
+		return fn(key)
+	}
+
+	if re, ok := e.(rangeEngine); ok {
+		end, hasEnd := prefixEnd(prefix)
+		return re.ascend(prefix, end, hasEnd, visit)
+	}
+
+	return e.forEach(func(key string, _ []byte) error {
+		return visit(key)
+	})
+}
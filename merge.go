@@ -0,0 +1,154 @@
+package kvndb
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// MergeSnapshots combines the latest snapshots in given input
+// directories, e.g. written by independent writers, into new snapshot
+// in out directory, returning its id. Values of keys existing in more
+// than one input are resolved by conflict in order of inputs, nil
+// conflict keeps value of the last input. Like DiffSnapshots, only keys
+// are held in memory, values are read from input snapshots as they are
+// written. Out may be one of inputs, existing snapshots are kept.
+func MergeSnapshots(out string, conflict ConflictPolicy, inputs ...string) (id uint, err error) {
+	defer func() {
+		err = wrapSnapshotError("merge", out, id, err)
+	}()
+
+	if conflict == nil {
+		conflict = PreferSnapshot
+	}
+
+	snaps := make([]*lazyEngine, 0, len(inputs))
+	defer func() {
+		for _, s := range snaps {
+			_ = s.close()
+		}
+	}()
+	for _, dir := range inputs {
+		s, err := openLatestLazy(dir)
+		if err != nil {
+			return 0, wrapSnapshotError("merge", dir, 0, err)
+		}
+		snaps = append(snaps, s)
+	}
+
+	lock, err := lockDir(out)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.unlock()
+
+	maxId, err := getMaxSnapshotId(out)
+	if err != nil {
+		return 0, err
+	}
+	id = maxId + 1
+
+	tmpPath := filepath.Join(out, fmt.Sprintf("%s.%d.tmp", generateSnapshotName(id), os.Getpid()))
+	err = writeRecordsSnapshot(tmpPath, &mergeDecoder{
+		snaps:    snaps,
+		keys:     mergeKeySet(snaps),
+		conflict: conflict,
+	})
+	if err == nil {
+		err = os.Rename(tmpPath, getSnapshotFilepath(out, id))
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return id, err
+	}
+
+	_, err = writeSnapshotChecksum(id, out, 0600, false)
+	if err != nil {
+		removeSnapshotFiles(out, id)
+		return id, err
+	}
+
+	return id, nil
+}
+
+// openLatestLazy opens the latest snapshot in given directory for
+// reading, holding directory lock while doing so.
+func openLatestLazy(dir string) (*lazyEngine, error) {
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+
+	id, err := getMaxSnapshotId(dir)
+	if err != nil {
+		return nil, err
+	}
+	if id == 0 {
+		return nil, ErrSnapshotNotFound
+	}
+
+	return newLazyEngine(newMapEngine(), dir, id, false)
+}
+
+// mergeKeySet returns sorted keys of all snapshots.
+func mergeKeySet(snaps []*lazyEngine) []string {
+	seen := make(map[string]struct{})
+	keys := make([]string, 0)
+	for _, s := range snaps {
+		for key := range s.index {
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// mergeDecoder is RecordDecoder returning records of merged snapshots
+// in ascending key order.
+type mergeDecoder struct {
+	snaps    []*lazyEngine
+	keys     []string
+	conflict ConflictPolicy
+}
+
+func (m *mergeDecoder) Decode() ([]byte, []byte, error) {
+	for len(m.keys) > 0 {
+		key := m.keys[0]
+		m.keys = m.keys[1:]
+
+		var value []byte
+		found := false
+		for _, s := range m.snaps {
+			pos, ok := s.index[key]
+			if !ok {
+				continue
+			}
+			v, _, err := s.snap.readAt(key, pos)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !found {
+				value, found = v, true
+				continue
+			}
+			value, err = m.conflict([]byte(key), value, v)
+			if err != nil {
+				return nil, nil, err
+			}
+			// conflict deleted entry
+			found = value != nil
+		}
+		if found {
+			return []byte(key), value, nil
+		}
+	}
+
+	return nil, nil, io.EOF
+}
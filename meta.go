@@ -0,0 +1,158 @@
+package kvndb
+
+import (
+	"time"
+)
+
+// Meta describes entry metadata tracked when datastore is created
+// with WithEntryMeta.
+type Meta struct {
+	// Created is time entry was first put.
+	Created time.Time
+	// Updated is time entry was last put. Times are taken from hybrid
+	// clock, which never goes back and is advanced past times of
+	// entries loaded from snapshots and patches, so every later write
+	// has later time, even if wall clocks of nodes differ.
+	Updated time.Time
+	// Revision is revision of datastore, as returned by DB.Revision,
+	// made by the last put of entry. Revisions of entry don't repeat
+	// when it is deleted and created again, so stale revision doesn't
+	// match in PutIfRevision. Entries loaded from snapshot, by Load,
+	// Restore and the like, get back revisions they had when it was
+	// saved, so revisions seen before loading older snapshot may match
+	// again.
+	Revision uint64
+}
+
+// entryMetaSize is size of entry metadata stored with every snapshot
+// record: created and updated time as unix nanoseconds and revision.
+const entryMetaSize = 24
+
+type entryMeta struct {
+	created  int64
+	updated  int64
+	revision uint64
+}
+
+func (m entryMeta) bytes() []byte {
+	result := make([]byte, 0, entryMetaSize)
+	result = append(result, uint64ToBytes(uint64(m.created))...)
+	result = append(result, uint64ToBytes(uint64(m.updated))...)
+	result = append(result, uint64ToBytes(m.revision)...)
+
+	return result
+}
+
+// parseEntryMeta reads entry metadata stored in snapshot. Fields it
+// does not have are left zero, fields it does not know are ignored.
+func parseEntryMeta(b []byte) entryMeta {
+	m := entryMeta{}
+	if len(b) >= 8 {
+		m.created = int64(bytesToUint64(b[0:8]))
+	}
+	if len(b) >= 16 {
+		m.updated = int64(bytesToUint64(b[8:16]))
+	}
+	if len(b) >= 24 {
+		m.revision = bytesToUint64(b[16:24])
+	}
+
+	return m
+}
+
+func (m entryMeta) export() Meta {
+	return Meta{
+		Created:  time.Unix(0, m.created),
+		Updated:  time.Unix(0, m.updated),
+		Revision: m.revision,
+	}
+}
+
+// metaTable holds metadata of all entries. All methods are called with
+// datastore mutex held and are no-op on nil table, which is used when
+// metadata is not tracked.
+type metaTable struct {
+	entries map[string]entryMeta
+	// clock is the latest time issued or observed.
+	clock int64
+	// wall returns current wall time.
+	wall func() time.Time
+}
+
+func newMetaTable(wall func() time.Time) *metaTable {
+	return &metaTable{
+		entries: make(map[string]entryMeta),
+		wall:    wall,
+	}
+}
+
+// touch records entry for given key was put now, making given revision
+// of datastore.
+func (t *metaTable) touch(key string, rev uint64) {
+	if t == nil {
+		return
+	}
+
+	now := t.now()
+	m, ok := t.entries[key]
+	if !ok {
+		m.created = now
+	}
+	m.updated = now
+	m.revision = rev
+	t.entries[key] = m
+}
+
+// now returns current time of hybrid clock, wall time unless it is not
+// later than time issued or observed before.
+func (t *metaTable) now() int64 {
+	now := t.wall().UnixNano()
+	if now <= t.clock {
+		now = t.clock + 1
+	}
+	t.clock = now
+
+	return now
+}
+
+// observe advances hybrid clock to time of write made elsewhere.
+func (t *metaTable) observe(ts int64) {
+	if ts > t.clock {
+		t.clock = ts
+	}
+}
+
+func (t *metaTable) get(key string) (entryMeta, bool) {
+	if t == nil {
+		return entryMeta{}, false
+	}
+
+	m, ok := t.entries[key]
+
+	return m, ok
+}
+
+func (t *metaTable) set(key string, m entryMeta) {
+	if t == nil {
+		return
+	}
+
+	t.observe(m.updated)
+	t.entries[key] = m
+}
+
+func (t *metaTable) remove(key string) {
+	if t == nil {
+		return
+	}
+
+	delete(t.entries, key)
+}
+
+func (t *metaTable) reset() {
+	if t == nil {
+		return
+	}
+
+	t.entries = make(map[string]entryMeta)
+}
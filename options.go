@@ -0,0 +1,537 @@
+package kvndb
+
+import (
+	"crypto/cipher"
+	"os"
+	"time"
+)
+
+// Option configures datastore created by New.
+type Option func(o *options)
+
+type options struct {
+	arena             bool
+	arenaChunkSize    int
+	valueLogDir       string
+	valueLogThreshold int
+	orderedIndex      bool
+	lazyCache         bool
+	snapshotIndex     bool
+	sync              bool
+	dsync             bool
+	directIO          bool
+	stagingDir        string
+	fileMode          os.FileMode
+	dirMode           os.FileMode
+	fileOwner         bool
+	fileUid           int
+	fileGid           int
+	trash             bool
+	trashGrace        time.Duration
+	manifest          bool
+	verifyAfterSave   bool
+	logger            Logger
+	keyLocks          bool
+	keyLockStripes    int
+	valueCipher       cipher.AEAD
+	entryMeta         bool
+	checksumChunkSize int
+	finalSaveDir      string
+	finalSaveHist     uint
+	expvarName        string
+	sweepInterval     time.Duration
+	sweepLimit        int
+	events            bool
+	eventsBuffer      int
+	eventsPolicy      DropPolicy
+	codec             Codec
+	accessLogFactor   int
+	accessDecay       time.Duration
+	saveBuffer        bool
+	skipUnchanged     bool
+	changeLogSize     int
+	lastWriteWins     bool
+	rateOps           float64
+	rateBytes         float64
+	unsafeGet         bool
+	unsafePut         bool
+	clock             func() time.Time
+	memoryLimit       int64
+}
+
+// WithArena makes datastore keep values packed in large manually
+// managed chunks of chunkSize bytes instead of individual heap
+// allocations. This keeps GC scan times low when storing huge number
+// of small values, at the cost of Get copying value out of the arena.
+// chunkSize of 0 selects default of 4 MiB, bigger than 4 GiB is capped
+// just below 4 GiB, as values are addressed by 32-bit offsets.
+func WithArena(chunkSize int) Option {
+	return func(o *options) {
+		o.arena = true
+		o.arenaChunkSize = chunkSize
+	}
+}
+
+// WithValueLog makes datastore keep values of at least threshold bytes
+// in a value log file created in dir, with only a pointer to them kept
+// in memory. Get of such values reads them from disk. Value log is not
+// a persistence mechanism, it is removed when datastore is closed or
+// data is replaced by Load.
+func WithValueLog(dir string, threshold int) Option {
+	return func(o *options) {
+		o.valueLogDir = dir
+		o.valueLogThreshold = threshold
+	}
+}
+
+// WithOrderedIndex makes datastore maintain sorted index of keys on
+// every mutation, so Range does not need to sort all keys at query
+// time. This makes mutations slower and uses more memory.
+func WithOrderedIndex() Option {
+	return func(o *options) {
+		o.orderedIndex = true
+	}
+}
+
+// WithLazyCache makes datastore opened by OpenLazy keep values in
+// memory once they were read from snapshot. Without it every Get of
+// not modified entry reads the snapshot file.
+func WithLazyCache() Option {
+	return func(o *options) {
+		o.lazyCache = true
+	}
+}
+
+// WithSnapshotIndex makes Save append index of record positions to
+// snapshot, so individual records can be read without scanning the
+// whole file. OpenLazy uses it to skip building index at startup.
+func WithSnapshotIndex() Option {
+	return func(o *options) {
+		o.snapshotIndex = true
+	}
+}
+
+// WithSync makes Save flush snapshot, its checksum and directory entry
+// to stable storage before returning, so saved snapshot survives power
+// loss. This makes Save considerably slower.
+func WithSync() Option {
+	return func(o *options) {
+		o.sync = true
+	}
+}
+
+// WithDSync makes Save open snapshot with O_DSYNC, so every write
+// returns only after its data reaches stable storage. Outside of Linux
+// O_SYNC is used instead. Unlike WithSync it does not cover checksum
+// file and directory entry.
+func WithDSync() Option {
+	return func(o *options) {
+		o.dsync = true
+	}
+}
+
+// WithDirectIO makes Save write snapshot with O_DIRECT, bypassing page
+// cache, so large snapshots do not evict pages other processes depend
+// on. It is only supported on Linux and ignored elsewhere. Filesystems
+// which do not support direct I/O are written through page cache.
+func WithDirectIO() Option {
+	return func(o *options) {
+		o.directIO = true
+	}
+}
+
+// WithStagingDir makes Save write snapshots to temporary files in given
+// directory before renaming them into snapshot directory, instead of
+// using snapshot directory itself. Directory must exist and be on the
+// same filesystem as snapshot directory, otherwise Save fails with
+// ErrStagingDir.
+func WithStagingDir(dir string) Option {
+	return func(o *options) {
+		o.stagingDir = dir
+	}
+}
+
+// WithFileMode sets permissions of snapshot files and their checksum
+// files written by Save, regardless of umask. By default snapshots are
+// created with 0666 and checksums with 0600, both subject to umask.
+func WithFileMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.fileMode = mode.Perm()
+	}
+}
+
+// WithDirMode sets permissions of directories created by Manager,
+// 0755 by default. It is subject to umask.
+func WithDirMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.dirMode = mode.Perm()
+	}
+}
+
+// WithFileOwner makes Save change owner of snapshot files and their
+// checksum files to given uid and gid, -1 leaves either unchanged.
+// Changing owner usually requires privileges and is not supported on
+// Windows, in both cases Save fails.
+func WithFileOwner(uid, gid int) Option {
+	return func(o *options) {
+		o.fileOwner = true
+		o.fileUid = uid
+		o.fileGid = gid
+	}
+}
+
+// WithTrash makes Save move snapshots rotated out by `hist` to .trash
+// subdirectory of snapshot directory instead of removing them, so
+// misconfigured retention does not destroy the only good snapshot.
+// Files are removed from trash by Save after given grace period. To
+// restore snapshot, move its files back to snapshot directory.
+func WithTrash(grace time.Duration) Option {
+	return func(o *options) {
+		o.trash = true
+		o.trashGrace = grace
+	}
+}
+
+// WithManifest makes Save maintain MANIFEST file in snapshot directory,
+// describing every snapshot in it, so ListSnapshots does not need to
+// inspect snapshot files.
+func WithManifest() Option {
+	return func(o *options) {
+		o.manifest = true
+	}
+}
+
+// WithVerifyAfterSave makes Save read back every snapshot it writes,
+// verifying its structure, checksum and number of records before older
+// snapshots are removed. Snapshot failing verification is removed and
+// Save returns ErrBadSnapshot, so previous snapshot stays the latest.
+func WithVerifyAfterSave() Option {
+	return func(o *options) {
+		o.verifyAfterSave = true
+	}
+}
+
+// WithLogger sets logger used to report what datastore is doing.
+// By default nothing is logged.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithKeyLocks makes writers of the same key additionally serialize on
+// one of `stripes` per-key locks. This lets DoWithKey run its function
+// without blocking operations on other keys. Operations replacing data
+// of any key, such as Load, LoadMerge, ApplyPatch, Restore and Reset,
+// take all stripes, so they wait for running DoWithKey functions.
+// stripes of 0 selects default of 256.
+func WithKeyLocks(stripes int) Option {
+	return func(o *options) {
+		o.keyLocks = true
+		o.keyLockStripes = stripes
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		logger: nopLogger{},
+		clock:  time.Now,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// WithValueEncryption makes datastore keep values encrypted with
+// AES-GCM using given key, decrypting them on every read. This keeps
+// stored secrets out of core dumps and swap, at the cost of extra CPU
+// and memory per entry. Values spilled to value log are encrypted too,
+// snapshots are not. key must be 16, 24 or 32 bytes long, otherwise
+// WithValueEncryption panics.
+func WithValueEncryption(key []byte) Option {
+	aead, err := newValueCipher(key)
+	if err != nil {
+		panic("kvndb: invalid value encryption key: " + err.Error())
+	}
+
+	return func(o *options) {
+		o.valueCipher = aead
+	}
+}
+
+// WithEntryMeta makes datastore track creation and last update time
+// and revision of every entry, available through GetMeta and persisted
+// in snapshots. This costs extra memory per entry. Snapshots saved with
+// metadata can not be read by versions of kvndb before it was added.
+// OpenLazy does not track metadata.
+func WithEntryMeta() Option {
+	return func(o *options) {
+		o.entryMeta = true
+	}
+}
+
+// WithChunkChecksums makes Save additionally store checksums of every
+// chunkSize bytes of snapshot file, so VerifySnapshot can tell which
+// parts of a large snapshot are corrupted. chunkSize of 0 selects
+// default of 4 MiB.
+func WithChunkChecksums(chunkSize int) Option {
+	return func(o *options) {
+		if chunkSize <= 0 {
+			chunkSize = defaultChecksumChunkSize
+		}
+		o.checksumChunkSize = chunkSize
+	}
+}
+
+// WithFinalSave makes Close save a snapshot into dir, keeping `hist`
+// previous snapshots, before closing datastore. If that Save fails,
+// Close returns its error and datastore stays open, so no data is
+// lost and Close can be retried.
+func WithFinalSave(dir string, hist uint) Option {
+	return func(o *options) {
+		o.finalSaveDir = dir
+		o.finalSaveHist = hist
+	}
+}
+
+// WithExpvar makes datastore publish its size, operation counters,
+// total time spent waiting for datastore lock and last saved snapshot
+// via expvar under given name. Like expvar.Publish, creating another
+// datastore with the same name panics, so this option should not be
+// used with Manager.
+func WithExpvar(name string) Option {
+	return func(o *options) {
+		o.expvarName = name
+	}
+}
+
+// WithSweeper makes datastore check up to limit entries put with TTL
+// every interval in background, removing expired ones, until it is
+// closed. Bounding work per run keeps datastore responsive, but with
+// many entries expiring at once it takes several runs to remove all of
+// them. limit of 0 selects default of 100.
+func WithSweeper(interval time.Duration, limit int) Option {
+	return func(o *options) {
+		if limit <= 0 {
+			limit = 100
+		}
+		o.sweepInterval = interval
+		o.sweepLimit = limit
+	}
+}
+
+// WithEvents enables channel of notifications returned by Events,
+// buffering up to buffer events. Policy decides what happens when
+// receiver does not keep up and buffer is full.
+func WithEvents(buffer int, policy DropPolicy) Option {
+	return func(o *options) {
+		o.events = true
+		o.eventsBuffer = buffer
+		o.eventsPolicy = policy
+	}
+}
+
+// WithCodec makes Save encode snapshot records with codec registered
+// under given name instead of the default binary format. It panics if
+// there is no such codec.
+func WithCodec(name string) Option {
+	c, err := lookupCodec(name)
+	if err != nil {
+		panic("kvndb: unknown codec " + name)
+	}
+
+	return func(o *options) {
+		o.codec = c
+	}
+}
+
+// WithAccessFrequency makes datastore keep approximate access counter
+// of every entry, costing a few bytes per entry. Counters are 8-bit
+// and logarithmic, the higher logFactor, the more accesses it takes to
+// increment counter. Counters decrease by one for every decay period
+// entry is not accessed. logFactor of 0 selects default of 10, decay
+// of 0 selects default of 1 minute.
+func WithAccessFrequency(logFactor int, decay time.Duration) Option {
+	return func(o *options) {
+		if logFactor <= 0 {
+			logFactor = defaultAccessLogFactor
+		}
+		if decay <= 0 {
+			decay = defaultAccessDecay
+		}
+		o.accessLogFactor = logFactor
+		o.accessDecay = decay
+	}
+}
+
+// WithSaveBuffer makes Put, TryPut and Delete made while Save is in
+// progress return right away, buffering writes until Save is done.
+// Get sees buffered writes, all other operations still wait for Save.
+// Errors of buffered writes, e.g. when value is too large, are only
+// logged.
+func WithSaveBuffer() Option {
+	return func(o *options) {
+		o.saveBuffer = true
+	}
+}
+
+// WithSkipUnchanged makes Save return ErrNotModified without writing
+// snapshot when data was not modified since the last snapshot saved to
+// the same directory.
+func WithSkipUnchanged() Option {
+	return func(o *options) {
+		o.skipUnchanged = true
+	}
+}
+
+// WithUnsafeGet makes Get, TryGet, WaitFor, KeysAndValues,
+// KeysAndValuesBatched, Range, FindValues, iterators and CopyTo hand
+// out stored values themselves rather than their copies, as GetUnsafe
+// does. This saves allocation per value, but callers MUST NOT modify
+// returned values, as that silently changes stored data.
+func WithUnsafeGet() Option {
+	return func(o *options) {
+		o.unsafeGet = true
+	}
+}
+
+// WithUnsafePut makes Put and other writes keep values given by caller
+// rather than their copies, as PutUnsafe does. This saves allocation
+// per write, but callers MUST NOT modify values after writing them, as
+// that silently changes stored data.
+func WithUnsafePut() Option {
+	return func(o *options) {
+		o.unsafePut = true
+	}
+}
+
+// WithRateLimit limits mutations, such as Put, Delete and DoWithKey, to
+// opsPerSec operations and bytesPerSec bytes of keys and values per
+// second, so one heavy writer can't starve others sharing datastore.
+// Limits allow bursts of one second worth of mutations, but at least
+// one, so fractional rates such as 0.5 allow one mutation every two
+// seconds. Mutation bigger than byte burst is allowed when no bytes are
+// owed, and is paid off before the next one. Mutations over the limit
+// fail with ErrRateLimited instead of waiting, so callers decide
+// whether to retry. Limit of 0 means unlimited. Load and other
+// operations replacing data are not limited.
+func WithRateLimit(opsPerSec, bytesPerSec float64) Option {
+	return func(o *options) {
+		o.rateOps = opsPerSec
+		o.rateBytes = bytesPerSec
+	}
+}
+
+// WithClock makes datastore use now instead of time.Now as current time
+// for TTL expiry, entry metadata, access frequency decay and rate
+// limits, so tests can control time. Sweeper still runs on wall clock
+// interval, but expires entries by time returned by now.
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		if now != nil {
+			o.clock = now
+		}
+	}
+}
+
+// WithMemoryLimit makes writes, such as Put, PutReader and DoWithKey,
+// fail with ErrMemoryLimit when memory held by entries would exceed
+// limit bytes.
+// Memory is approximate, see Stats, and update of entry is checked as
+// if its new value was added in full. Delete is never limited, neither
+// are Load and other operations replacing data. Limit of 0 means
+// unlimited.
+func WithMemoryLimit(limit int64) Option {
+	return func(o *options) {
+		o.memoryLimit = limit
+	}
+}
+
+// WithChangeLog makes datastore retain up to size most recent changes,
+// so replication followers can catch up from revision of snapshot they
+// loaded, see ReplicationHandler. Changes made before Load, LoadMerge,
+// Reset or PutReader are dropped, as they can not be replicated one by
+// one.
+func WithChangeLog(size int) Option {
+	return func(o *options) {
+		o.changeLogSize = size
+	}
+}
+
+// WithLastWriteWins makes LoadMerge and ApplyPatch resolve conflicts by
+// keeping the write with the latest update time, so nodes merging the
+// same snapshots and patches in any order end up with the same data.
+// Writes with the same time are ordered by value. Deleted entries leave
+// no trace, so put older than deletion brings entry back. It implies
+// WithEntryMeta. Conflict policy passed to LoadMerge is only used for
+// records without metadata.
+func WithLastWriteWins() Option {
+	return func(o *options) {
+		o.entryMeta = true
+		o.lastWriteWins = true
+	}
+}
+
+// filePerm returns permissions to create snapshot file with, def
+// unless set by WithFileMode.
+func (o *options) filePerm(def os.FileMode) os.FileMode {
+	if o.fileMode != 0 {
+		return o.fileMode
+	}
+
+	return def
+}
+
+// dirPerm returns permissions to create directories with.
+func (o *options) dirPerm() os.FileMode {
+	if o.dirMode != 0 {
+		return o.dirMode
+	}
+
+	return 0755
+}
+
+// setFileAttrs sets permissions and owner of given files as set by
+// WithFileMode and WithFileOwner. Permissions files were created with
+// are reduced by umask, so they are set again.
+func (o *options) setFileAttrs(paths ...string) error {
+	for _, path := range paths {
+		if o.fileMode != 0 {
+			err := os.Chmod(path, o.fileMode)
+			if err != nil {
+				return err
+			}
+		}
+		if o.fileOwner {
+			err := os.Chown(path, o.fileUid, o.fileGid)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (o *options) newEngine() engine {
+	var e engine = newMapEngine()
+	if o.arena {
+		e = newArenaEngine(o.arenaChunkSize)
+	}
+
+	if o.valueLogDir != "" {
+		e = newHybridEngine(e, o.valueLogDir, o.valueLogThreshold, o.logger)
+	}
+
+	if o.valueCipher != nil {
+		e = newSealedEngine(e, o.valueCipher)
+	}
+
+	if o.orderedIndex {
+		e = newOrderedEngine(e)
+	}
+
+	return e
+}
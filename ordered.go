@@ -0,0 +1,203 @@
+package kvndb
+
+import (
+	"io"
+	"math/rand"
+	"sort"
+)
+
+const (
+	skiplistMaxLevel = 32
+	skiplistP        = 0.25
+)
+
+type skiplistNode struct {
+	key  string
+	next []*skiplistNode
+}
+
+// skiplist is a sorted set of keys.
+type skiplist struct {
+	head  *skiplistNode
+	level int
+	rnd   *rand.Rand
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  &skiplistNode{next: make([]*skiplistNode, skiplistMaxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+func (s *skiplist) randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && s.rnd.Float64() < skiplistP {
+		level++
+	}
+
+	return level
+}
+
+// findPrev returns for every level the last node with key less than
+// given key.
+func (s *skiplist) findPrev(key string) []*skiplistNode {
+	prev := make([]*skiplistNode, skiplistMaxLevel)
+	node := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		prev[i] = node
+	}
+
+	return prev
+}
+
+func (s *skiplist) insert(key string) {
+	prev := s.findPrev(key)
+	if next := prev[0].next[0]; next != nil && next.key == key {
+		return
+	}
+
+	level := s.randomLevel()
+	if level > s.level {
+		for i := s.level; i < level; i++ {
+			prev[i] = s.head
+		}
+		s.level = level
+	}
+
+	node := &skiplistNode{
+		key:  key,
+		next: make([]*skiplistNode, level),
+	}
+	for i := 0; i < level; i++ {
+		node.next[i] = prev[i].next[i]
+		prev[i].next[i] = node
+	}
+}
+
+func (s *skiplist) remove(key string) {
+	prev := s.findPrev(key)
+	node := prev[0].next[0]
+	if node == nil || node.key != key {
+		return
+	}
+
+	for i := 0; i < len(node.next); i++ {
+		prev[i].next[i] = node.next[i]
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+}
+
+// seek returns first node with key greater or equal to given key.
+func (s *skiplist) seek(key string) *skiplistNode {
+	return s.findPrev(key)[0].next[0]
+}
+
+// rangeEngine is implemented by engines able to iterate keys in
+// ascending order without sorting them first.
+type rangeEngine interface {
+	// ascend calls fn for every key in range [start, end) in
+	// ascending order, stopping at first error returned by fn.
+	// If hasEnd is false range has no upper bound.
+	ascend(start, end string, hasEnd bool, fn func(key string) error) error
+}
+
+// ascendSorted is a fallback for engines not implementing rangeEngine,
+// it collects and sorts all keys in range before calling fn.
+func ascendSorted(e engine, start, end string, hasEnd bool, fn func(key string) error) error {
+	keys := make([]string, 0)
+	err := e.forEach(func(key string, _ []byte) error {
+		if key >= start && (!hasEnd || key < end) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// orderedEngine maintains sorted index of keys of wrapped engine
+// on every mutation.
+type orderedEngine struct {
+	engine
+	index *skiplist
+}
+
+func newOrderedEngine(e engine) *orderedEngine {
+	return &orderedEngine{
+		engine: e,
+		index:  newSkiplist(),
+	}
+}
+
+func (e *orderedEngine) put(key string, value []byte) error {
+	err := e.engine.put(key, value)
+	if err != nil {
+		return err
+	}
+
+	e.index.insert(key)
+
+	return nil
+}
+
+func (e *orderedEngine) delete(key string) bool {
+	e.index.remove(key)
+
+	return e.engine.delete(key)
+}
+
+func (e *orderedEngine) reset() error {
+	e.index = newSkiplist()
+	return e.engine.reset()
+}
+
+func (e *orderedEngine) close() error {
+	e.index = nil
+	return e.engine.close()
+}
+
+func (e *orderedEngine) putReader(key string, r io.Reader, size int64) error {
+	err := putReader(e.engine, key, r, size)
+	if err != nil {
+		return err
+	}
+
+	e.index.insert(key)
+
+	return nil
+}
+
+func (e *orderedEngine) getReader(key string) (io.ReadCloser, error) {
+	return getReader(e.engine, key)
+}
+
+func (e *orderedEngine) ascend(start, end string, hasEnd bool, fn func(key string) error) error {
+	for node := e.index.seek(start); node != nil; node = node.next[0] {
+		if hasEnd && node.key >= end {
+			break
+		}
+		if err := fn(node.key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
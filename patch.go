@@ -0,0 +1,153 @@
+package kvndb
+
+import (
+	"bufio"
+	"io"
+)
+
+const (
+	patchMagic   = "KPATCH"
+	patchVersion = 2
+
+	patchOpPut    byte = 1
+	patchOpDelete byte = 2
+	// patchOpEnd marks the end of patch, so truncated patch is not
+	// mistaken for a complete one.
+	patchOpEnd byte = 3
+
+	// patchMetaSize is size of record metadata: operation and time.
+	patchMetaSize = 9
+)
+
+// patchMeta returns record metadata of given operation made at given
+// time.
+func patchMeta(op byte, ts int64) []byte {
+	return append([]byte{op}, uint64ToBytes(uint64(ts))...)
+}
+
+// WritePatch writes differences between snapshots `a` (older) and `b`
+// (newer) in given directory to w. Applying the patch with ApplyPatch
+// to datastore holding data of snapshot `a` makes it hold data of
+// snapshot `b`. Id of 0 means the latest snapshot.
+//
+// Every operation carries time of the write, update time of entry in
+// snapshot `b` for entries saved with metadata, and modification time
+// of snapshot `b` for deletions, so datastores created with
+// WithLastWriteWins only apply operations later than their own writes.
+//
+// Layout: magic (6 bytes), version (1 byte), followed by snappy framed
+// records in the same format as snapshot records, each carrying one
+// byte of operation followed by time of the write as unix nanoseconds
+// (8 bytes, 0 if unknown) as its metadata. Version 1 records carry only
+// the operation.
+func WritePatch(w io.Writer, dir string, a, b uint) (err error) {
+	defer func() {
+		err = wrapSnapshotError("patch", dir, 0, err)
+	}()
+
+	older, newer, err := openSnapshotPair(dir, a, b)
+	if err != nil {
+		return err
+	}
+	defer older.close()
+	defer newer.close()
+
+	fi, err := newer.snap.fd.Stat()
+	if err != nil {
+		return err
+	}
+	deleted := fi.ModTime().UnixNano()
+
+	bw := bufio.NewWriter(w)
+	_, err = bw.Write(append([]byte(patchMagic), patchVersion))
+	if err != nil {
+		return err
+	}
+
+	fw := newFrameWriter(bw, int64(len(patchMagic)+1))
+	err = diffKeys(diffKeySet(older, newer), older, newer, func(entry DiffEntry, meta []byte) error {
+		var record []byte
+		var err error
+		if entry.Kind == DiffRemoved {
+			record, err = packRecord(entry.Key, nil, patchMeta(patchOpDelete, deleted))
+		} else {
+			record, err = packRecord(entry.Key, entry.New, patchMeta(patchOpPut, parseEntryMeta(meta).updated))
+		}
+		if err != nil {
+			return err
+		}
+		_, err = fw.Write(record)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	end, _ := packRecord(nil, nil, patchMeta(patchOpEnd, 0))
+	_, err = fw.Write(end)
+	if err != nil {
+		return err
+	}
+
+	err = fw.Flush()
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+type patchOp struct {
+	op    byte
+	key   []byte
+	value []byte
+	// ts is time of the write, 0 if unknown.
+	ts int64
+}
+
+// readPatch reads all operations of patch written by WritePatch.
+func readPatch(r io.Reader) ([]patchOp, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(patchMagic)+1)
+	err := readFull(br, header)
+	if err != nil {
+		return nil, err
+	}
+	version := header[len(patchMagic)]
+	if string(header[:len(patchMagic)]) != patchMagic || version == 0 || version > patchVersion {
+		return nil, ErrBadPatch
+	}
+
+	rr := newRecordReader(newFrameReader(br, int64(len(header))))
+	rr.metaSize = 1
+	if version >= 2 {
+		rr.metaSize = patchMetaSize
+	}
+	ops := make([]patchOp, 0)
+	for {
+		key, value, err := rr.next()
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		op := rr.meta[0]
+		switch op {
+		case patchOpPut, patchOpDelete:
+			ops = append(ops, patchOp{
+				op:    op,
+				key:   append([]byte{}, key...),
+				value: value,
+			})
+			if version >= 2 {
+				ops[len(ops)-1].ts = int64(bytesToUint64(rr.meta[1:]))
+			}
+		case patchOpEnd:
+			return ops, nil
+		default:
+			return nil, ErrBadPatch
+		}
+	}
+}
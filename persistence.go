@@ -1,92 +1,365 @@
 package kvndb
 
 import (
-	"encoding/hex"
+	"bytes"
+	"crypto/sha256"
 	"io"
+	"os"
+	"strings"
+	"time"
 )
 
-func save(d *db, dir string, hist uint) error {
+func save(d *db, dir string, hist uint) (err error) {
+	var id uint
+	defer func() {
+		err = wrapSnapshotError("save", dir, id, err)
+	}()
+
+	report := newReport(dir, time.Now())
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
 	maxId, err := getMaxSnapshotId(dir)
 	if err != nil {
 		return err
 	}
 
-	id := maxId + 1
+	id = maxId + 1
+	d.opts.logger.Debugf("kvndb: saving snapshot %d to %s", id, dir)
+
+	err = writeSnapshot(d, dir, id)
+	if err != nil {
+		return err
+	}
 
-	fd, err := getSnapshotFDForWriting(id, dir)
+	// write checksum
+	checksum, err := writeSnapshotChecksum(id, dir, d.opts.filePerm(0600), d.opts.sync)
 	if err != nil {
 		return err
 	}
+	files := []string{getSnapshotFilepath(dir, id), getChecksumFilepath(dir, id)}
 
-	for keyString, value := range d.data {
-		key, err := hex.DecodeString(keyString)
+	if d.opts.checksumChunkSize > 0 {
+		err = writeChunkChecksums(id, dir, int64(d.opts.checksumChunkSize), d.opts.filePerm(0600), d.opts.sync)
 		if err != nil {
 			return err
 		}
-		_, err = fd.Write(packBytes(key, value))
+		files = append(files, getChunksFilepath(dir, id))
+	}
+
+	err = d.opts.setFileAttrs(files...)
+	if err != nil {
+		return err
+	}
+
+	if d.opts.sync {
+		err = syncDir(dir)
 		if err != nil {
 			return err
 		}
 	}
 
-	err = fd.Flush()
-	if err != nil {
-		return err
+	if d.opts.verifyAfterSave {
+		err = verifySavedSnapshot(dir, id, checksum, uint64(d.data.len()))
+		if err != nil {
+			d.opts.logger.Errorf("kvndb: removing snapshot %d from %s, it failed verification: %v", id, dir, err)
+			removeSnapshotFiles(dir, id)
+			return err
+		}
 	}
-	err = fd.Close()
+
+	err = cleanupSnapshotsUpTo(dir, hist, d.onRetire, d.opts)
 	if err != nil {
 		return err
 	}
 
-	// write checksum
-	err = writeSnapshotChecksum(id, dir)
+	err = report.finish(id, uint64(d.data.len()), checksum)
 	if err != nil {
 		return err
 	}
+	report.Revision = d.revision
 
-	err = cleanupSnapshotsUpTo(dir, hist)
+	if d.opts.manifest {
+		err = updateManifest(dir, report, d.opts)
+		if err != nil {
+			return err
+		}
+	}
+	d.lastSave = report
+	d.savedRevision = d.revision
+
+	d.opts.logger.Infof("kvndb: saved snapshot %d with %d entries to %s in %s", id, report.Entries, dir, report.Duration)
+
+	return nil
+}
+
+// verifySavedSnapshot reads back all records of snapshot with given id,
+// verifying its frames, checksum and number of records.
+func verifySavedSnapshot(dir string, id uint, checksum []byte, entries uint64) error {
+	s, err := openSnapshotFile(dir, id)
 	if err != nil {
 		return err
 	}
+	defer s.Close()
+
+	hasher := sha256.New()
+	rr := s.records(io.TeeReader(s.body(), hasher))
+	var n uint64
+	for {
+		_, _, err = rr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		n++
+	}
+
+	if n != entries || !bytes.Equal(checksum, hasher.Sum(nil)) {
+		return ErrBadSnapshot
+	}
 
 	return nil
 }
 
-func load(d *db, dir string) error {
-	// reset data regardless
-	d.data = make(map[string][]byte)
+// removeSnapshotFiles removes snapshot with given id and its checksum
+// files, ignoring errors.
+func removeSnapshotFiles(dir string, id uint) {
+	for _, path := range []string{getSnapshotFilepath(dir, id), getChecksumFilepath(dir, id), getChunksFilepath(dir, id)} {
+		_ = os.Remove(path)
+	}
+}
+
+// load replaces data with records of the latest snapshot, which keys
+// start with given prefix. Empty prefix loads all records. If conflict
+// is not nil, records are merged into current data instead, with
+// conflict resolving records of existing keys.
+func load(d *db, dir string, prefix []byte, conflict ConflictPolicy) (err error) {
+	var id uint
+	defer func() {
+		err = wrapSnapshotError("load", dir, id, err)
+	}()
 
-	id, err := getMaxSnapshotId(dir)
+	report := newReport(dir, time.Now())
+	d.modified()
+	d.changes.reset()
+
+	// reset data regardless, unless merging
+	if conflict == nil {
+		err = d.data.reset()
+		if err != nil {
+			return err
+		}
+		d.meta.reset()
+		d.access.reset()
+		d.ttl.reset()
+	}
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	id, err = getMaxSnapshotId(dir)
 	if err != nil {
 		return err
 	}
 
 	// if id == 0 there is no snapshots to load
 	if id == 0 {
+		d.opts.logger.Warnf("kvndb: no snapshots to load in %s", dir)
 		return ErrSnapshotNotFound
 	}
 
-	// verify snapshot checksum
-	err = verifySnapshotChecksum(id, dir)
+	d.opts.logger.Debugf("kvndb: loading snapshot %d from %s", id, dir)
+
+	s, err := openSnapshotFile(dir, id)
 	if err != nil {
 		return err
 	}
+	defer s.Close()
+
+	// with footer index only matching records need to be read,
+	// corruption of them is detected by chunk checksums
+	if len(prefix) > 0 && s.hasIndex() {
+		err = loadIndexed(d, s, prefix, conflict)
+	} else {
+		err = loadScan(d, s, dir, id, prefix, conflict)
+	}
+	if err != nil {
+		return err
+	}
+
+	checksum, err := readSnapshotChecksum(id, dir)
+	if err != nil {
+		return err
+	}
+
+	err = report.finish(id, uint64(d.data.len()), checksum)
+	if err != nil {
+		return err
+	}
+	d.loadRevision(report, s.header.revision)
+	d.lastLoad = report
+
+	d.opts.logger.Infof("kvndb: loaded snapshot %d with %d entries from %s in %s", id, report.Entries, dir, report.Duration)
 
-	fd, err := getSnapshotFDForReading(id, dir)
+	return nil
+}
+
+func loadScan(d *db, s *snapshotFile, dir string, id uint, prefix []byte, conflict ConflictPolicy) error {
+
+	// verify snapshot checksum
+	err := verifySnapshotChecksum(id, dir)
 	if err != nil {
 		return err
 	}
 
+	rr := s.records(s.body())
 	for true {
-		key, value, err := readNext(fd)
+		key, value, err := rr.next()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
 			return err
 		}
-		d.data[hex.EncodeToString(key)] = value
+		if !bytes.HasPrefix(key, prefix) {
+			continue
+		}
+		err = loadRecord(d, string(key), value, rr.meta, conflict)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func loadIndexed(d *db, s *snapshotFile, prefix []byte, conflict ConflictPolicy) error {
+	index, err := s.readIndex()
+	if err != nil {
+		return err
+	}
+
+	for key, pos := range index {
+		if !strings.HasPrefix(key, string(prefix)) {
+			continue
+		}
+		value, meta, err := s.readAt(key, pos)
+		if err != nil {
+			return err
+		}
+		err = loadRecord(d, key, value, meta, conflict)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadRecord puts loaded record into datastore. If conflict is not nil
+// and key already exists, value is resolved by it instead.
+func loadRecord(d *db, key string, value, meta []byte, conflict ConflictPolicy) error {
+	if conflict != nil {
+		current, err := d.data.get(key)
+		if err == nil && d.opts.lastWriteWins && meta != nil {
+			return mergeLatest(d, key, current, value, parseEntryMeta(meta))
+		}
+		if err == nil {
+			return mergeRecord(d, key, current, value, conflict)
+		}
+		if err != ErrKeyNotFound {
+			return err
+		}
+	}
+
+	err := d.data.put(key, value)
+	if err != nil {
+		return err
+	}
+	d.ttl.remove(key)
+	loadMeta(d, key, meta)
+
+	return nil
+}
+
+func mergeRecord(d *db, key string, current, value []byte, conflict ConflictPolicy) error {
+	resolved, err := conflict([]byte(key), current, value)
+	if err != nil {
+		return err
 	}
 
+	if resolved == nil {
+		d.data.delete(key)
+		d.meta.remove(key)
+		d.access.remove(key)
+		d.ttl.remove(key)
+		return nil
+	}
+	if bytes.Equal(resolved, current) {
+		return nil
+	}
+
+	err = d.data.put(key, resolved)
+	if err != nil {
+		return err
+	}
+	d.ttl.remove(key)
+	d.meta.touch(key, d.revision)
+
 	return nil
 }
+
+// mergeLatest keeps loaded record if it was written later than current
+// value of the same key.
+func mergeLatest(d *db, key string, current, value []byte, meta entryMeta) error {
+	m, _ := d.meta.get(key)
+	if !laterWrite(meta.updated, value, m.updated, current) {
+		return nil
+	}
+
+	err := d.data.put(key, value)
+	if err != nil {
+		return err
+	}
+	d.ttl.remove(key)
+	d.meta.set(key, meta)
+
+	return nil
+}
+
+// laterWrite reports whether write of value at time ts wins over write
+// of current value at time currentTs. Writes made at the same time are
+// ordered by value, so all nodes pick the same one.
+func laterWrite(ts int64, value []byte, currentTs int64, current []byte) bool {
+	if ts != currentTs {
+		return ts > currentTs
+	}
+
+	return bytes.Compare(value, current) > 0
+}
+
+// loadMeta sets metadata of loaded entry to one stored in snapshot,
+// or treats entry as created now if snapshot has none.
+func loadMeta(d *db, key string, meta []byte) {
+	if meta == nil {
+		d.meta.touch(key, d.revision)
+		return
+	}
+
+	m := parseEntryMeta(meta)
+	// snapshots written before entry revisions were taken from
+	// datastore revision may carry revisions above it
+	if m.revision > d.revision {
+		d.revision = m.revision
+	}
+	d.meta.set(key, m)
+}
@@ -0,0 +1,126 @@
+package kvndb
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket allows rate units per second, with burst of one second
+// worth of units, but at least one unit, so rates below one per second
+// still allow something. Rate of 0 means unlimited.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) tokenBucket {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+
+	return tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// give returns n units taken before.
+func (b *tokenBucket) give(n float64) {
+	b.tokens += n
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// rateLimiter limits rate of mutations in operations and bytes per
+// second, all methods are no-op on nil limiter.
+type rateLimiter struct {
+	mutex sync.Mutex
+	ops   tokenBucket
+	bytes tokenBucket
+	now   func() time.Time
+}
+
+func newRateLimiter(opsPerSec, bytesPerSec float64, now func() time.Time) *rateLimiter {
+	start := now()
+
+	return &rateLimiter{
+		ops:   newTokenBucket(opsPerSec, start),
+		bytes: newTokenBucket(bytesPerSec, start),
+		now:   now,
+	}
+}
+
+// allow takes one operation of n bytes from limiter, ErrRateLimited if
+// there are not enough tokens. Operation bigger than byte burst is
+// allowed when bucket is not in debt, and leaves it in debt for the
+// excess, so large values are slowed down rather than rejected forever.
+func (l *rateLimiter) allow(n int) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	l.ops.refill(now)
+	l.bytes.refill(now)
+	if l.ops.rate > 0 && l.ops.tokens < 1 {
+		return ErrRateLimited
+	}
+	if l.bytes.rate > 0 && l.bytes.tokens <= 0 {
+		return ErrRateLimited
+	}
+
+	if l.ops.rate > 0 {
+		l.ops.tokens--
+	}
+	if l.bytes.rate > 0 {
+		l.bytes.tokens -= float64(n)
+	}
+
+	return nil
+}
+
+// refund returns tokens taken by allow for operation of n bytes which
+// was not done after all.
+func (l *rateLimiter) refund(n int) {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.ops.rate > 0 {
+		l.ops.give(1)
+	}
+	if l.bytes.rate > 0 {
+		l.bytes.give(float64(n))
+	}
+}
+
+// allowWrite checks rate limit for mutation of n bytes, counting
+// rejected ones.
+func (d *db) allowWrite(n int) error {
+	err := d.limiter.allow(n)
+	if err != nil {
+		d.stats.countRateLimited()
+	}
+
+	return err
+}
@@ -0,0 +1,131 @@
+package kvndb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"io"
+)
+
+// SnapshotIterator iterates over records of a snapshot without loading
+// them into a datastore.
+type SnapshotIterator interface {
+	// Next advances iterator to the next record. It returns false
+	// when there are no more records or an error occurred.
+	Next() bool
+
+	// Key returns key of the current record. It is only valid until
+	// the next call to Next.
+	Key() []byte
+
+	// Value returns value of the current record.
+	Value() []byte
+
+	// Err returns error which stopped iteration, if any. Checksum of
+	// snapshot is verified once all records are read, so mismatch is
+	// only reported after the last record.
+	Err() error
+
+	// Close releases snapshot file. It MUST be called when done with
+	// iterator.
+	Close() error
+}
+
+// ReadSnapshot returns iterator over records of snapshot with given
+// id in given directory. Id of 0 reads the latest snapshot.
+func ReadSnapshot(dir string, id uint) (it SnapshotIterator, err error) {
+	defer func() {
+		err = wrapSnapshotError("read", dir, id, err)
+	}()
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+
+	if id == 0 {
+		id, err = getMaxSnapshotId(dir)
+		if err != nil {
+			return nil, err
+		}
+		if id == 0 {
+			return nil, ErrSnapshotNotFound
+		}
+	}
+
+	checksum, err := readSnapshotChecksum(id, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := openSnapshotFile(dir, id)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+
+	return &snapshotIterator{
+		dir:      dir,
+		id:       id,
+		snap:     s,
+		rr:       s.records(io.TeeReader(s.body(), hasher)),
+		hasher:   hasher,
+		checksum: checksum,
+	}, nil
+}
+
+type snapshotIterator struct {
+	dir      string
+	id       uint
+	snap     *snapshotFile
+	rr       *recordReader
+	hasher   hash.Hash
+	checksum []byte
+	key      []byte
+	value    []byte
+	err      error
+	done     bool
+}
+
+func (it *snapshotIterator) Next() bool {
+	if it.done {
+		return false
+	}
+
+	key, value, err := it.rr.next()
+	if err != nil {
+		it.done = true
+		it.key = nil
+		it.value = nil
+		if err != io.EOF {
+			it.err = wrapSnapshotError("read", it.dir, it.id, err)
+		} else if !bytes.Equal(it.checksum, it.hasher.Sum(nil)) {
+			it.err = wrapSnapshotError("read", it.dir, it.id, ErrBadSnapshot)
+		}
+		return false
+	}
+
+	it.key = key
+	it.value = value
+
+	return true
+}
+
+func (it *snapshotIterator) Key() []byte {
+	return it.key
+}
+
+func (it *snapshotIterator) Value() []byte {
+	return it.value
+}
+
+func (it *snapshotIterator) Err() error {
+	return it.err
+}
+
+func (it *snapshotIterator) Close() error {
+	it.done = true
+	return it.snap.Close()
+}
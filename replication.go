@@ -0,0 +1,203 @@
+package kvndb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// changesPath is URL path changes are streamed at.
+const changesPath = "/changes"
+
+// change is JSON representation of Event streamed to followers.
+type change struct {
+	Kind     string `json:"kind"`
+	Key      []byte `json:"key"`
+	Value    []byte `json:"value,omitempty"`
+	Revision uint64 `json:"revision"`
+}
+
+// ServeReplication serves the latest snapshot in given directory and
+// changes of given datastore over HTTP on given listener, for Follow.
+// It blocks until listener fails, like http.Serve.
+func ServeReplication(l net.Listener, d DB, dir string) error {
+	return http.Serve(l, ReplicationHandler(d, dir))
+}
+
+// ReplicationHandler returns HTTP handler serving the latest snapshot in
+// given directory, like SnapshotHandler, and streaming changes of given
+// datastore made after revision of that snapshot, for Follow. Datastore
+// must be created by New with WithChangeLog and save its snapshots to
+// dir, otherwise followers can not catch up. It panics if datastore was
+// not created by New.
+func ReplicationHandler(d DB, dir string) http.Handler {
+	leader, ok := d.(*db)
+	if !ok {
+		panic("kvndb: ReplicationHandler requires datastore created by New")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(snapshotPath, SnapshotHandler(dir))
+	mux.HandleFunc(changesPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		from, err := strconv.ParseUint(r.URL.Query().Get("from"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid revision", http.StatusBadRequest)
+			return
+		}
+
+		backlog, ch, ok, err := leader.subscribeChanges(from)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if !ok {
+			http.Error(w, ErrChangesTruncated.Error(), http.StatusGone)
+			return
+		}
+		defer leader.unsubscribeChanges(ch)
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+		enc := json.NewEncoder(w)
+		send := func(ev Event) bool {
+			err := enc.Encode(change{
+				Kind:     ev.Kind.String(),
+				Key:      ev.Key,
+				Value:    ev.Value,
+				Revision: ev.Revision,
+			})
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return err == nil
+		}
+
+		for _, ev := range backlog {
+			if !send(ev) {
+				return
+			}
+		}
+		for {
+			select {
+			case ev, ok := <-ch:
+				// closed when follower can not catch up anymore
+				if !ok || !send(ev) {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+
+	return mux
+}
+
+// subscribeChanges returns retained changes made after given revision
+// and channel receiving following ones, false if some of them are not
+// retained.
+func (d *db) subscribeChanges(from uint64) ([]Event, <-chan Event, bool, error) {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return nil, nil, false, ErrAlreadyClosed
+	}
+
+	backlog, ch, ok := d.changes.subscribe(from, d.revision)
+
+	return backlog, ch, ok, nil
+}
+
+func (d *db) unsubscribeChanges(ch <-chan Event) {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	d.changes.unsubscribe(ch)
+}
+
+// Follow makes given datastore a follower of datastore served by
+// ServeReplication at given address, host:port or URL. It fetches the
+// latest snapshot into given directory, loads it and then applies
+// changes made after revision of that snapshot as they happen, until
+// ctx is done. Changes are applied in order and without gaps, if that
+// is not possible, because follower fell too far behind or data of
+// leader was replaced, Follow returns ErrChangesTruncated and should be
+// called again to start over from a new snapshot.
+func Follow(ctx context.Context, addr, dir string, d DB) error {
+	_, err := FetchSnapshot(addr, dir)
+	if err != nil {
+		return err
+	}
+	err = d.Load(dir)
+	if err != nil {
+		return err
+	}
+	rev := d.LastLoad().Revision
+
+	url := addr
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		url = "http://" + addr
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+changesPath+"?from="+strconv.FormatUint(rev, 10), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return ErrChangesTruncated
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("server responded %s: %s", resp.Status, body)
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var c change
+		err = dec.Decode(&c)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// leader closes stream when follower can not catch up anymore
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrChangesTruncated
+		}
+		if err != nil {
+			return err
+		}
+		if c.Revision != rev+1 {
+			return ErrChangesTruncated
+		}
+
+		switch c.Kind {
+		case EventPut.String():
+			err = d.Put(c.Key, c.Value)
+		case EventDelete.String(), EventExpire.String():
+			err = d.Delete(c.Key)
+		default:
+			err = fmt.Errorf("unknown change kind %q", c.Kind)
+		}
+		if err != nil {
+			return err
+		}
+		rev = c.Revision
+	}
+}
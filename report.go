@@ -0,0 +1,175 @@
+package kvndb
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Report describes result of successful Save or Load.
+type Report struct {
+	// Id is id of written or read snapshot.
+	Id uint
+	// Dir is snapshot directory.
+	Dir string
+	// Entries is number of entries written or read.
+	Entries uint64
+	// Bytes is size of snapshot file.
+	Bytes int64
+	// Checksum is checksum of snapshot.
+	Checksum []byte
+	// Revision is revision of data in snapshot, 0 for snapshots
+	// written before it was recorded.
+	Revision uint64
+	// Started is time operation started at.
+	Started time.Time
+	// Duration is how long operation took, including waiting for
+	// directory lock.
+	Duration time.Duration
+}
+
+// newReport returns report of operation started at given time.
+func newReport(dir string, started time.Time) *Report {
+	return &Report{
+		Dir:     dir,
+		Started: started,
+	}
+}
+
+// finish fills in details of snapshot file and duration.
+func (r *Report) finish(id uint, entries uint64, checksum []byte) error {
+	fi, err := os.Stat(getSnapshotFilepath(r.Dir, id))
+	if err != nil {
+		return err
+	}
+
+	r.Id = id
+	r.Entries = entries
+	r.Bytes = fi.Size()
+	r.Checksum = checksum
+	r.Duration = time.Since(r.Started)
+
+	return nil
+}
+
+// copy returns copy of report safe to be handed out, nil if there is
+// no report.
+func (r *Report) copy() *Report {
+	if r == nil {
+		return nil
+	}
+
+	c := *r
+	c.Checksum = append([]byte(nil), r.Checksum...)
+
+	return &c
+}
+
+// SnapshotInfo describes snapshot written by Save, as passed to hook
+// registered with AfterSave, or removed by it, as passed to hook
+// registered with OnRetire, or inspected by InspectSnapshot. Format
+// details are only filled in by InspectSnapshot.
+type SnapshotInfo struct {
+	// Id is id of snapshot.
+	Id uint
+	// Dir is snapshot directory.
+	Dir string
+	// Path is path of snapshot file.
+	Path string
+	// ChecksumPath is path of file with snapshot checksum.
+	ChecksumPath string
+	// Checksum is checksum of snapshot.
+	Checksum []byte
+	// Entries is number of entries in snapshot, 0 for retired
+	// snapshots and inspected snapshots without footer index.
+	Entries uint64
+	// Bytes is size of snapshot file.
+	Bytes int64
+	// Version is snapshot format version, 0 for snapshots written
+	// before header was introduced. Records of all versions are
+	// compressed with snappy, snapshots are never encrypted.
+	Version uint8
+	// Codec is name of codec records are encoded with, empty for
+	// native records.
+	Codec string
+	// HasIndex reports whether snapshot has footer index.
+	HasIndex bool
+	// HasMeta reports whether records carry entry metadata.
+	HasMeta bool
+	// Revision is revision of data in snapshot, 0 if not recorded.
+	Revision uint64
+}
+
+// InspectSnapshot describes snapshot file at given path from its
+// header, footer index and checksum file, without reading records.
+// Checksum is nil if there is no checksum file next to snapshot, and Id
+// is 0 if file is not named like snapshot.
+func InspectSnapshot(path string) (info SnapshotInfo, err error) {
+	defer func() {
+		err = wrapSnapshotError("inspect", filepath.Dir(path), info.Id, err)
+	}()
+
+	info.Path = path
+	info.Dir = filepath.Dir(path)
+	if isSnapshotName(filepath.Base(path)) {
+		info.Id = parseSnapshotName(filepath.Base(path))
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return info, err
+	}
+	defer fd.Close()
+
+	fi, err := fd.Stat()
+	if err != nil {
+		return info, err
+	}
+	header, _, err := readSnapshotHeader(fd, fi.Size())
+	if err != nil {
+		return info, err
+	}
+
+	info.Bytes = fi.Size()
+	info.Version = header.version
+	info.Codec = header.codec
+	info.HasIndex = header.flags&snapshotFlagIndex != 0
+	info.HasMeta = header.hasMeta()
+	info.Revision = header.revision
+
+	if info.HasIndex {
+		s, err := newSnapshotFile(fd)
+		if err != nil {
+			return info, err
+		}
+		index, err := s.readIndex()
+		if err != nil {
+			return info, err
+		}
+		info.Entries = uint64(len(index))
+	}
+
+	if info.Id > 0 {
+		info.ChecksumPath = getChecksumFilepath(info.Dir, info.Id)
+		info.Checksum, err = readSnapshotChecksum(info.Id, info.Dir)
+		if os.IsNotExist(err) {
+			info.ChecksumPath = ""
+			err = nil
+		}
+	}
+
+	return info, err
+}
+
+// snapshotInfo returns description of snapshot saved with report.
+func (r *Report) snapshotInfo() SnapshotInfo {
+	return SnapshotInfo{
+		Id:           r.Id,
+		Dir:          r.Dir,
+		Path:         getSnapshotFilepath(r.Dir, r.Id),
+		ChecksumPath: getChecksumFilepath(r.Dir, r.Id),
+		Checksum:     append([]byte(nil), r.Checksum...),
+		Entries:      r.Entries,
+		Bytes:        r.Bytes,
+	}
+}
@@ -0,0 +1,212 @@
+package kvndb
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+func (d *db) Restore(r io.Reader) error {
+	d.keyLocks.lockAll()
+	defer d.keyLocks.unlockAll()
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return ErrAlreadyClosed
+	}
+
+	err := restore(d, r)
+	d.setLoadErr(err)
+	if err != nil {
+		d.opts.logger.Errorf("kvndb: failed to restore data: %v", err)
+	}
+
+	return err
+}
+
+// restore replaces data with records of snapshot or backup archive read
+// from r. If reading fails, data is reset.
+func restore(d *db, r io.Reader) error {
+	report := newReport("", time.Now())
+	d.modified()
+	d.changes.reset()
+
+	err := resetData(d, nil)
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(2)
+	// gzip magic of archive written by Backup
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		var checksum []byte
+		found := false
+		err = readBackup(br, func(name string, r io.Reader) error {
+			var err error
+			switch {
+			case strings.HasSuffix(name, ".sha256"):
+				checksum, err = io.ReadAll(io.LimitReader(r, 1024))
+			case isSnapshotName(name):
+				if checksum == nil || found {
+					return ErrBadBackup
+				}
+				found = true
+				err = restoreSnapshot(d, r, checksum, report)
+			}
+			return err
+		})
+		if err == nil && !found {
+			err = ErrBadBackup
+		}
+	} else {
+		err = restoreSnapshot(d, br, nil, report)
+	}
+	if err != nil {
+		return resetData(d, err)
+	}
+
+	report.Entries = uint64(d.data.len())
+	report.Duration = time.Since(report.Started)
+	d.lastLoad = report
+
+	d.opts.logger.Infof("kvndb: restored %d entries in %s", report.Entries, report.Duration)
+
+	return nil
+}
+
+// restoreSnapshot puts records of snapshot read from r into datastore,
+// verifying them against given checksum unless it is nil. Snapshots
+// with footer index are staged in temporary file, as the end of their
+// records is only known from the end of snapshot.
+func restoreSnapshot(d *db, r io.Reader, checksum []byte, report *Report) error {
+	cr := &countingReader{r: r}
+	br := bufio.NewReader(cr)
+	header, headerBytes, err := readStreamHeader(br)
+	if err != nil {
+		return err
+	}
+
+	s := &snapshotFile{
+		header:    header,
+		bodyStart: int64(len(headerBytes)),
+	}
+	fr := newFrameReader(br, s.bodyStart)
+	if s.hasIndex() {
+		fd, err := stageSnapshot(headerBytes, br)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(fd.Name())
+		defer fd.Close()
+
+		s, err = newSnapshotFile(fd)
+		if err != nil {
+			return err
+		}
+		fr = s.body()
+	} else if header.hasCodec() {
+		s.codec, err = lookupCodec(header.codec)
+		if err != nil {
+			return err
+		}
+	}
+
+	hasher := sha256.New()
+	rr := s.records(io.TeeReader(fr, hasher))
+	for {
+		key, value, err := rr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		err = d.data.put(string(key), value)
+		if err != nil {
+			return err
+		}
+		loadMeta(d, string(key), rr.meta)
+	}
+
+	if checksum != nil && !bytes.Equal(checksum, hasher.Sum(nil)) {
+		return ErrBadSnapshot
+	}
+
+	report.Bytes = cr.n
+	report.Checksum = hasher.Sum(nil)
+	d.loadRevision(report, header.revision)
+
+	return nil
+}
+
+// readStreamHeader reads snapshot header from br, returning it along
+// with its bytes.
+func readStreamHeader(br *bufio.Reader) (*snapshotHeader, []byte, error) {
+	prefix, _ := br.Peek(len(snapshotMagic) + 3)
+	// snapshots written before header was introduced start with body
+	if len(prefix) == len(snapshotMagic)+3 && prefix[0] != frameChunkStreamId {
+		var err error
+		prefix, err = br.Peek(len(prefix) + int(binary.LittleEndian.Uint16(prefix[len(snapshotMagic)+1:])))
+		if errors.Is(err, bufio.ErrBufferFull) || err == io.EOF {
+			return nil, nil, ErrBadSnapshot
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	header, size, err := readSnapshotHeader(bytes.NewReader(prefix), int64(len(prefix)))
+	if err != nil {
+		return nil, nil, err
+	}
+	headerBytes := append([]byte(nil), prefix[:size]...)
+	_, err = br.Discard(int(size))
+
+	return header, headerBytes, err
+}
+
+// stageSnapshot writes snapshot with given header and body read from r
+// to temporary file, returning it opened for reading.
+func stageSnapshot(header []byte, r io.Reader) (*os.File, error) {
+	fd, err := os.CreateTemp("", "kvndb-restore-")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fd.Write(header)
+	if err == nil {
+		_, err = io.Copy(fd, r)
+	}
+	if err == nil {
+		_, err = fd.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = fd.Close()
+		_ = os.Remove(fd.Name())
+		return nil, err
+	}
+
+	return fd, nil
+}
+
+// countingReader counts bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
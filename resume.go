@@ -0,0 +1,238 @@
+package kvndb
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"io"
+	"os"
+	"time"
+)
+
+// loadProgress records how far interrupted LoadContext got, so the
+// next one can continue from there.
+type loadProgress struct {
+	dir     string
+	id      uint
+	size    int64
+	modTime time.Time
+	// pos is position of the first record not known to be loaded,
+	// hashState is state of snapshot checksum up to it.
+	pos       framePos
+	hashState []byte
+}
+
+// checkpoint records given position as loaded up to.
+func (p *loadProgress) checkpoint(pos framePos, hasher io.Writer) error {
+	state, err := hasher.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	p.pos = pos
+	p.hashState = state
+
+	return nil
+}
+
+// matches reports whether progress was made loading the same snapshot
+// file, verifying already read part of it against chunk checksums if
+// snapshot has them.
+func (p *loadProgress) matches(dir string, id uint, fd *os.File) (bool, error) {
+	if p.dir != dir || p.id != id {
+		return false, nil
+	}
+
+	fi, err := fd.Stat()
+	if err != nil {
+		return false, err
+	}
+	if fi.Size() != p.size || !fi.ModTime().Equal(p.modTime) {
+		return false, nil
+	}
+
+	c, err := readChunkChecksums(id, dir)
+	if err != nil || c == nil {
+		return err == nil, err
+	}
+
+	// chunks fully read so far must be intact
+	n := int(p.pos.chunk / c.size)
+	if n > len(c.hashes) {
+		return false, nil
+	}
+	verified := &chunkChecksums{
+		size:   c.size,
+		hashes: c.hashes[:n],
+	}
+	regions, err := verified.verify(io.NewSectionReader(fd, 0, int64(n)*c.size))
+	if err != nil {
+		return false, err
+	}
+
+	return len(regions) == 0, nil
+}
+
+// loadResumable replaces data with records of the latest snapshot,
+// giving up when ctx is done. If it is interrupted by ctx or by error
+// reading snapshot, data loaded so far is kept together with progress,
+// and the next call continues from there as long as the snapshot and
+// data did not change in between.
+func loadResumable(ctx context.Context, d *db, dir string) (err error) {
+	var id uint
+	defer func() {
+		err = wrapSnapshotError("load", dir, id, err)
+	}()
+
+	report := newReport(dir, time.Now())
+	progress := d.resume
+	d.modified()
+	d.changes.reset()
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	id, err = getMaxSnapshotId(dir)
+	if err != nil {
+		return err
+	}
+
+	// if id == 0 there is no snapshots to load
+	if id == 0 {
+		d.opts.logger.Warnf("kvndb: no snapshots to load in %s", dir)
+		return resetData(d, ErrSnapshotNotFound)
+	}
+
+	s, err := openSnapshotFile(dir, id)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	resuming := false
+	if progress != nil {
+		resuming, err = progress.matches(dir, id, s.fd)
+		if err != nil {
+			return err
+		}
+	}
+
+	hasher := sha256.New()
+	var fr *frameReader
+	if resuming {
+		d.opts.logger.Infof("kvndb: resuming load of snapshot %d from %s at offset %d", id, dir, progress.pos.chunk)
+		err = hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(progress.hashState)
+		if err == nil {
+			fr, err = s.bodyAt(progress.pos)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		d.opts.logger.Debugf("kvndb: loading snapshot %d from %s", id, dir)
+		err = resetData(d, nil)
+		if err != nil {
+			return err
+		}
+		fi, err := s.fd.Stat()
+		if err != nil {
+			return err
+		}
+		progress = &loadProgress{
+			dir:     dir,
+			id:      id,
+			size:    fi.Size(),
+			modTime: fi.ModTime(),
+		}
+		fr = s.body()
+	}
+
+	err = loadRecords(ctx, d, s, fr, hasher, progress)
+	if err != nil {
+		// decoders of codecs read ahead, so positions of their records
+		// are not known and loading can not be resumed
+		if isCorruption(err) || s.codec != nil {
+			return resetData(d, err)
+		}
+		d.resume = progress
+		return err
+	}
+
+	checksum, err := readSnapshotChecksum(id, dir)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(checksum, hasher.Sum(nil)) {
+		return resetData(d, ErrBadSnapshot)
+	}
+
+	err = report.finish(id, uint64(d.data.len()), checksum)
+	if err != nil {
+		return err
+	}
+	d.loadRevision(report, s.header.revision)
+	d.lastLoad = report
+
+	d.opts.logger.Infof("kvndb: loaded snapshot %d with %d entries from %s in %s", id, report.Entries, dir, report.Duration)
+
+	return nil
+}
+
+// loadRecords puts records read from fr into datastore, checkpointing
+// progress at every chunk of snapshot and when ctx is done.
+func loadRecords(ctx context.Context, d *db, s *snapshotFile, fr *frameReader, hasher io.Writer, progress *loadProgress) error {
+	err := progress.checkpoint(fr.position(), hasher)
+	if err != nil {
+		return err
+	}
+
+	rr := s.records(io.TeeReader(fr, hasher))
+	for {
+		pos := fr.position()
+		if ctx.Err() != nil {
+			err = progress.checkpoint(pos, hasher)
+			if err != nil {
+				return err
+			}
+			return ctx.Err()
+		}
+		if pos.chunk != progress.pos.chunk {
+			err = progress.checkpoint(pos, hasher)
+			if err != nil {
+				return err
+			}
+		}
+
+		key, value, err := rr.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = d.data.put(string(key), value)
+		if err != nil {
+			return err
+		}
+		loadMeta(d, string(key), rr.meta)
+	}
+}
+
+// resetData removes all entries, returning given error unless reset
+// itself fails.
+func resetData(d *db, err error) error {
+	resetErr := d.data.reset()
+	if resetErr != nil {
+		return resetErr
+	}
+	d.meta.reset()
+	d.access.reset()
+	d.ttl.reset()
+
+	return err
+}
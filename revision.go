@@ -0,0 +1,80 @@
+package kvndb
+
+func (d *db) PutRevision(key, value []byte) (uint64, error) {
+	if err := d.allowWrite(len(key) + len(value)); err != nil {
+		return 0, err
+	}
+	value = d.ownValue(value)
+	d.keyLocks.lock(key)
+	defer d.keyLocks.unlock(key)
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return 0, ErrAlreadyClosed
+	}
+	if d.meta == nil {
+		return 0, ErrNoMeta
+	}
+
+	err := d.put(key, value)
+	if err != nil {
+		return 0, err
+	}
+	m, _ := d.meta.get(string(key))
+
+	return m.revision, nil
+}
+
+func (d *db) PutIfRevision(key, value []byte, expected uint64) error {
+	if err := d.allowWrite(len(key) + len(value)); err != nil {
+		return err
+	}
+	value = d.ownValue(value)
+	d.keyLocks.lock(key)
+	defer d.keyLocks.unlock(key)
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return ErrAlreadyClosed
+	}
+	if d.meta == nil {
+		return ErrNoMeta
+	}
+
+	// expired entry is treated as missing one
+	d.expire(string(key))
+	m, _ := d.meta.get(string(key))
+	if m.revision != expected {
+		return wrapKeyError("put", key, ErrRevisionMismatch)
+	}
+
+	return d.put(key, value)
+}
+
+func (d *db) Revision() uint64 {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	return d.revision
+}
+
+func (d *db) ModifiedSince(rev uint64) bool {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	return d.revision > rev
+}
+
+// loadRevision records revision of loaded snapshot in report and
+// advances revision of data to it, so revisions of datastore restored
+// from snapshot are comparable with ones of datastore which saved it.
+// Revision never goes back, loading older snapshot still counts as
+// modification.
+func (d *db) loadRevision(report *Report, rev uint64) {
+	report.Revision = rev
+	if rev > d.revision {
+		d.revision = rev
+	}
+}
@@ -0,0 +1,262 @@
+package kvndb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config configures BlobStore returned by NewS3BlobStore.
+type S3Config struct {
+	// Endpoint is URL of S3 compatible service, e.g.
+	// https://s3.eu-west-1.amazonaws.com or http://localhost:9000.
+	Endpoint string
+	// Region is region requests are signed for, us-east-1 by default.
+	Region string
+	// Bucket is name of bucket objects are stored in.
+	Bucket string
+	// Prefix is prepended to names of all objects, e.g. "kvndb/".
+	Prefix string
+	// AccessKey and SecretKey are credentials requests are signed with.
+	AccessKey string
+	SecretKey string
+	// Client is HTTP client used for requests, http.DefaultClient by
+	// default.
+	Client *http.Client
+}
+
+// s3BlobStore is BlobStore keeping objects in S3 compatible object
+// storage, using path-style requests signed with AWS Signature V4.
+type s3BlobStore struct {
+	c S3Config
+}
+
+// NewS3BlobStore returns BlobStore keeping objects in bucket of S3 or S3
+// compatible object storage, such as MinIO or Ceph. Object content is
+// streamed and not signed, so endpoint should use HTTPS.
+func NewS3BlobStore(c S3Config) BlobStore {
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.Client == nil {
+		c.Client = http.DefaultClient
+	}
+	c.Endpoint = strings.TrimSuffix(c.Endpoint, "/")
+
+	return &s3BlobStore{
+		c: c,
+	}
+}
+
+func (s *s3BlobStore) Put(name string, r io.Reader, size int64) error {
+	var body io.Reader = http.NoBody
+	if size > 0 {
+		body = io.LimitReader(r, size)
+	}
+	resp, err := s.do(http.MethodPut, name, nil, body, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return s3Error(resp)
+}
+
+func (s *s3BlobStore) Get(name string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, name, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		_ = resp.Body.Close()
+		return nil, ErrBlobNotFound
+	}
+	err = s3Error(resp)
+	if err != nil {
+		_ = resp.Body.Close()
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// s3ListResult is response of ListObjectsV2.
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3BlobStore) List(prefix string) ([]string, error) {
+	names := make([]string, 0)
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.c.Prefix + prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = s3Error(resp)
+		if err == nil {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		}
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			names = append(names, strings.TrimPrefix(c.Key, s.c.Prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *s3BlobStore) Delete(name string) error {
+	resp, err := s.do(http.MethodDelete, name, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	return s3Error(resp)
+}
+
+// do sends signed request for object with given name, bucket itself if
+// name is empty.
+func (s *s3BlobStore) do(method, name string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	u, err := url.Parse(s.c.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path += "/" + s.c.Bucket
+	if name != "" {
+		u.Path += "/" + s.c.Prefix + name
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	s.sign(req, time.Now().UTC())
+
+	return s.c.Client.Do(req)
+}
+
+// sign signs request with AWS Signature V4, leaving payload unsigned.
+func (s *s3BlobStore) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + s.c.Region + "/s3/aws4_request"
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:UNSIGNED-PAYLOAD",
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + s.c.SecretKey)
+	for _, part := range []string{now.Format("20060102"), s.c.Region, "s3", "aws4_request"} {
+		key = hmacSha256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.c.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+// s3Escape escapes string as required by AWS Signature V4, which
+// differs from both url.PathEscape and url.QueryEscape.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func s3EscapePath(path string) string {
+	return s3Escape(path, true)
+}
+
+// s3CanonicalQuery encodes query sorted by key, as it is signed.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// s3Error returns error describing unsuccessful response.
+func s3Error(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	return fmt.Errorf("object storage responded %s: %s", resp.Status, body)
+}
@@ -0,0 +1,129 @@
+package kvndb
+
+import "sync"
+
+// saveBuffer holds writes made while Save is in progress, so writers
+// do not wait for it. Methods are no-op on nil buffer, which is used
+// when writes are not buffered.
+type saveBuffer struct {
+	mutex sync.Mutex
+	// ops is nil unless Save is in progress
+	ops map[string]bufferedOp
+}
+
+type bufferedOp struct {
+	value   []byte
+	deleted bool
+}
+
+// start makes buffer collect writes, reporting false if it already
+// does for another Save.
+func (b *saveBuffer) start() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.ops != nil {
+		return false
+	}
+	b.ops = make(map[string]bufferedOp)
+
+	return true
+}
+
+// tryAdd buffers write if Save is in progress, reporting whether it
+// did.
+func (b *saveBuffer) tryAdd(key, value []byte, deleted bool) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.ops == nil {
+		return false
+	}
+	b.ops[string(key)] = bufferedOp{
+		value:   value,
+		deleted: deleted,
+	}
+
+	return true
+}
+
+// get returns buffered value of given key, reporting whether there
+// was a write buffered for it.
+func (b *saveBuffer) get(key []byte) ([]byte, bool, error) {
+	if b == nil {
+		return nil, false, nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	op, ok := b.ops[string(key)]
+	if !ok {
+		return nil, false, nil
+	}
+	if op.deleted {
+		return nil, true, ErrKeyNotFound
+	}
+
+	return op.value, true, nil
+}
+
+// lockWrite locks datastore for write, unless Save is in progress, in
+// which case write is buffered and true is returned.
+func (d *db) lockWrite(key, value []byte, deleted bool) bool {
+	b := d.saveBuffer
+	if b == nil {
+		d.lock()
+		return false
+	}
+
+	// buffer lock is held until datastore is locked, so Save can not
+	// start in between and make this write wait for it
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.ops != nil {
+		b.ops[string(key)] = bufferedOp{
+			value:   value,
+			deleted: deleted,
+		}
+		return true
+	}
+	d.lock()
+
+	return false
+}
+
+// applySaveBuffer applies writes buffered during Save and stops
+// buffering. Datastore must be locked.
+func (d *db) applySaveBuffer() {
+	b := d.saveBuffer
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ops := b.ops
+	b.ops = nil
+	if d.isClosed {
+		return
+	}
+
+	for key, op := range ops {
+		var err error
+		if op.deleted {
+			err = d.delete([]byte(key))
+		} else {
+			err = d.put([]byte(key), op.value)
+		}
+		if err != nil {
+			d.opts.logger.Errorf("kvndb: failed to apply write buffered during save: %v", err)
+		}
+	}
+}
@@ -0,0 +1,570 @@
+package kvndb
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	snapshotMagic   = "KVNDB"
+	snapshotVersion = 5
+
+	// snapshotFlagIndex marks snapshot having footer index.
+	snapshotFlagIndex uint32 = 1 << 0
+	// snapshotFlagMeta marks snapshot records carrying entry metadata,
+	// it requires version 2.
+	snapshotFlagMeta uint32 = 1 << 1
+	// snapshotFlagCodec marks snapshot records encoded by codec named
+	// in header, it requires version 3.
+	snapshotFlagCodec uint32 = 1 << 2
+	// snapshotFlagRevision marks snapshot recording revision of saved
+	// data, it requires version 4.
+	snapshotFlagRevision uint32 = 1 << 3
+	// snapshotFlagHeaderCrc marks header ending with its checksum, as
+	// checksum file covers only snapshot body, it requires version 5.
+	snapshotFlagHeaderCrc uint32 = 1 << 4
+
+	snapshotIndexMagic  = "KIDX"
+	snapshotTrailerSize = 16
+)
+
+// snapshotHeader is written uncompressed in front of snapshot body.
+// Snapshots written before header was introduced start directly with
+// snappy stream and are treated as version 0. Since version 4 records
+// are packed by packCompactRecord, older ones by packRecord.
+//
+// Layout: magic (5 bytes), version (1 byte), length of fields that
+// follow (uint16), flags (uint32), size of entry metadata of every
+// record (uint16, only with snapshotFlagMeta), length of codec name
+// (1 byte) and the name (only with snapshotFlagCodec), revision of
+// data (uint64, only with snapshotFlagRevision). Readers ignore unknown
+// fields appended at the end. Since version 5 fields end with CRC-32C
+// (Castagnoli) of all preceding header bytes (uint32, flagged by
+// snapshotFlagHeaderCrc), which covers unknown fields as well.
+type snapshotHeader struct {
+	version  uint8
+	flags    uint32
+	metaSize uint16
+	codec    string
+	revision uint64
+}
+
+func (h *snapshotHeader) hasMeta() bool {
+	return h.flags&snapshotFlagMeta != 0
+}
+
+func (h *snapshotHeader) hasCodec() bool {
+	return h.flags&snapshotFlagCodec != 0
+}
+
+func (h *snapshotHeader) hasRevision() bool {
+	return h.flags&snapshotFlagRevision != 0
+}
+
+func (h *snapshotHeader) hasHeaderCrc() bool {
+	return h.flags&snapshotFlagHeaderCrc != 0
+}
+
+func (h *snapshotHeader) bytes() []byte {
+	if h.version >= 5 {
+		h.flags |= snapshotFlagHeaderCrc
+	}
+
+	fields := uint32ToBytes(h.flags)
+	if h.hasMeta() {
+		fields = append(fields, uint16ToBytes(h.metaSize)...)
+	}
+	if h.hasCodec() {
+		fields = append(fields, uint8(len(h.codec)))
+		fields = append(fields, h.codec...)
+	}
+	if h.hasRevision() {
+		fields = append(fields, uint64ToBytes(h.revision)...)
+	}
+
+	size := len(fields)
+	if h.hasHeaderCrc() {
+		size += 4
+	}
+
+	result := make([]byte, 0)
+	result = append(result, snapshotMagic...)
+	result = append(result, h.version)
+	result = append(result, uint16ToBytes(uint16(size))...)
+	result = append(result, fields...)
+	if h.hasHeaderCrc() {
+		result = append(result, uint32ToBytes(crc32.Checksum(result, crcTable))...)
+	}
+
+	return result
+}
+
+// readSnapshotHeader returns header of snapshot and size of it.
+func readSnapshotHeader(r io.ReaderAt, size int64) (*snapshotHeader, int64, error) {
+	// empty datastore used to be saved as empty file
+	if size == 0 {
+		return &snapshotHeader{}, 0, nil
+	}
+
+	prefix := make([]byte, len(snapshotMagic)+3)
+	n, err := r.ReadAt(prefix, 0)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	if n > 0 && prefix[0] == frameChunkStreamId {
+		return &snapshotHeader{}, 0, nil
+	}
+	if n < len(prefix) || !bytes.HasPrefix(prefix, []byte(snapshotMagic)) {
+		return nil, 0, ErrBadSnapshot
+	}
+
+	h := &snapshotHeader{
+		version: prefix[len(snapshotMagic)],
+	}
+	if h.version > snapshotVersion {
+		return nil, 0, ErrBadSnapshot
+	}
+
+	fields := make([]byte, binary.LittleEndian.Uint16(prefix[len(snapshotMagic)+1:]))
+	_, err = r.ReadAt(fields, int64(len(prefix)))
+	if err != nil {
+		return nil, 0, ErrBadSnapshot
+	}
+	if len(fields) < 4 {
+		return nil, 0, ErrBadSnapshot
+	}
+	h.flags = bytesToUint32(fields[0:4])
+	rest := fields[4:]
+	// flag can't be dropped by corruption of the flag itself
+	if h.version >= 5 && !h.hasHeaderCrc() {
+		return nil, 0, ErrBadSnapshot
+	}
+	if h.hasHeaderCrc() {
+		if h.version < 5 || len(rest) < 4 {
+			return nil, 0, ErrBadSnapshot
+		}
+		crc := crc32.Update(crc32.Checksum(prefix, crcTable), crcTable, fields[:len(fields)-4])
+		if crc != bytesToUint32(fields[len(fields)-4:]) {
+			return nil, 0, ErrBadSnapshot
+		}
+		rest = rest[:len(rest)-4]
+	}
+	if h.hasMeta() {
+		if h.version < 2 || len(rest) < 2 {
+			return nil, 0, ErrBadSnapshot
+		}
+		h.metaSize = binary.LittleEndian.Uint16(rest[0:2])
+		rest = rest[2:]
+	}
+	if h.hasCodec() {
+		if h.version < 3 || len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return nil, 0, ErrBadSnapshot
+		}
+		h.codec = string(rest[1 : 1+int(rest[0])])
+		rest = rest[1+int(rest[0]):]
+	}
+	if h.hasRevision() {
+		if h.version < 4 || len(rest) < 8 {
+			return nil, 0, ErrBadSnapshot
+		}
+		h.revision = bytesToUint64(rest[0:8])
+	}
+
+	return h, int64(len(prefix) + len(fields)), nil
+}
+
+// snapshotFile is snapshot opened for reading.
+type snapshotFile struct {
+	fd        *os.File
+	size      int64
+	header    *snapshotHeader
+	codec     Codec
+	bodyStart int64
+	bodyEnd   int64
+}
+
+func openSnapshotFile(dir string, id uint) (*snapshotFile, error) {
+	fd, err := os.Open(getSnapshotFilepath(dir, id))
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newSnapshotFile(fd)
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func newSnapshotFile(fd *os.File) (*snapshotFile, error) {
+	fi, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header, bodyStart, err := readSnapshotHeader(fd, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	s := &snapshotFile{
+		fd:        fd,
+		size:      fi.Size(),
+		header:    header,
+		bodyStart: bodyStart,
+		bodyEnd:   fi.Size(),
+	}
+
+	if header.hasCodec() {
+		s.codec, err = lookupCodec(header.codec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.hasIndex() {
+		indexOffset, _, err := s.readTrailer()
+		if err != nil {
+			return nil, err
+		}
+		s.bodyEnd = indexOffset
+	}
+
+	return s, nil
+}
+
+func (s *snapshotFile) hasIndex() bool {
+	return s.header.flags&snapshotFlagIndex != 0
+}
+
+// records returns reader of records read from r, which must be
+// positioned at the beginning of a record.
+func (s *snapshotFile) records(r io.Reader) *recordReader {
+	rr := newRecordReader(r)
+	rr.metaSize = uint32(s.header.metaSize)
+	rr.compact = s.header.version >= 4
+	if s.codec != nil {
+		rr.dec = s.codec.NewDecoder(r)
+	}
+
+	return rr
+}
+
+// body returns reader of snapshot records from the beginning.
+func (s *snapshotFile) body() *frameReader {
+	r := io.NewSectionReader(s.fd, s.bodyStart, s.bodyEnd-s.bodyStart)
+	return newFrameReader(bufio.NewReader(r), s.bodyStart)
+}
+
+// bodyAt returns reader of snapshot records starting at given position.
+func (s *snapshotFile) bodyAt(pos framePos) (*frameReader, error) {
+	r := io.NewSectionReader(s.fd, pos.chunk, s.bodyEnd-pos.chunk)
+	fr := newFrameReader(r, pos.chunk)
+
+	_, err := io.CopyN(io.Discard, fr, int64(pos.offset))
+	if err != nil {
+		return nil, err
+	}
+
+	return fr, nil
+}
+
+// readAt returns value and metadata of record at given position,
+// verifying it belongs to given key. Metadata is nil if snapshot
+// has none.
+func (s *snapshotFile) readAt(key string, pos framePos) ([]byte, []byte, error) {
+	r, err := s.bodyAt(pos)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rr := s.records(r)
+	k, value, err := rr.next()
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(k) != key {
+		return nil, nil, ErrBadSnapshot
+	}
+
+	return value, rr.meta, nil
+}
+
+func (s *snapshotFile) readTrailer() (int64, uint32, error) {
+	trailer := make([]byte, snapshotTrailerSize)
+	_, err := s.fd.ReadAt(trailer, s.size-snapshotTrailerSize)
+	if err != nil {
+		return 0, 0, ErrBadSnapshot
+	}
+	if string(trailer[12:]) != snapshotIndexMagic {
+		return 0, 0, ErrBadSnapshot
+	}
+
+	indexOffset := int64(bytesToUint64(trailer[0:8]))
+	if indexOffset < s.bodyStart || indexOffset > s.size-snapshotTrailerSize {
+		return 0, 0, ErrBadSnapshot
+	}
+
+	return indexOffset, bytesToUint32(trailer[8:12]), nil
+}
+
+// readIndex returns positions of all records as stored in footer index.
+func (s *snapshotFile) readIndex() (map[string]framePos, error) {
+	data := make([]byte, s.size-snapshotTrailerSize-s.bodyEnd)
+	_, err := s.fd.ReadAt(data, s.bodyEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	_, crc, err := s.readTrailer()
+	if err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != crc {
+		return nil, ErrBadSnapshot
+	}
+
+	index := make(map[string]framePos)
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, ErrBadSnapshot
+		}
+		kLen := int(bytesToUint32(data[0:4]))
+		if len(data) < 4+kLen+12 {
+			return nil, ErrBadSnapshot
+		}
+		key := string(data[4 : 4+kLen])
+		data = data[4+kLen:]
+		index[key] = framePos{
+			chunk:  int64(bytesToUint64(data[0:8])),
+			offset: bytesToUint32(data[8:12]),
+		}
+		data = data[12:]
+	}
+
+	return index, nil
+}
+
+func (s *snapshotFile) Close() error {
+	return s.fd.Close()
+}
+
+// writeSnapshot writes all entries of datastore into snapshot with
+// given id. Snapshot is written to temporary file in staging directory
+// and renamed into place when complete, so it never appears partially
+// written.
+func writeSnapshot(d *db, dir string, id uint) error {
+	staging := d.opts.stagingDir
+	if staging == "" {
+		staging = dir
+	} else {
+		ok, err := sameFilesystem(staging, dir)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrStagingDir
+		}
+	}
+
+	// staging directory may be shared by several datastores
+	n := atomic.AddUint64(&tempSnapshotCounter, 1)
+	tmpPath := filepath.Join(staging, fmt.Sprintf("%s.%d-%d.tmp", generateSnapshotName(id), os.Getpid(), n))
+	err := writeSnapshotFile(d, dir, tmpPath)
+	if os.IsExist(err) {
+		// file is not ours to remove
+		return err
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, getSnapshotFilepath(dir, id))
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// tempSnapshotCounter makes names of temporary snapshot files unique
+// within process.
+var tempSnapshotCounter uint64
+
+// writeSnapshotFile writes all entries of datastore into new file at
+// given path.
+func writeSnapshotFile(d *db, dir string, path string) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if d.opts.dsync {
+		flags |= dsyncFlag
+	}
+	direct := d.opts.directIO && directIOFlag != 0
+
+	var fd *os.File
+	var err error
+	if direct {
+		fd, err = os.OpenFile(path, flags|directIOFlag, d.opts.filePerm(0666))
+		// some filesystems, e.g. tmpfs, do not support O_DIRECT
+		if errors.Is(err, syscall.EINVAL) {
+			d.opts.logger.Warnf("kvndb: direct I/O is not supported in %s, writing snapshot through page cache", dir)
+			direct = false
+		}
+	}
+	if !direct {
+		fd, err = os.OpenFile(path, flags, d.opts.filePerm(0666))
+	}
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = fd
+	var dw *directWriter
+	if direct {
+		dw = newDirectWriter(fd)
+		w = dw
+	}
+
+	err = writeSnapshotTo(w, d.data, d.meta, d.opts.snapshotIndex, d.opts.codec, d.revision)
+	if err == nil && dw != nil {
+		err = dw.Flush()
+	}
+	if err == nil && d.opts.sync {
+		err = fd.Sync()
+	}
+	if err != nil {
+		_ = fd.Close()
+		return err
+	}
+
+	return fd.Close()
+}
+
+// writeSnapshotTo writes header, all entries of engine and optionally
+// footer index to w. Entry metadata is written when meta is not nil.
+// Records are encoded by codec unless it is nil, in which case neither
+// index nor metadata is written. Revision of data is recorded in
+// header.
+func writeSnapshotTo(w io.Writer, e engine, meta *metaTable, withIndex bool, codec Codec, revision uint64) error {
+	if codec != nil {
+		meta = nil
+		withIndex = false
+	}
+
+	header := &snapshotHeader{
+		version:  snapshotVersion,
+		flags:    snapshotFlagRevision,
+		revision: revision,
+	}
+	if withIndex {
+		header.flags |= snapshotFlagIndex
+	}
+	if meta != nil {
+		header.flags |= snapshotFlagMeta
+		header.metaSize = entryMetaSize
+	}
+	if codec != nil {
+		header.flags |= snapshotFlagCodec
+		header.codec = codec.Name()
+	}
+
+	bw := bufio.NewWriter(w)
+	headerBytes := header.bytes()
+	_, err := bw.Write(headerBytes)
+	if err != nil {
+		return err
+	}
+
+	fw := newFrameWriter(bw, int64(len(headerBytes)))
+	var index []byte
+	if codec != nil {
+		err = writeEncodedRecords(fw, e, codec)
+	} else {
+		index, err = writeRecords(fw, e, meta, withIndex)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = fw.Flush()
+	if err != nil {
+		return err
+	}
+
+	if withIndex {
+		trailer := make([]byte, 0, snapshotTrailerSize)
+		trailer = append(trailer, uint64ToBytes(uint64(fw.offset))...)
+		trailer = append(trailer, uint32ToBytes(crc32.ChecksumIEEE(index))...)
+		trailer = append(trailer, snapshotIndexMagic...)
+		for _, b := range [][]byte{index, trailer} {
+			_, err = bw.Write(b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// writeRecords writes all entries of engine as compact records,
+// returning footer index of their positions if withIndex is set.
+func writeRecords(fw *frameWriter, e engine, meta *metaTable, withIndex bool) ([]byte, error) {
+	index := make([]byte, 0)
+	err := e.forEach(func(key string, value []byte) error {
+		if withIndex {
+			pos := fw.position()
+			index = append(index, uint32ToBytes(uint32(len(key)))...)
+			index = append(index, key...)
+			index = append(index, uint64ToBytes(uint64(pos.chunk))...)
+			index = append(index, uint32ToBytes(pos.offset)...)
+		}
+		var metaBytes []byte
+		if meta != nil {
+			m, _ := meta.get(key)
+			metaBytes = m.bytes()
+		}
+		return writeCompactRecord(fw, []byte(key), value, metaBytes)
+	})
+
+	return index, err
+}
+
+// writeEncodedRecords writes all entries of engine encoded by codec.
+func writeEncodedRecords(fw *frameWriter, e engine, codec Codec) error {
+	enc := codec.NewEncoder(fw)
+	err := e.forEach(func(key string, value []byte) error {
+		return enc.Encode([]byte(key), value)
+	})
+	if err != nil {
+		return err
+	}
+
+	return enc.Flush()
+}
+
+// getSnapshotChecksum returns checksum of decoded snapshot records.
+func getSnapshotChecksum(id uint, dir string) ([]byte, error) {
+	s, err := openSnapshotFile(dir, id)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, s.body()); err != nil {
+		return nil, err
+	}
+
+	return hasher.Sum(nil), nil
+}
@@ -0,0 +1,164 @@
+package kvndb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// SSHConfig configures BlobStore returned by NewSSHBlobStore.
+type SSHConfig struct {
+	// Host is remote host as accepted by ssh, e.g. "backup@example.com"
+	// or host alias from ssh config.
+	Host string
+	// Dir is remote directory objects are stored in, which must exist.
+	Dir string
+	// Args are additional arguments for ssh, e.g. {"-i", keyPath, "-p",
+	// "2222"}.
+	Args []string
+	// Command is ssh client to run, "ssh" by default.
+	Command string
+}
+
+// sshBlobStore is BlobStore keeping objects as files in directory on
+// remote host, accessed with ssh client.
+type sshBlobStore struct {
+	c SSHConfig
+}
+
+// NewSSHBlobStore returns BlobStore keeping objects as files in
+// directory on remote host, accessed with ssh client of the system, so
+// authentication, known hosts and proxies are configured as for ssh.
+// Remote host must provide POSIX shell. Object names must not contain
+// path separators.
+func NewSSHBlobStore(c SSHConfig) BlobStore {
+	if c.Command == "" {
+		c.Command = "ssh"
+	}
+
+	return &sshBlobStore{
+		c: c,
+	}
+}
+
+func (s *sshBlobStore) path(name string) string {
+	return shellQuote(strings.TrimSuffix(s.c.Dir, "/") + "/" + name)
+}
+
+func (s *sshBlobStore) command(script string) *exec.Cmd {
+	args := append(append([]string{}, s.c.Args...), "--", s.c.Host, script)
+
+	return exec.Command(s.c.Command, args...)
+}
+
+// run runs script on remote host with given stdin and stdout.
+func (s *sshBlobStore) run(script string, stdin io.Reader, stdout io.Writer) error {
+	cmd := s.command(script)
+	stderr := &bytes.Buffer{}
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	return sshError(cmd.Run(), stderr)
+}
+
+func (s *sshBlobStore) Put(name string, r io.Reader, size int64) error {
+	tmpPath := s.path("." + name + ".tmp")
+	// object is renamed into place only if it was received whole
+	script := fmt.Sprintf("cat > %[1]s && [ $(wc -c < %[1]s) -eq %[2]d ] && mv -f %[1]s %[3]s || { rm -f %[1]s; exit 1; }", tmpPath, size, s.path(name))
+
+	return s.run(script, io.LimitReader(r, size), nil)
+}
+
+func (s *sshBlobStore) Get(name string) (io.ReadCloser, error) {
+	// marker tells missing object apart from empty one
+	cmd := s.command(fmt.Sprintf("if [ -f %[1]s ]; then printf +; exec cat %[1]s; fi", s.path(name)))
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &sshReader{
+		Reader: bufio.NewReader(stdout),
+		cmd:    cmd,
+		stderr: stderr,
+	}
+	_, err = rc.ReadByte()
+	if err == io.EOF {
+		err = rc.Close()
+		if err == nil {
+			err = ErrBlobNotFound
+		}
+		return nil, err
+	}
+	if err != nil {
+		_ = rc.Close()
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+// sshReader reads output of remote command, waiting for it on close.
+type sshReader struct {
+	*bufio.Reader
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func (r *sshReader) Close() error {
+	// drain output, so command exits before it is waited for
+	_, _ = io.Copy(io.Discard, r.Reader)
+
+	return sshError(r.cmd.Wait(), r.stderr)
+}
+
+func (s *sshBlobStore) List(prefix string) ([]string, error) {
+	// hidden files, such as temporary files of Put, are not matched
+	script := fmt.Sprintf("cd %s && for f in %s*; do [ -f \"$f\" ] && printf '%%s\\n' \"$f\"; done; true", shellQuote(s.c.Dir), shellQuote(prefix))
+	out := &bytes.Buffer{}
+	err := s.run(script, nil, out)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for _, name := range strings.Split(out.String(), "\n") {
+		if name != "" && !strings.HasPrefix(name, ".") {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+func (s *sshBlobStore) Delete(name string) error {
+	return s.run("rm -f "+s.path(name), nil, nil)
+}
+
+// shellQuote quotes string for POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// sshError adds output of ssh to error of its run.
+func sshError(err error, stderr *bytes.Buffer) error {
+	if err == nil {
+		return nil
+	}
+	msg := strings.TrimSpace(stderr.String())
+	if msg == "" {
+		return fmt.Errorf("ssh: %w", err)
+	}
+
+	return fmt.Errorf("ssh: %w: %s", err, msg)
+}
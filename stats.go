@@ -0,0 +1,200 @@
+package kvndb
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats describes datastore, as returned by Stats and passed to hook
+// registered with BeforeSave. Counters start at 0 when datastore is
+// created.
+type Stats struct {
+	// Entries is number of entries.
+	Entries int
+	// Bytes is approximate memory used by entries, as reported by
+	// SizeBytes.
+	Bytes int64
+	// LastSave is report of the last successful Save, nil if there
+	// was none.
+	LastSave *Report
+	// Gets is number of reads of single entry. Reads which failed
+	// for other reason than missing entry are neither hits nor misses.
+	Gets uint64
+	// Hits is number of reads which found the entry.
+	Hits uint64
+	// Misses is number of reads which did not find the entry.
+	Misses uint64
+	// Puts is number of entries put.
+	Puts uint64
+	// Deletes is number of entries deleted.
+	Deletes uint64
+	// ExpiredOnAccess is number of expired entries removed when
+	// accessed, before sweeper got to them.
+	ExpiredOnAccess uint64
+	// ExpiredBySweeper is number of expired entries removed by
+	// sweeper.
+	ExpiredBySweeper uint64
+	// RateLimited is number of mutations rejected with
+	// ErrRateLimited.
+	RateLimited uint64
+}
+
+// stats holds live counters of datastore, also published via expvar.
+// Counters are updated atomically, all methods are no-op on nil stats.
+type stats struct {
+	gets     uint64
+	hits     uint64
+	misses   uint64
+	puts     uint64
+	deletes  uint64
+	lockWait int64
+
+	expiredOnAccess  uint64
+	expiredBySweeper uint64
+	rateLimited      uint64
+
+	// last known values of fields guarded by datastore mutex, they
+	// are refreshed when it is free, so publishing never blocks
+	mutex    sync.Mutex
+	size     uint64
+	lastSave *Report
+}
+
+func (s *stats) countGet() {
+	if s != nil {
+		atomic.AddUint64(&s.gets, 1)
+	}
+}
+
+func (s *stats) countHit() {
+	if s != nil {
+		atomic.AddUint64(&s.hits, 1)
+	}
+}
+
+func (s *stats) countMiss() {
+	if s != nil {
+		atomic.AddUint64(&s.misses, 1)
+	}
+}
+
+func (s *stats) countPut() {
+	if s != nil {
+		atomic.AddUint64(&s.puts, 1)
+	}
+}
+
+func (s *stats) countDelete() {
+	if s != nil {
+		atomic.AddUint64(&s.deletes, 1)
+	}
+}
+
+func (s *stats) countExpired(bySweeper bool) {
+	if s == nil {
+		return
+	}
+
+	if bySweeper {
+		atomic.AddUint64(&s.expiredBySweeper, 1)
+	} else {
+		atomic.AddUint64(&s.expiredOnAccess, 1)
+	}
+}
+
+func (s *stats) countRateLimited() {
+	if s != nil {
+		atomic.AddUint64(&s.rateLimited, 1)
+	}
+}
+
+func (s *stats) waited(d time.Duration) {
+	if s != nil {
+		atomic.AddInt64(&s.lockWait, int64(d))
+	}
+}
+
+// lock locks datastore mutex, accounting time spent waiting for it
+// when stats are published.
+func (d *db) lock() {
+	if d.opts.expvarName == "" {
+		d.mutex.Lock()
+		return
+	}
+
+	start := time.Now()
+	d.mutex.Lock()
+	d.stats.waited(time.Since(start))
+}
+
+// publish publishes stats of datastore under given expvar name.
+func (d *db) publish(name string) {
+	expvar.Publish(name, expvar.Func(d.expvarStats))
+}
+
+func (d *db) expvarStats() interface{} {
+	if d.mutex.TryLock() {
+		d.stats.mutex.Lock()
+		d.stats.size = 0
+		if !d.isClosed {
+			d.stats.size = uint64(d.data.len())
+		}
+		d.stats.lastSave = d.lastSave.copy()
+		d.stats.mutex.Unlock()
+		d.mutex.Unlock()
+	}
+
+	d.stats.mutex.Lock()
+	defer d.stats.mutex.Unlock()
+
+	result := map[string]interface{}{
+		"size":        d.stats.size,
+		"gets":        atomic.LoadUint64(&d.stats.gets),
+		"hits":        atomic.LoadUint64(&d.stats.hits),
+		"misses":      atomic.LoadUint64(&d.stats.misses),
+		"puts":        atomic.LoadUint64(&d.stats.puts),
+		"deletes":     atomic.LoadUint64(&d.stats.deletes),
+		"lockWaitSec": time.Duration(atomic.LoadInt64(&d.stats.lockWait)).Seconds(),
+
+		"expiredOnAccess":  atomic.LoadUint64(&d.stats.expiredOnAccess),
+		"expiredBySweeper": atomic.LoadUint64(&d.stats.expiredBySweeper),
+		"rateLimited":      atomic.LoadUint64(&d.stats.rateLimited),
+	}
+	if d.stats.lastSave != nil {
+		result["lastSaveId"] = d.stats.lastSave.Id
+		result["lastSaveTime"] = d.stats.lastSave.Started.Add(d.stats.lastSave.Duration)
+	}
+
+	return result
+}
+
+func (d *db) Stats() Stats {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	return d.currentStats()
+}
+
+// currentStats returns stats of datastore, which must be locked.
+func (d *db) currentStats() Stats {
+	s := Stats{
+		LastSave: d.lastSave.copy(),
+		Gets:     atomic.LoadUint64(&d.stats.gets),
+		Hits:     atomic.LoadUint64(&d.stats.hits),
+		Misses:   atomic.LoadUint64(&d.stats.misses),
+		Puts:     atomic.LoadUint64(&d.stats.puts),
+		Deletes:  atomic.LoadUint64(&d.stats.deletes),
+
+		ExpiredOnAccess:  atomic.LoadUint64(&d.stats.expiredOnAccess),
+		ExpiredBySweeper: atomic.LoadUint64(&d.stats.expiredBySweeper),
+		RateLimited:      atomic.LoadUint64(&d.stats.rateLimited),
+	}
+	if !d.isClosed {
+		s.Entries = d.data.len()
+		s.Bytes = d.data.memSize()
+	}
+
+	return s
+}
@@ -0,0 +1,47 @@
+//go:build !windows
+// +build !windows
+
+package kvndb
+
+import (
+	"os"
+	"syscall"
+)
+
+// syncDir flushes directory entries to stable storage, so that newly
+// created files are not lost on power failure.
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = fd.Sync()
+	if err != nil {
+		_ = fd.Close()
+		return err
+	}
+
+	return fd.Close()
+}
+
+// sameFilesystem reports whether given directories are on the same
+// filesystem, so files can be renamed between them.
+func sameFilesystem(a, b string) (bool, error) {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	if !fa.IsDir() || !fb.IsDir() {
+		return false, nil
+	}
+
+	sa, okA := fa.Sys().(*syscall.Stat_t)
+	sb, okB := fb.Sys().(*syscall.Stat_t)
+
+	return okA && okB && sa.Dev == sb.Dev, nil
+}
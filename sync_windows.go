@@ -0,0 +1,38 @@
+//go:build windows
+// +build windows
+
+package kvndb
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// syncDir is a no-op on Windows, where directories cannot be opened
+// for syncing and metadata is flushed together with files.
+func syncDir(dir string) error {
+	return nil
+}
+
+// sameFilesystem reports whether given directories are on the same
+// volume, so files can be renamed between them.
+func sameFilesystem(a, b string) (bool, error) {
+	volumes := make([]string, 0, 2)
+	for _, dir := range []string{a, b} {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return false, err
+		}
+		if !fi.IsDir() {
+			return false, nil
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return false, err
+		}
+		volumes = append(volumes, filepath.VolumeName(abs))
+	}
+
+	return strings.EqualFold(volumes[0], volumes[1]), nil
+}
@@ -0,0 +1,161 @@
+package kvndb
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// KeyAccess is key along with its access frequency counter, as
+// reported by TopKeysByAccess.
+type KeyAccess struct {
+	Key       []byte
+	Frequency uint8
+}
+
+func (d *db) TopKeysByAccess(n int) ([]KeyAccess, error) {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return nil, ErrAlreadyClosed
+	}
+
+	if d.access == nil {
+		return nil, ErrNoAccessFrequency
+	}
+
+	d.removeExpired()
+
+	top := newTopEntries(n)
+	for key := range d.access.counters {
+		count, _ := d.access.get(key)
+		top.add(key, int64(count))
+	}
+
+	result := make([]KeyAccess, 0, top.Len())
+	for _, e := range top.sorted() {
+		result = append(result, KeyAccess{
+			Key:       []byte(e.key),
+			Frequency: uint8(e.score),
+		})
+	}
+
+	return result, nil
+}
+
+// KeySize is key along with size of its value, as reported by
+// TopKeysBySize.
+type KeySize struct {
+	Key  []byte
+	Size int64
+}
+
+func (d *db) TopKeysBySize(n int) ([]KeySize, error) {
+	d.lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return nil, ErrAlreadyClosed
+	}
+
+	d.removeExpired()
+
+	top := newTopEntries(n)
+	err := d.data.forEach(func(key string, value []byte) error {
+		top.add(key, int64(len(value)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]KeySize, 0, top.Len())
+	for _, e := range top.sorted() {
+		result = append(result, KeySize{
+			Key:  []byte(e.key),
+			Size: e.score,
+		})
+	}
+
+	return result, nil
+}
+
+type topEntry struct {
+	key   string
+	score int64
+}
+
+// topEntries keeps n entries with the highest score seen so far, as a
+// min-heap with the lowest of them on top.
+type topEntries struct {
+	n       int
+	entries []topEntry
+}
+
+func newTopEntries(n int) *topEntries {
+	return &topEntries{
+		n:       n,
+		entries: make([]topEntry, 0),
+	}
+}
+
+func (t *topEntries) add(key string, score int64) {
+	if t.n <= 0 {
+		return
+	}
+
+	e := topEntry{
+		key:   key,
+		score: score,
+	}
+	if len(t.entries) < t.n {
+		heap.Push(t, e)
+		return
+	}
+	if t.less(t.entries[0], e) {
+		t.entries[0] = e
+		heap.Fix(t, 0)
+	}
+}
+
+// sorted returns entries from the highest score, ties ordered by key.
+func (t *topEntries) sorted() []topEntry {
+	sort.Slice(t.entries, func(i, j int) bool {
+		return t.less(t.entries[j], t.entries[i])
+	})
+
+	return t.entries
+}
+
+// less orders entries by score, and by key in reverse for equal score,
+// so of entries with equal score the lowest keys are kept.
+func (t *topEntries) less(a, b topEntry) bool {
+	if a.score != b.score {
+		return a.score < b.score
+	}
+
+	return a.key > b.key
+}
+
+func (t *topEntries) Len() int {
+	return len(t.entries)
+}
+
+func (t *topEntries) Less(i, j int) bool {
+	return t.less(t.entries[i], t.entries[j])
+}
+
+func (t *topEntries) Swap(i, j int) {
+	t.entries[i], t.entries[j] = t.entries[j], t.entries[i]
+}
+
+func (t *topEntries) Push(x interface{}) {
+	t.entries = append(t.entries, x.(topEntry))
+}
+
+func (t *topEntries) Pop() interface{} {
+	last := t.entries[len(t.entries)-1]
+	t.entries = t.entries[:len(t.entries)-1]
+
+	return last
+}
@@ -0,0 +1,192 @@
+package kvndb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// snapshotPath is URL path snapshots are served at.
+	snapshotPath = "/snapshot/latest"
+
+	headerSnapshotId       = "X-Kvndb-Snapshot-Id"
+	headerSnapshotChecksum = "X-Kvndb-Snapshot-Checksum"
+)
+
+// ServeSnapshots serves the latest snapshot in given directory over
+// HTTP on given listener, for FetchSnapshot. It blocks until listener
+// fails, like http.Serve.
+func ServeSnapshots(l net.Listener, dir string) error {
+	return http.Serve(l, SnapshotHandler(dir))
+}
+
+// SnapshotHandler returns HTTP handler serving the latest snapshot in
+// given directory, for use with existing HTTP server. FetchSnapshot
+// expects it to be mounted at root.
+func SnapshotHandler(dir string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(snapshotPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		fd, id, checksum, err := openLatestSnapshot(dir)
+		if errors.Is(err, ErrDirLocked) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if errors.Is(err, ErrSnapshotNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer fd.Close()
+
+		fi, err := fd.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(headerSnapshotId, strconv.FormatUint(uint64(id), 10))
+		w.Header().Set(headerSnapshotChecksum, hex.EncodeToString(checksum))
+		http.ServeContent(w, r, generateSnapshotName(id), fi.ModTime(), fd)
+	})
+
+	return mux
+}
+
+// openLatestSnapshot opens the latest snapshot in given directory,
+// returning it with its id and checksum. Directory is only locked while
+// snapshot is opened, open file stays readable even if snapshot is
+// removed later.
+func openLatestSnapshot(dir string) (*os.File, uint, []byte, error) {
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer lock.unlock()
+
+	id, err := getMaxSnapshotId(dir)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if id == 0 {
+		return nil, 0, nil, ErrSnapshotNotFound
+	}
+
+	checksum, err := readSnapshotChecksum(id, dir)
+	if err != nil {
+		return nil, id, nil, err
+	}
+	fd, err := os.Open(getSnapshotFilepath(dir, id))
+	if err != nil {
+		return nil, id, nil, err
+	}
+
+	return fd, id, checksum, nil
+}
+
+// FetchSnapshot downloads the latest snapshot served by ServeSnapshots
+// at given address, host:port or URL, into new snapshot in given
+// directory, returning its id. Downloaded snapshot is verified against
+// checksum sent by server before it is kept, so it can be loaded right
+// away.
+func FetchSnapshot(addr, dir string) (id uint, err error) {
+	defer func() {
+		err = wrapSnapshotError("fetch", dir, id, err)
+	}()
+
+	url := addr
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		url = "http://" + addr
+	}
+	resp, err := http.Get(url + snapshotPath)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, ErrSnapshotNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return 0, fmt.Errorf("server responded %s: %s", resp.Status, body)
+	}
+	checksum, err := hex.DecodeString(resp.Header.Get(headerSnapshotChecksum))
+	if err != nil || len(checksum) == 0 {
+		return 0, errors.New("server sent no snapshot checksum")
+	}
+
+	return receiveSnapshot(dir, resp.Body, checksum)
+}
+
+// receiveSnapshot writes snapshot read from r into new snapshot in given
+// directory, returning its id. Snapshot is kept only if it matches
+// given checksum.
+func receiveSnapshot(dir string, r io.Reader, checksum []byte) (id uint, err error) {
+	lock, err := lockDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.unlock()
+
+	maxId, err := getMaxSnapshotId(dir)
+	if err != nil {
+		return 0, err
+	}
+	id = maxId + 1
+
+	tmpPath := filepath.Join(dir, fmt.Sprintf("%s.%d.tmp", generateSnapshotName(id), os.Getpid()))
+	err = downloadFile(tmpPath, r)
+	if err == nil {
+		err = os.Rename(tmpPath, getSnapshotFilepath(dir, id))
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return id, err
+	}
+
+	actual, err := getSnapshotChecksum(id, dir)
+	if err == nil && !bytes.Equal(actual, checksum) {
+		err = ErrBadSnapshot
+	}
+	if err == nil {
+		err = writeFile(getChecksumFilepath(dir, id), actual, 0600, false)
+	}
+	if err != nil {
+		removeSnapshotFiles(dir, id)
+		return id, err
+	}
+
+	return id, nil
+}
+
+func downloadFile(path string, r io.Reader) error {
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fd, r)
+	if err != nil {
+		_ = fd.Close()
+		return err
+	}
+
+	return fd.Close()
+}
@@ -0,0 +1,76 @@
+package kvndb
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// trashDirName is name of subdirectory of snapshot directory retired
+// snapshots are moved to when datastore was created with WithTrash.
+const trashDirName = ".trash"
+
+func getTrashDir(dir string) string {
+	return filepath.Join(dir, trashDirName)
+}
+
+// trashSnapshot moves snapshot with given id and its checksum files to
+// trash directory. Modification time of moved files is set to now, so
+// they are purged after grace period counted from now.
+func trashSnapshot(dir string, id uint, perm os.FileMode) error {
+	trash := getTrashDir(dir)
+	err := os.MkdirAll(trash, perm)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, path := range []string{getSnapshotFilepath(dir, id), getChecksumFilepath(dir, id), getChunksFilepath(dir, id)} {
+		dst := filepath.Join(trash, filepath.Base(path))
+		err = os.Rename(path, dst)
+		if os.IsNotExist(err) && path == getChunksFilepath(dir, id) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = os.Chtimes(dst, now, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// purgeTrash removes files which were in trash directory for longer
+// than grace period.
+func purgeTrash(dir string, grace time.Duration, logger Logger) error {
+	trash := getTrashDir(dir)
+	entries, err := os.ReadDir(trash)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(-grace)
+	for _, entry := range entries {
+		fi, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || fi.ModTime().After(deadline) {
+			continue
+		}
+
+		logger.Debugf("kvndb: purging %s from %s", entry.Name(), trash)
+		err = os.Remove(filepath.Join(trash, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package kvndb
+
+import (
+	"time"
+)
+
+// ttlTable holds expiration times of entries put with TTL. All methods
+// are called with datastore mutex held and are no-op on nil table,
+// which is used until the first entry with TTL is put.
+type ttlTable struct {
+	expires map[string]int64
+}
+
+func newTTLTable() *ttlTable {
+	return &ttlTable{
+		expires: make(map[string]int64),
+	}
+}
+
+// set records entry for given key expires at given unix nanoseconds.
+func (t *ttlTable) set(key string, at int64) {
+	t.expires[key] = at
+}
+
+func (t *ttlTable) remove(key string) {
+	if t == nil {
+		return
+	}
+
+	delete(t.expires, key)
+}
+
+func (t *ttlTable) reset() {
+	if t == nil {
+		return
+	}
+
+	t.expires = make(map[string]int64)
+}
+
+// isExpired reports whether entry for given key expired before now.
+func (t *ttlTable) isExpired(key string, now int64) bool {
+	if t == nil {
+		return false
+	}
+
+	at, ok := t.expires[key]
+
+	return ok && at <= now
+}
+
+// expired returns up to limit keys which expired before now. Map
+// iteration starts at random entry, so every call samples different
+// part of the table.
+func (t *ttlTable) expired(now int64, limit int) []string {
+	if t == nil {
+		return nil
+	}
+
+	keys := make([]string, 0)
+	checked := 0
+	for key, at := range t.expires {
+		if checked >= limit {
+			break
+		}
+		checked++
+		if at <= now {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+func (t *ttlTable) clone() *ttlTable {
+	if t == nil {
+		return nil
+	}
+
+	c := newTTLTable()
+	for key, at := range t.expires {
+		c.expires[key] = at
+	}
+
+	return c
+}
+
+func (d *db) PutTTL(key, value []byte, ttl time.Duration) error {
+	if err := d.allowWrite(len(key) + len(value)); err != nil {
+		return err
+	}
+	value = d.ownValue(value)
+	d.keyLocks.lock(key)
+	defer d.keyLocks.unlock(key)
+	d.lock()
+	defer d.mutex.Unlock()
+
+	err := d.put(key, value)
+	if err != nil {
+		return err
+	}
+
+	if d.ttl == nil {
+		d.ttl = newTTLTable()
+	}
+	d.ttl.set(string(key), d.opts.clock().Add(ttl).UnixNano())
+
+	return nil
+}
+
+// expire removes entry for given key if it expired, reporting whether
+// it did.
+func (d *db) expire(key string) bool {
+	if !d.ttl.isExpired(key, d.opts.clock().UnixNano()) {
+		return false
+	}
+
+	d.removeExpiredKey(key)
+	d.stats.countExpired(false)
+
+	return true
+}
+
+// removeExpired removes all expired entries, so iterations over
+// entries do not see them.
+func (d *db) removeExpired() {
+	if d.ttl != nil {
+		for _, key := range d.ttl.expired(d.opts.clock().UnixNano(), len(d.ttl.expires)) {
+			d.removeExpiredKey(key)
+			d.stats.countExpired(false)
+		}
+	}
+}
+
+// sweep removes up to limit expired entries, checking at most limit
+// entries with TTL.
+func (d *db) sweep(limit int) int {
+	keys := d.ttl.expired(d.opts.clock().UnixNano(), limit)
+	for _, key := range keys {
+		d.removeExpiredKey(key)
+		d.stats.countExpired(true)
+	}
+
+	return len(keys)
+}
+
+func (d *db) removeExpiredKey(key string) {
+	d.remove(key)
+	d.notify(EventExpire, []byte(key), nil)
+}
+
+// startSweeper starts goroutine removing expired entries every
+// interval until datastore is closed.
+func (d *db) startSweeper(interval time.Duration, limit int) {
+	stop := make(chan struct{})
+	d.stopSweeper = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				d.lock()
+				if n := d.sweep(limit); n > 0 {
+					d.opts.logger.Debugf("kvndb: removed %d expired entries", n)
+				}
+				d.mutex.Unlock()
+			}
+		}
+	}()
+}
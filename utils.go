@@ -2,14 +2,12 @@ package kvndb
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
-	"github.com/golang/snappy"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -18,13 +16,20 @@ import (
 	"strings"
 )
 
-func hexToBytes(s string) []byte {
-	b, err := hex.DecodeString(s)
+// readValue reads exactly size bytes from r.
+func readValue(r io.Reader, size int64) ([]byte, error) {
+	value := make([]byte, size)
+	_, err := io.ReadFull(r, value)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return b
+	return value, nil
+}
+
+// readCloser returns no-op closing reader over given value.
+func readCloser(value []byte) io.ReadCloser {
+	return io.NopCloser(bytes.NewReader(value))
 }
 
 func generateSnapshotName(n uint) string {
@@ -35,6 +40,10 @@ func generateChecksumName(n uint) string {
 	return fmt.Sprintf("%06d.sha256", n)
 }
 
+func generateChunksName(n uint) string {
+	return fmt.Sprintf("%06d.chunks", n)
+}
+
 var (
 	re = regexp.MustCompile(`^[0-9]{6}\.kvndb$`)
 )
@@ -81,28 +90,6 @@ func getAllSnapshotIds(dir string) ([]uint, error) {
 	return result, nil
 }
 
-func getSnapshotFDForReading(id uint, dir string) (*snappy.Reader, error) {
-	fd, err := os.Open(getSnapshotFilepath(dir, id))
-	if err != nil {
-		return nil, err
-	}
-
-	r := snappy.NewReader(fd)
-
-	return r, nil
-}
-
-func getSnapshotFDForWriting(id uint, dir string) (*snappy.Writer, error) {
-	fd, err := os.OpenFile(getSnapshotFilepath(dir, id), os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
-		return nil, err
-	}
-
-	w := snappy.NewBufferedWriter(fd)
-
-	return w, nil
-}
-
 func getSnapshotFilepath(dir string, id uint) string {
 	return filepath.Clean(fmt.Sprintf("%s/%s", dir, generateSnapshotName(id)))
 }
@@ -111,6 +98,10 @@ func getChecksumFilepath(dir string, id uint) string {
 	return filepath.Clean(fmt.Sprintf("%s/%s", dir, generateChecksumName(id)))
 }
 
+func getChunksFilepath(dir string, id uint) string {
+	return filepath.Clean(fmt.Sprintf("%s/%s", dir, generateChunksName(id)))
+}
+
 func getMaxSnapshotId(dir string) (uint, error) {
 	fileInfos, err := ioutil.ReadDir(dir)
 	if err != nil {
@@ -139,70 +130,294 @@ func getMaxSnapshotId(dir string) (uint, error) {
 	return maxId, nil
 }
 
+// packBytes packs record with key and value known to fit.
 func packBytes(key, value []byte) []byte {
-	result := make([]byte, 0)
-	dataFrameLength := 8 + len(key) + len(value)
+	result, _ := packRecord(key, value, nil)
+	return result
+}
+
+// packRecord packs record of snapshots before version 4, meta is entry
+// metadata appended after value when snapshot has it. Lengths are
+// uint32, so it returns ErrValueTooLarge for records over 4 GiB rather
+// than truncate them.
+func packRecord(key, value, meta []byte) ([]byte, error) {
+	dataFrameLength := 8 + uint64(len(key)) + uint64(len(value)) + uint64(len(meta))
+	if dataFrameLength > math.MaxUint32 {
+		return nil, ErrValueTooLarge
+	}
+	result := make([]byte, 0, 12+len(key)+len(value)+len(meta))
 
 	result = append(result, uint32ToBytes(uint32(dataFrameLength))...)
 	result = append(result, uint32ToBytes(uint32(len(key)))...)
 	result = append(result, key...)
 	result = append(result, uint32ToBytes(uint32(len(value)))...)
 	result = append(result, value...)
+	result = append(result, meta...)
+
+	return result, nil
+}
+
+// packCompactRecord packs snapshot record of version 4 and later, with
+// lengths of key and value encoded as varints and no length of whole
+// record, as it is implied by them. Varints have no practical limit on
+// length, so values over 4 GiB are stored as is.
+func packCompactRecord(key, value, meta []byte) []byte {
+	result := compactRecordHeader(key, len(value))
+	result = append(result, value...)
+	result = append(result, meta...)
 
 	return result
 }
 
+// writeCompactRecord writes the same record as packCompactRecord, but
+// without copying value into it, so saving huge values does not need
+// twice their size of memory.
+func writeCompactRecord(w io.Writer, key, value, meta []byte) error {
+	for _, b := range [][]byte{compactRecordHeader(key, len(value)), value, meta} {
+		_, err := w.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compactRecordHeader returns part of compact record preceding value.
+func compactRecordHeader(key []byte, vLen int) []byte {
+	result := make([]byte, 0, 2*binary.MaxVarintLen64+len(key))
+	buf := make([]byte, binary.MaxVarintLen64)
+
+	n := binary.PutUvarint(buf, uint64(len(key)))
+	result = append(result, buf[:n]...)
+	result = append(result, key...)
+	n = binary.PutUvarint(buf, uint64(vLen))
+	result = append(result, buf[:n]...)
+
+	return result
+}
+
+// maxRecordLength is the largest key or value length accepted when
+// reading compact records (1 TiB), records claiming more are treated
+// as corrupted.
+const maxRecordLength = 1 << 40
+
+// recordChunkSize is the largest key or value allocated up front when
+// reading records. Bigger ones grow as their data is read, so length
+// of corrupted or forged record can't make reader allocate more than
+// stream actually holds.
+const recordChunkSize = 1 << 20
+
 var (
-	errReadToLittle     = errors.New("io: read less than expected")
 	errDataSizeMismatch = errors.New("io: data size mismatch")
 )
 
-func readNext(fd *snappy.Reader) ([]byte, []byte, error) {
-	r := func(l uint32) ([]byte, error) {
-		buf := make([]byte, l)
-		read, err := io.ReadFull(fd, buf)
-		if err != nil {
-			return nil, err
-		}
-		if read != int(l) {
-			return nil, errReadToLittle
-		}
-		return buf, nil
+// recordReader reads records packed by packRecord, reusing buffers
+// between records where possible. metaSize is size of entry metadata
+// of every record, metadata of the last read record is kept in meta.
+// Records are packed by packCompactRecord if compact is set, records
+// of snapshots written with codec are read by dec instead.
+type recordReader struct {
+	r        io.Reader
+	header   []byte
+	key      []byte
+	metaSize uint32
+	meta     []byte
+	compact  bool
+	dec      RecordDecoder
+}
+
+func newRecordReader(r io.Reader) *recordReader {
+	return &recordReader{
+		r:      r,
+		header: make([]byte, 8),
+	}
+}
+
+// next returns key and value of the next record, io.EOF if there are
+// no more records. Returned key is only valid until the next call.
+func (rr *recordReader) next() ([]byte, []byte, error) {
+	if rr.dec != nil {
+		return rr.dec.Decode()
 	}
 
-	dfLenBytes, err := r(4)
+	key, vLen, err := rr.nextKey()
 	if err != nil {
 		return nil, nil, err
 	}
-	dfLen := bytesToUint32(dfLenBytes)
 
-	kLenBytes, err := r(4)
+	value, err := readRecordBytes(rr.r, nil, vLen)
 	if err != nil {
 		return nil, nil, err
 	}
-	kLen := bytesToUint32(kLenBytes)
 
-	key, err := r(kLen)
+	if rr.metaSize > 0 {
+		if rr.meta == nil {
+			rr.meta = make([]byte, rr.metaSize)
+		}
+		err = readFull(rr.r, rr.meta)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return key, value, nil
+}
+
+// skip returns key of the next record skipping its value, io.EOF if
+// there are no more records. Returned key is only valid until the
+// next call.
+func (rr *recordReader) skip() ([]byte, error) {
+	if rr.dec != nil {
+		key, _, err := rr.dec.Decode()
+		return key, err
+	}
+
+	key, vLen, err := rr.nextKey()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	vLenBytes, err := r(4)
+	_, err = io.CopyN(io.Discard, rr.r, int64(vLen+uint64(rr.metaSize)))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	vLen := bytesToUint32(vLenBytes)
 
-	value, err := r(vLen)
+	return key, nil
+}
+
+// nextKey reads record up to its value, returning key and value length.
+func (rr *recordReader) nextKey() ([]byte, uint64, error) {
+	if rr.compact {
+		return rr.nextCompactKey()
+	}
+
+	// io.EOF here means clean end of records, anywhere after it
+	// means records were truncated
+	_, err := io.ReadFull(rr.r, rr.header[0:8])
 	if err != nil {
-		return nil, nil, err
+		return nil, 0, err
 	}
+	dfLen := bytesToUint32(rr.header[0:4])
+	kLen := bytesToUint32(rr.header[4:8])
 
-	if dfLen != 8+kLen+vLen {
-		return nil, nil, errDataSizeMismatch
+	// validate before allocating anything based on these lengths
+	if dfLen < 8 || kLen > dfLen-8 {
+		return nil, 0, errDataSizeMismatch
 	}
 
-	return key, value, nil
+	key, err := readRecordBytes(rr.r, rr.key, uint64(kLen))
+	if err != nil {
+		return nil, 0, err
+	}
+	rr.key = key
+
+	err = readFull(rr.r, rr.header[0:4])
+	if err != nil {
+		return nil, 0, err
+	}
+	vLen := bytesToUint32(rr.header[0:4])
+
+	if uint64(dfLen) != 8+uint64(kLen)+uint64(vLen)+uint64(rr.metaSize) {
+		return nil, 0, errDataSizeMismatch
+	}
+
+	return key, uint64(vLen), nil
+}
+
+// nextCompactKey is the same as nextKey for records packed by
+// packCompactRecord.
+func (rr *recordReader) nextCompactKey() ([]byte, uint64, error) {
+	// io.EOF here means clean end of records, anywhere after it
+	// means records were truncated
+	kLen, err := rr.readUvarint()
+	if err != nil {
+		return nil, 0, err
+	}
+	if kLen > maxRecordLength {
+		return nil, 0, ErrBadSnapshot
+	}
+
+	key, err := readRecordBytes(rr.r, rr.key, kLen)
+	if err != nil {
+		return nil, 0, err
+	}
+	rr.key = key
+
+	vLen, err := rr.readUvarint()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if vLen > maxRecordLength {
+		return nil, 0, ErrBadSnapshot
+	}
+
+	return key, vLen, nil
+}
+
+// readRecordBytes reads exactly n bytes from r, reusing buf if it is big
+// enough. Buffers over recordChunkSize grow as data is read.
+func readRecordBytes(r io.Reader, buf []byte, n uint64) ([]byte, error) {
+	if uint64(cap(buf)) >= n {
+		buf = buf[:n]
+		return buf, readFull(r, buf)
+	}
+	if n <= recordChunkSize {
+		buf = make([]byte, n)
+		return buf, readFull(r, buf)
+	}
+
+	b := bytes.NewBuffer(make([]byte, 0, recordChunkSize))
+	_, err := io.CopyN(b, r, int64(n))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// readUvarint reads varint byte by byte, so nothing past it is
+// consumed. It returns io.EOF only if there were no bytes at all.
+func (rr *recordReader) readUvarint() (uint64, error) {
+	var x uint64
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		_, err := io.ReadFull(rr.r, rr.header[0:1])
+		if err == io.EOF && i > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		b := rr.header[0]
+		if b < 0x80 {
+			if i == binary.MaxVarintLen64-1 && b > 1 {
+				return 0, errDataSizeMismatch
+			}
+			return x | uint64(b)<<(7*i), nil
+		}
+		x |= uint64(b&0x7f) << (7 * i)
+	}
+
+	return 0, errDataSizeMismatch
+}
+
+// readFull is the same as io.ReadFull, but treats io.EOF as unexpected.
+func readFull(r io.Reader, buf []byte) error {
+	_, err := io.ReadFull(r, buf)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
 }
 
 func bytesToUint32(data []byte) uint32 {
@@ -215,8 +430,36 @@ func uint32ToBytes(data uint32) []byte {
 	return bs
 }
 
-func cleanupSnapshotsUpTo(dir string, hist uint) error {
+func uint16ToBytes(data uint16) []byte {
+	bs := make([]byte, 2)
+	binary.LittleEndian.PutUint16(bs, data)
+	return bs
+}
+
+func bytesToUint64(data []byte) uint64 {
+	return binary.LittleEndian.Uint64(data)
+}
+
+func uint64ToBytes(data uint64) []byte {
+	bs := make([]byte, 8)
+	binary.LittleEndian.PutUint64(bs, data)
+	return bs
+}
+
+// cleanupSnapshotsUpTo removes all but hist+1 latest snapshots, or
+// moves them to trash if set by WithTrash. If retire is not nil, it is
+// called before every snapshot is removed, and snapshots it fails for
+// are kept.
+func cleanupSnapshotsUpTo(dir string, hist uint, retire func(info SnapshotInfo) error, o *options) error {
 	keep := hist + 1
+	logger := o.logger
+
+	if o.trash {
+		err := purgeTrash(dir, o.trashGrace, logger)
+		if err != nil {
+			return err
+		}
+	}
 
 	ids, err := getAllSnapshotIds(dir)
 	if err != nil {
@@ -230,6 +473,24 @@ func cleanupSnapshotsUpTo(dir string, hist uint) error {
 	toDelete := ids[:(len(ids) - int(keep))]
 
 	for _, id := range toDelete {
+		if retire != nil {
+			err = retireSnapshot(dir, id, retire)
+			if err != nil {
+				logger.Errorf("kvndb: keeping snapshot %d in %s, failed to retire it: %v", id, dir, err)
+				continue
+			}
+		}
+
+		if o.trash {
+			logger.Debugf("kvndb: moving snapshot %d from %s to trash", id, dir)
+			err = trashSnapshot(dir, id, o.dirPerm())
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		logger.Debugf("kvndb: removing snapshot %d from %s", id, dir)
 		err = os.Remove(getSnapshotFilepath(dir, id))
 		if err != nil {
 			return err
@@ -238,37 +499,74 @@ func cleanupSnapshotsUpTo(dir string, hist uint) error {
 		if err != nil {
 			return err
 		}
+		err = os.Remove(getChunksFilepath(dir, id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func getSnapshotChecksum(id uint, dir string) ([]byte, error) {
-	fd, err := getSnapshotFDForReading(id, dir)
+// retireSnapshot calls retire with details of snapshot with given id.
+// Number of entries is not known without reading snapshot and is left
+// zero.
+func retireSnapshot(dir string, id uint, retire func(info SnapshotInfo) error) error {
+	checksum, err := readSnapshotChecksum(id, dir)
+	if err != nil {
+		return err
+	}
+
+	return retire(SnapshotInfo{
+		Id:           id,
+		Dir:          dir,
+		Path:         getSnapshotFilepath(dir, id),
+		ChecksumPath: getChecksumFilepath(dir, id),
+		Checksum:     checksum,
+	})
+}
+
+func writeSnapshotChecksum(id uint, dir string, perm os.FileMode, sync bool) ([]byte, error) {
+	hash, err := getSnapshotChecksum(id, dir)
 	if err != nil {
 		return nil, err
 	}
 
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, fd); err != nil {
+	err = writeFile(getChecksumFilepath(dir, id), hash, perm, sync)
+	if err != nil {
 		return nil, err
 	}
 
-	return hasher.Sum(nil), nil
+	return hash, nil
 }
 
-func writeSnapshotChecksum(id uint, dir string) error {
-	hash, err := getSnapshotChecksum(id, dir)
+// writeFile is the same as ioutil.WriteFile, but optionally flushes
+// file to stable storage.
+func writeFile(name string, data []byte, perm os.FileMode, sync bool) error {
+	fd, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(getChecksumFilepath(dir, id), hash, 0600)
+	_, err = fd.Write(data)
+	if err == nil && sync {
+		err = fd.Sync()
+	}
+	if err != nil {
+		_ = fd.Close()
+		return err
+	}
+
+	return fd.Close()
+}
+
+func readSnapshotChecksum(id uint, dir string) ([]byte, error) {
+	return ioutil.ReadFile(getChecksumFilepath(dir, id))
 }
 
 func verifySnapshotChecksum(id uint, dir string) error {
 	// read stored checksum
-	storedHash, err := ioutil.ReadFile(getChecksumFilepath(dir, id))
+	storedHash, err := readSnapshotChecksum(id, dir)
 	if err != nil {
 		return err
 	}
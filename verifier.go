@@ -0,0 +1,158 @@
+package kvndb
+
+import (
+	"errors"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+const (
+	defaultVerifyInterval = time.Hour
+)
+
+// VerifyFailure describes snapshot which failed background
+// verification.
+type VerifyFailure struct {
+	// Dir is snapshot directory.
+	Dir string
+	// Id is id of snapshot.
+	Id uint
+	// Regions are corrupted regions of snapshot file, empty if it
+	// could not be verified at all.
+	Regions []CorruptRegion
+	// Err is error which prevented verification, nil if snapshot was
+	// verified and found corrupted.
+	Err error
+}
+
+// Verifier periodically verifies all snapshots in a directory, so
+// corruption of stored snapshots is found before they are needed.
+type Verifier struct {
+	dir       string
+	interval  time.Duration
+	onFailure func(f VerifyFailure)
+	logger    Logger
+	mutex     sync.Mutex
+	runs      uint64
+	failures  uint64
+	lastRun   time.Time
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// StartVerifier starts verifying all snapshots in given directory every
+// interval, until Close is called. Failures are logged with logger set
+// by options and passed to onFailure, unless it is nil. onFailure is
+// called from verifier goroutine. interval of 0 or less selects default
+// of one hour.
+func StartVerifier(dir string, interval time.Duration, onFailure func(f VerifyFailure), opts ...Option) *Verifier {
+	if interval <= 0 {
+		interval = defaultVerifyInterval
+	}
+
+	v := &Verifier{
+		dir:       dir,
+		interval:  interval,
+		onFailure: onFailure,
+		logger:    newOptions(opts).logger,
+		stop:      make(chan struct{}),
+	}
+
+	v.wg.Add(1)
+	go v.run()
+
+	return v
+}
+
+func (v *Verifier) run() {
+	defer v.wg.Done()
+
+	ticker := time.NewTicker(v.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-v.stop:
+			return
+		case <-ticker.C:
+			v.verify()
+		}
+	}
+}
+
+// verify verifies all snapshots in directory once.
+func (v *Verifier) verify() {
+	ids, err := getAllSnapshotIds(v.dir)
+	if err != nil {
+		v.fail(VerifyFailure{Dir: v.dir, Err: err})
+		return
+	}
+
+	for _, id := range ids {
+		regions, err := VerifySnapshot(v.dir, id)
+		// snapshots being saved or removed are verified next time
+		if errors.Is(err, ErrDirLocked) || errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil || len(regions) > 0 {
+			v.fail(VerifyFailure{Dir: v.dir, Id: id, Regions: regions, Err: err})
+		}
+	}
+
+	v.mutex.Lock()
+	v.runs++
+	v.lastRun = time.Now()
+	v.mutex.Unlock()
+
+	v.logger.Debugf("kvndb: verified %d snapshots in %s", len(ids), v.dir)
+}
+
+func (v *Verifier) fail(f VerifyFailure) {
+	v.mutex.Lock()
+	v.failures++
+	v.mutex.Unlock()
+
+	if f.Err != nil {
+		v.logger.Errorf("kvndb: failed to verify snapshot %d in %s: %v", f.Id, f.Dir, f.Err)
+	} else {
+		v.logger.Errorf("kvndb: snapshot %d in %s is corrupted in %d regions", f.Id, f.Dir, len(f.Regions))
+	}
+
+	if v.onFailure != nil {
+		v.onFailure(f)
+	}
+}
+
+// Runs returns number of completed verifications of all snapshots.
+func (v *Verifier) Runs() uint64 {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	return v.runs
+}
+
+// Failures returns number of snapshots which failed verification, a
+// snapshot is counted every time it fails.
+func (v *Verifier) Failures() uint64 {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	return v.failures
+}
+
+// LastRun returns time the last verification of all snapshots
+// completed, zero if there was none.
+func (v *Verifier) LastRun() time.Time {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	return v.lastRun
+}
+
+// Close stops verifier, waiting for verification in progress to
+// finish.
+func (v *Verifier) Close() {
+	close(v.stop)
+	v.wg.Wait()
+}
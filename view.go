@@ -0,0 +1,25 @@
+package kvndb
+
+// readOnlyView restricts datastore to operations of ReadOnlyDB. It is a
+// separate type, so it can't be type asserted to DB.
+type readOnlyView struct {
+	ReadOnlyDB
+}
+
+func (d *db) ReadOnlyView() ReadOnlyDB {
+	return &readOnlyView{
+		ReadOnlyDB: d,
+	}
+}
+
+// Close does nothing, datastore is closed by its owner.
+func (v *readOnlyView) Close() error {
+	return nil
+}
+
+// snapshotView is ReadOnlyDB returned by OpenSnapshot. Like readOnlyView
+// it can't be type asserted to DB, but it owns datastore it wraps, so
+// Close closes it.
+type snapshotView struct {
+	ReadOnlyDB
+}
@@ -0,0 +1,389 @@
+package kvndb
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// vlogPtr points to a value stored in value log file.
+type vlogPtr struct {
+	offset int64
+	length int64
+}
+
+// valueLog is an append-only file holding large values. It only
+// extends memory of the datastore and is not a persistence mechanism,
+// file is removed when datastore is closed. File descriptor is kept
+// open for as long as there are readers returned by reader.
+type valueLog struct {
+	dir     string
+	fd      *os.File
+	size    int64
+	mutex   sync.Mutex
+	readers int
+	removed bool
+}
+
+func (l *valueLog) open() error {
+	if l.fd != nil {
+		return nil
+	}
+
+	fd, err := os.CreateTemp(l.dir, "*.vlog")
+	if err != nil {
+		return err
+	}
+
+	l.fd = fd
+	l.size = 0
+
+	return nil
+}
+
+func (l *valueLog) append(value []byte) (vlogPtr, error) {
+	if err := l.open(); err != nil {
+		return vlogPtr{}, err
+	}
+
+	n, err := l.fd.WriteAt(value, l.size)
+	if err != nil {
+		return vlogPtr{}, err
+	}
+
+	ptr := vlogPtr{
+		offset: l.size,
+		length: int64(n),
+	}
+	l.size += int64(n)
+
+	return ptr, nil
+}
+
+// appendFrom copies exactly size bytes from r to the end of value log.
+func (l *valueLog) appendFrom(r io.Reader, size int64) (vlogPtr, error) {
+	if err := l.open(); err != nil {
+		return vlogPtr{}, err
+	}
+
+	buf := make([]byte, 32*1024)
+	var written int64
+	for written < size {
+		chunk := buf
+		if size-written < int64(len(chunk)) {
+			chunk = chunk[:size-written]
+		}
+		n, err := io.ReadFull(r, chunk)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return vlogPtr{}, err
+		}
+		_, err = l.fd.WriteAt(chunk[:n], l.size+written)
+		if err != nil {
+			return vlogPtr{}, err
+		}
+		written += int64(n)
+	}
+
+	ptr := vlogPtr{
+		offset: l.size,
+		length: size,
+	}
+	l.size += size
+
+	return ptr, nil
+}
+
+// reader returns reader over value pointed by ptr. Value log file stays
+// open until returned reader is closed.
+func (l *valueLog) reader(ptr vlogPtr) io.ReadCloser {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.readers++
+
+	return &vlogReader{
+		SectionReader: io.NewSectionReader(l.fd, ptr.offset, ptr.length),
+		log:           l,
+	}
+}
+
+func (l *valueLog) read(ptr vlogPtr) ([]byte, error) {
+	value := make([]byte, ptr.length)
+	n, err := l.fd.ReadAt(value, ptr.offset)
+	if int64(n) == ptr.length {
+		return value, nil
+	}
+	// value log shorter than pointer was truncated behind our back
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return nil, err
+}
+
+// remove deletes value log file, after that value log must not be
+// used anymore. If there are open readers, file is closed and deleted
+// once the last one of them is closed.
+func (l *valueLog) remove() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.removed = true
+	if l.readers > 0 {
+		return nil
+	}
+
+	return l.closeAndRemove()
+}
+
+func (l *valueLog) releaseReader() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.readers--
+	if l.readers > 0 || !l.removed {
+		return nil
+	}
+
+	return l.closeAndRemove()
+}
+
+func (l *valueLog) closeAndRemove() error {
+	if l.fd == nil {
+		return nil
+	}
+
+	fd := l.fd
+	l.fd = nil
+	l.size = 0
+
+	err := fd.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(fd.Name())
+}
+
+// vlogReader is a reader over single value in value log.
+type vlogReader struct {
+	*io.SectionReader
+	log    *valueLog
+	closed bool
+}
+
+func (r *vlogReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	return r.log.releaseReader()
+}
+
+// hybridEngine keeps values of at least threshold bytes in value log
+// on disk and only pointers to them in memory. Smaller values are
+// kept by wrapped engine.
+type hybridEngine struct {
+	engine
+	threshold int
+	log       *valueLog
+	ptrs      map[string]vlogPtr
+	live      int64
+	garbage   int64
+	keyBytes  int64
+	logger    Logger
+}
+
+func newHybridEngine(e engine, dir string, threshold int, logger Logger) *hybridEngine {
+	return &hybridEngine{
+		engine:    e,
+		threshold: threshold,
+		log:       &valueLog{dir: dir},
+		ptrs:      make(map[string]vlogPtr),
+		logger:    logger,
+	}
+}
+
+func (e *hybridEngine) get(key string) ([]byte, error) {
+	if ptr, ok := e.ptrs[key]; ok {
+		return e.log.read(ptr)
+	}
+
+	return e.engine.get(key)
+}
+
+func (e *hybridEngine) put(key string, value []byte) error {
+	if len(value) < e.threshold {
+		e.release(key)
+		return e.engine.put(key, value)
+	}
+
+	ptr, err := e.log.append(value)
+	if err != nil {
+		return err
+	}
+
+	e.release(key)
+	e.engine.delete(key)
+	e.ptrs[key] = ptr
+	e.live += ptr.length
+	e.keyBytes += int64(len(key))
+
+	// failed compaction leaves value log intact, it will be
+	// retried on next put, so the error is not of caller concern
+	if err := e.maybeCompact(); err != nil {
+		e.logger.Warnf("kvndb: value log compaction failed: %v", err)
+	}
+
+	return nil
+}
+
+func (e *hybridEngine) delete(key string) bool {
+	_, ok := e.ptrs[key]
+	e.release(key)
+
+	return e.engine.delete(key) || ok
+}
+
+func (e *hybridEngine) len() int {
+	return e.engine.len() + len(e.ptrs)
+}
+
+// memSize only counts pointers of values kept in value log.
+func (e *hybridEngine) memSize() int64 {
+	return e.engine.memSize() + e.keyBytes + int64(len(e.ptrs))*mapEntryOverhead
+}
+
+func (e *hybridEngine) forEach(fn func(key string, value []byte) error) error {
+	err := e.engine.forEach(fn)
+	if err != nil {
+		return err
+	}
+
+	for key, ptr := range e.ptrs {
+		value, err := e.log.read(ptr)
+		if err != nil {
+			return err
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *hybridEngine) reset() error {
+	old := e.log
+	e.log = &valueLog{dir: old.dir}
+	e.ptrs = make(map[string]vlogPtr)
+	e.live = 0
+	e.garbage = 0
+	e.keyBytes = 0
+
+	if err := old.remove(); err != nil {
+		return err
+	}
+
+	return e.engine.reset()
+}
+
+func (e *hybridEngine) putReader(key string, r io.Reader, size int64) error {
+	if size < int64(e.threshold) {
+		value, err := readValue(r, size)
+		if err != nil {
+			return err
+		}
+		return e.put(key, value)
+	}
+
+	ptr, err := e.log.appendFrom(r, size)
+	if err != nil {
+		return err
+	}
+
+	e.release(key)
+	e.engine.delete(key)
+	e.ptrs[key] = ptr
+	e.live += ptr.length
+	e.keyBytes += int64(len(key))
+
+	// see put on why error is not returned
+	if err := e.maybeCompact(); err != nil {
+		e.logger.Warnf("kvndb: value log compaction failed: %v", err)
+	}
+
+	return nil
+}
+
+func (e *hybridEngine) getReader(key string) (io.ReadCloser, error) {
+	if ptr, ok := e.ptrs[key]; ok {
+		return e.log.reader(ptr), nil
+	}
+
+	value, err := e.engine.get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return readCloser(value), nil
+}
+
+func (e *hybridEngine) close() error {
+	e.ptrs = nil
+
+	if err := e.log.remove(); err != nil {
+		return err
+	}
+
+	return e.engine.close()
+}
+
+// release marks value log space of given key, if any, as garbage.
+func (e *hybridEngine) release(key string) {
+	ptr, ok := e.ptrs[key]
+	if !ok {
+		return
+	}
+
+	delete(e.ptrs, key)
+	e.keyBytes -= int64(len(key))
+	e.live -= ptr.length
+	e.garbage += ptr.length
+}
+
+// maybeCompact rewrites live values into fresh value log once garbage
+// takes more space than live values.
+func (e *hybridEngine) maybeCompact() error {
+	if e.garbage < int64(e.threshold) || e.garbage < e.live {
+		return nil
+	}
+
+	e.logger.Debugf("kvndb: compacting value log, %d bytes live, %d bytes garbage", e.live, e.garbage)
+
+	log := &valueLog{dir: e.log.dir}
+	ptrs := make(map[string]vlogPtr, len(e.ptrs))
+	for key, ptr := range e.ptrs {
+		value, err := e.log.read(ptr)
+		if err != nil {
+			_ = log.remove()
+			return err
+		}
+		ptrs[key], err = log.append(value)
+		if err != nil {
+			_ = log.remove()
+			return err
+		}
+	}
+
+	old := e.log
+	e.log = log
+	e.ptrs = ptrs
+	e.garbage = 0
+
+	return old.remove()
+}
@@ -0,0 +1,73 @@
+package kvndb
+
+import (
+	"context"
+	"errors"
+)
+
+func (d *db) WaitFor(ctx context.Context, key []byte) ([]byte, error) {
+	for {
+		d.lock()
+		value, err := d.get(key)
+		if !errors.Is(err, ErrKeyNotFound) {
+			d.mutex.Unlock()
+			return d.safeValue(value), err
+		}
+		ch := d.addWaiter(string(key))
+		d.mutex.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			d.lock()
+			d.removeWaiter(string(key), ch)
+			d.mutex.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// addWaiter returns channel closed once entry for given key may have
+// appeared.
+func (d *db) addWaiter(key string) chan struct{} {
+	if d.waiters == nil {
+		d.waiters = make(map[string][]chan struct{})
+	}
+
+	ch := make(chan struct{})
+	d.waiters[key] = append(d.waiters[key], ch)
+
+	return ch
+}
+
+func (d *db) removeWaiter(key string, ch chan struct{}) {
+	waiting := d.waiters[key]
+	for i, w := range waiting {
+		if w == ch {
+			waiting = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+
+	if len(waiting) == 0 {
+		delete(d.waiters, key)
+	} else {
+		d.waiters[key] = waiting
+	}
+}
+
+// wakeWaiters wakes all waiting for entry with given key.
+func (d *db) wakeWaiters(key string) {
+	for _, ch := range d.waiters[key] {
+		close(ch)
+	}
+	delete(d.waiters, key)
+}
+
+// wakeAllWaiters wakes all waiting for any entry, so they check
+// again after data was replaced or datastore was closed.
+func (d *db) wakeAllWaiters() {
+	for key := range d.waiters {
+		d.wakeWaiters(key)
+	}
+}